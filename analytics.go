@@ -0,0 +1,335 @@
+/*
+ * Statistics of a selection round
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Fill curves and year group popularity come from the selection times of
+ * the choices currently held, so they describe the final result of the
+ * round. Demand, changes of mind and confirmation times come from the
+ * choice_events history, which only records what students did through the
+ * selection page, including choices refused because the course was full,
+ * and forced choices given when they log in. It is cleared along with the
+ * choices when new courses are uploaded.
+ */
+
+type fillPointT struct {
+	Time  time.Time `json:"time"`
+	Count int       `json:"count"`
+}
+
+type courseAnalyticsT struct {
+	ID       int    `json:"id"`
+	Title    string `json:"title"`
+	Teacher  string `json:"teacher"`
+	Type     string `json:"type"`
+	Group    string `json:"group"`
+	Max      int    `json:"max"`
+	Selected int    `json:"selected"`
+	/* Students who have held the course or were refused it for being full */
+	Demand      int            `json:"demand"`
+	DemandRatio float64        `json:"demand_ratio"`
+	Dropped     int            `json:"dropped"`
+	FilledAt    *time.Time     `json:"filled_at"`
+	ByYearGroup map[string]int `json:"by_year_group"`
+	Fill        []fillPointT   `json:"fill"`
+	/* SVG polyline points for the page, scaled to analyticsSparkline* */
+	Sparkline string `json:"-"`
+}
+
+type funnelStepT struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	/* Relative to the first step */
+	Percent int `json:"percent"`
+}
+
+type funnelT struct {
+	YearGroup string        `json:"year_group"`
+	Steps     []funnelStepT `json:"steps"`
+}
+
+type analyticsT struct {
+	Term       int64              `json:"term"`
+	Generated  time.Time          `json:"generated"`
+	Start      *time.Time         `json:"start"`
+	YearGroups []string           `json:"year_groups"`
+	Courses    []courseAnalyticsT `json:"courses"`
+	Funnels    []funnelT          `json:"funnels"`
+	/* Students who have dropped at least one course */
+	ChangedMinds int `json:"changed_minds"`
+	/* From each student's first choice to their first confirmation */
+	ConfirmationCount         int     `json:"confirmation_count"`
+	ConfirmationMedianSeconds float64 `json:"confirmation_median_seconds"`
+	ConfirmationP90Seconds    float64 `json:"confirmation_p90_seconds"`
+}
+
+const (
+	analyticsSparklineWidth  = 200
+	analyticsSparklineHeight = 40
+)
+
+/* Year groups in ascending order */
+func getYearGroups() []string {
+	yearGroups := getKeysOfMap(yearGroupsNumberBits)
+	sort.Slice(yearGroups, func(i, j int) bool {
+		return yearGroupsNumberBits[yearGroups[i]] < yearGroupsNumberBits[yearGroups[j]]
+	})
+	return yearGroups
+}
+
+func getAnalytics(ctx context.Context, term int64) (analyticsT, error) {
+	//exhaustruct:ignore
+	analytics := analyticsT{
+		Term:       term,
+		Generated:  time.Now(),
+		YearGroups: getYearGroups(),
+	}
+
+	sortedCourses, err := getTermCourses(ctx, term)
+	if err != nil {
+		return analytics, err
+	}
+	indices := make(map[int]int, len(sortedCourses))
+	analytics.Courses = make([]courseAnalyticsT, len(sortedCourses))
+	for i, course := range sortedCourses {
+		indices[course.ID] = i
+		//exhaustruct:ignore
+		analytics.Courses[i] = courseAnalyticsT{
+			ID:          course.ID,
+			Title:       course.Title,
+			Teacher:     course.Teacher,
+			Type:        course.Type,
+			Group:       course.Group,
+			Max:         int(course.Max),
+			ByYearGroup: make(map[string]int),
+			Fill:        []fillPointT{},
+		}
+	}
+	holders := make(map[int]map[string]struct{}, len(sortedCourses))
+	firstChoice := make(map[string]time.Time)
+
+	timedChoices, err := store.getTimedChoices(ctx, term)
+	if err != nil {
+		return analytics, err
+	}
+	for _, c := range timedChoices {
+		i, ok := indices[c.CourseID]
+		if !ok {
+			continue
+		}
+		t := c.SelTime
+		if analytics.Start == nil {
+			analytics.Start = &t
+		}
+		course := &analytics.Courses[i]
+		course.Selected++
+		course.ByYearGroup[c.Department]++
+		course.Fill = append(course.Fill, fillPointT{t, course.Selected})
+		if course.Selected == course.Max {
+			course.FilledAt = &t
+		}
+		if holders[c.CourseID] == nil {
+			holders[c.CourseID] = make(map[string]struct{})
+		}
+		holders[c.CourseID][c.UserID] = struct{}{}
+	}
+
+	events, err := store.getChoiceEvents(ctx, term)
+	if err != nil {
+		return analytics, err
+	}
+	changedMinds := make(map[string]struct{})
+	firstConfirmation := make(map[string]time.Time)
+	for _, event := range events {
+		switch event.Kind {
+		case "choose":
+			if _, ok := firstChoice[event.UserID]; !ok {
+				firstChoice[event.UserID] = event.Time
+			}
+			if event.CourseID == nil {
+				continue
+			}
+			if holders[*event.CourseID] == nil {
+				holders[*event.CourseID] = make(map[string]struct{})
+			}
+			holders[*event.CourseID][event.UserID] = struct{}{}
+		case "full":
+			if event.CourseID == nil {
+				continue
+			}
+			if holders[*event.CourseID] == nil {
+				holders[*event.CourseID] = make(map[string]struct{})
+			}
+			holders[*event.CourseID][event.UserID] = struct{}{}
+		case "unchoose":
+			changedMinds[event.UserID] = struct{}{}
+			if event.CourseID == nil {
+				continue
+			}
+			if i, ok := indices[*event.CourseID]; ok {
+				analytics.Courses[i].Dropped++
+			}
+		case "confirm":
+			if _, ok := firstConfirmation[event.UserID]; !ok {
+				firstConfirmation[event.UserID] = event.Time
+			}
+		}
+	}
+	analytics.ChangedMinds = len(changedMinds)
+
+	var durations []float64
+	for userID, confirmed := range firstConfirmation {
+		chosen, ok := firstChoice[userID]
+		if !ok || confirmed.Before(chosen) {
+			continue
+		}
+		durations = append(durations, confirmed.Sub(chosen).Seconds())
+	}
+	sort.Float64s(durations)
+	analytics.ConfirmationCount = len(durations)
+	if len(durations) != 0 {
+		analytics.ConfirmationMedianSeconds = durations[len(durations)/2]
+		analytics.ConfirmationP90Seconds = durations[len(durations)*9/10]
+	}
+
+	start := analytics.Generated
+	if analytics.Start != nil {
+		start = *analytics.Start
+	}
+	for i := range analytics.Courses {
+		course := &analytics.Courses[i]
+		course.Demand = len(holders[course.ID])
+		if course.Max != 0 {
+			course.DemandRatio = float64(course.Demand) / float64(course.Max)
+		}
+		course.Sparkline = fillSparkline(course.Fill, course.Max, start, analytics.Generated)
+	}
+
+	analytics.Funnels, err = getFunnels(ctx, term, analytics.YearGroups)
+	if err != nil {
+		return analytics, err
+	}
+
+	return analytics, nil
+}
+
+/*
+ * The first funnel covers everyone, starting from the expected students,
+ * and is followed by one for each year group, starting from those who
+ * have logged in, since expected students have no year group.
+ */
+func getFunnels(ctx context.Context, term int64, yearGroups []string) ([]funnelT, error) {
+	expected, err := store.countExpectedStudents(ctx, term)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := store.getYearGroupCounts(ctx, term)
+	if err != nil {
+		return nil, err
+	}
+	var total yearGroupCountsT
+	for _, c := range counts {
+		total.Total += c.Total
+		total.Chosen += c.Chosen
+		total.Confirmed += c.Confirmed
+	}
+
+	funnels := []funnelT{{
+		YearGroup: "All",
+		Steps: funnelSteps(
+			[]string{"Expected", "Logged in", "Chosen", "Confirmed"},
+			[]int{expected, total.Total, total.Chosen, total.Confirmed},
+		),
+	}}
+	for _, yearGroup := range yearGroups {
+		c := counts[yearGroup]
+		funnels = append(funnels, funnelT{
+			YearGroup: yearGroup,
+			Steps: funnelSteps(
+				[]string{"Logged in", "Chosen", "Confirmed"},
+				[]int{c.Total, c.Chosen, c.Confirmed},
+			),
+		})
+	}
+	return funnels, nil
+}
+
+func funnelSteps(names []string, counts []int) []funnelStepT {
+	steps := make([]funnelStepT, len(names))
+	for i, name := range names {
+		percent := 0
+		if counts[0] != 0 {
+			percent = counts[i] * 100 / counts[0]
+		}
+		steps[i] = funnelStepT{name, counts[i], percent}
+	}
+	return steps
+}
+
+/*
+ * A step line from the start of the round to now, with full capacity at
+ * the top.
+ */
+func fillSparkline(fill []fillPointT, capacity int, start, end time.Time) string {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	span := end.Sub(start)
+	x := func(t time.Time) string {
+		if span <= 0 {
+			return "0"
+		}
+		return strconv.FormatFloat(
+			float64(t.Sub(start))/float64(span)*analyticsSparklineWidth,
+			'f', 1, 64,
+		)
+	}
+	y := func(count int) string {
+		count = min(count, capacity)
+		return strconv.FormatFloat(
+			analyticsSparklineHeight-float64(count)/float64(capacity)*analyticsSparklineHeight,
+			'f', 1, 64,
+		)
+	}
+
+	points := []string{"0," + y(0)}
+	last := 0
+	for _, point := range fill {
+		points = append(points, x(point.Time)+","+y(last), x(point.Time)+","+y(point.Count))
+		last = point.Count
+	}
+	points = append(points, strconv.Itoa(analyticsSparklineWidth)+","+y(last))
+	return strings.Join(points, " ")
+}
+
+func (analytics analyticsT) ConfirmationMedian() string {
+	return (time.Duration(analytics.ConfirmationMedianSeconds) * time.Second).String()
+}
+
+func (analytics analyticsT) ConfirmationP90() string {
+	return (time.Duration(analytics.ConfirmationP90Seconds) * time.Second).String()
+}
+
+func (course courseAnalyticsT) DemandPercent() int {
+	return min(int(course.DemandRatio*100), 100)
+}
+
+func (course courseAnalyticsT) FilledAtString() string {
+	if course.FilledAt == nil {
+		return ""
+	}
+	return course.FilledAt.In(loc).Format(time.DateTime)
+}
@@ -0,0 +1,138 @@
+/*
+ * Staff announcements
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+/*
+ * Announcements are pushed to connected students as
+ *
+ *    A <id> <created> :<body>
+ *
+ * where <created> is a UNIX timestamp in seconds, and removed with
+ *
+ *    AD <id>
+ *
+ * Students who connect later receive every announcement for their year group
+ * right after the snapshot.
+ */
+
+const announcementMaxLength = 2000
+
+type announcementT struct {
+	ID         int
+	Body       string
+	YearGroups uint8
+	Author     string
+	Created    time.Time
+}
+
+func (a announcementT) message() string {
+	return "A " + strconv.Itoa(a.ID) + " " +
+		strconv.FormatInt(a.Created.Unix(), 10) + " :" + a.Body
+}
+
+func (a announcementT) CreatedString() string {
+	return a.Created.In(loc).Format("2006-01-02 15:04")
+}
+
+func (a announcementT) YearGroupsString() string {
+	return yearGroupsNumberToString(a.YearGroups)
+}
+
+/*
+ * Get announcements visible to a year group, newest first. If yeargroup is
+ * the staff department, all announcements are returned.
+ */
+func getAnnouncements(
+	ctx context.Context,
+	yeargroup string,
+) ([]announcementT, error) {
+	all, err := store.getAllAnnouncements(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if yeargroup == staffDepartment {
+		return all, nil
+	}
+	var announcements []announcementT
+	for _, a := range all {
+		if a.YearGroups&yearGroupsNumberBits[yeargroup] != 0 {
+			announcements = append(announcements, a)
+		}
+	}
+	return announcements, nil
+}
+
+func sendAnnouncements(
+	ctx context.Context,
+	c *websocket.Conn,
+	yeargroup string,
+) error {
+	announcements, err := getAnnouncements(ctx, yeargroup)
+	if err != nil {
+		return err
+	}
+	/* Oldest first, so that the client could simply prepend each one */
+	for i := len(announcements) - 1; i >= 0; i-- {
+		err := writeText(ctx, c, announcements[i].message())
+		if err != nil {
+			return wrapError(errCannotSend, err)
+		}
+	}
+	return nil
+}
+
+func createAnnouncement(
+	ctx context.Context,
+	body string,
+	yearGroups uint8,
+	author string,
+) error {
+	a := announcementT{
+		ID:         0,
+		Body:       body,
+		YearGroups: yearGroups,
+		Author:     author,
+		Created:    time.Now(),
+	}
+	err := store.insertAnnouncement(ctx, &a)
+	if err != nil {
+		return err
+	}
+	notifyCluster(ctx, clusterAnnounce, strconv.Itoa(a.ID))
+	return propagateToYearGroups(a.YearGroups, a.message())
+}
+
+func deleteAnnouncement(ctx context.Context, id int) error {
+	yearGroups, err := store.deleteAnnouncement(ctx, id)
+	if err != nil {
+		return err
+	}
+	notifyCluster(ctx, clusterUnannounce, strconv.Itoa(id), strconv.FormatUint(uint64(yearGroups), 10))
+	return propagateToYearGroups(yearGroups, "AD "+strconv.Itoa(id))
+}
+
+func propagateToYearGroups(yearGroups uint8, msg string) error {
+	for yeargroup, bit := range yearGroupsNumberBits {
+		if yearGroups&bit == 0 {
+			continue
+		}
+		err := propagate(yeargroup, msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
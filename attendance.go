@@ -0,0 +1,186 @@
+/*
+ * Attendance sheets
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"io"
+	"strconv"
+	"time"
+)
+
+/*
+ * Each course gets its own sheet, on landscape A4, with one row for each
+ * student and one column for each date the course's group meets in the
+ * term. Sheets that don't fit on a page are split across pages, by students
+ * first and then by dates. Rows left over on the last page of students are
+ * kept blank for students who join late.
+ */
+
+const (
+	attendanceMargin       = 36
+	attendanceRowHeight    = 16
+	attendanceHeaderHeight = 44
+	attendanceMinDateWidth = 14
+	attendanceMaxDateWidth = 40
+	attendanceFontSize     = 9
+)
+
+var attendanceColumns = [...]struct {
+	Title string
+	Width float64
+}{
+	{"#", 20},
+	{"Name", 170},
+	{"ID", 50},
+	{"Year", 32},
+}
+
+func writeAttendanceSheets(w io.Writer, rosters []rosterT) error {
+	p := newPDF(pdfA4Height, pdfA4Width)
+	generated := "Generated " + time.Now().In(loc).Format("2006-01-02 15:04")
+	for _, roster := range rosters {
+		drawAttendanceSheet(p, roster, generated)
+	}
+	if len(p.pages) == 0 {
+		p.addPage()
+		p.text(attendanceMargin, p.Height-attendanceMargin-16, 12, false, "No courses")
+	}
+	return p.writeTo(w)
+}
+
+func drawAttendanceSheet(p *pdfT, roster rosterT, generated string) {
+	course := roster.Course
+	dates := getTermDates(courseGroupWeekdays[course.Group])
+
+	var fixedWidth float64
+	for _, column := range attendanceColumns {
+		fixedWidth += column.Width
+	}
+	contentWidth := p.Width - 2*attendanceMargin
+	tableTop := p.Height - attendanceMargin - 44
+
+	datesPerPage := int((contentWidth - fixedWidth) / attendanceMinDateWidth)
+	rowsPerPage := int((tableTop - attendanceHeaderHeight - attendanceMargin - 12) / attendanceRowHeight)
+
+	studentPages := (len(roster.Entries) + rowsPerPage - 1) / rowsPerPage
+	if studentPages == 0 {
+		studentPages = 1
+	}
+	datePages := (len(dates) + datesPerPage - 1) / datesPerPage
+	if datePages == 0 {
+		datePages = 1
+	}
+	totalPages := studentPages * datePages
+
+	subtitle := "Teacher: " + course.Teacher +
+		"   Location: " + course.Location +
+		"   Group: " + courseGroups[course.Group] +
+		"   Section: " + course.SectionID
+
+	for datePage := 0; datePage < datePages; datePage++ {
+		pageDates := dates[min(datePage*datesPerPage, len(dates)):min((datePage+1)*datesPerPage, len(dates))]
+		dateWidth := attendanceMaxDateWidth * 1.0
+		if len(pageDates) > 0 {
+			dateWidth = min((contentWidth-fixedWidth)/float64(len(pageDates)), attendanceMaxDateWidth)
+		}
+		tableWidth := fixedWidth + dateWidth*float64(len(pageDates))
+
+		for studentPage := 0; studentPage < studentPages; studentPage++ {
+			p.addPage()
+			pageNumber := datePage*studentPages + studentPage + 1
+
+			p.text(
+				attendanceMargin,
+				p.Height-attendanceMargin-16,
+				16,
+				true,
+				pdfTruncate(course.Title, 16, true, contentWidth-80),
+			)
+			pageLabel := "Page " + strconv.Itoa(pageNumber) + " of " + strconv.Itoa(totalPages)
+			p.text(
+				p.Width-attendanceMargin-pdfTextWidth(pageLabel, 9, false),
+				p.Height-attendanceMargin-16,
+				9,
+				false,
+				pageLabel,
+			)
+			p.text(
+				attendanceMargin,
+				p.Height-attendanceMargin-32,
+				10,
+				false,
+				pdfTruncate(subtitle, 10, false, contentWidth),
+			)
+			p.text(attendanceMargin, attendanceMargin-12, 7, false, generated)
+
+			first := studentPage * rowsPerPage
+			entries := roster.Entries[min(first, len(roster.Entries)):min(first+rowsPerPage, len(roster.Entries))]
+			rows := len(entries)
+			if studentPage == studentPages-1 {
+				rows = rowsPerPage
+			}
+			tableBottom := tableTop - attendanceHeaderHeight - float64(rows)*attendanceRowHeight
+
+			/* Horizontal lines */
+			p.line(attendanceMargin, tableTop, attendanceMargin+tableWidth, tableTop, 1)
+			for i := 0; i <= rows; i++ {
+				y := tableTop - attendanceHeaderHeight - float64(i)*attendanceRowHeight
+				width := 0.5
+				if i == 0 || i == rows {
+					width = 1
+				}
+				p.line(attendanceMargin, y, attendanceMargin+tableWidth, y, width)
+			}
+
+			/* Vertical lines and column headers */
+			x := float64(attendanceMargin)
+			p.line(x, tableTop, x, tableBottom, 1)
+			for _, column := range attendanceColumns {
+				p.text(x+3, tableTop-attendanceHeaderHeight+5, attendanceFontSize, true, column.Title)
+				x += column.Width
+				p.line(x, tableTop, x, tableBottom, 1)
+			}
+			for i, date := range pageDates {
+				p.textRotated(
+					x+dateWidth/2+3,
+					tableTop-attendanceHeaderHeight+4,
+					7,
+					false,
+					date.Format("Mon 01-02"),
+				)
+				x += dateWidth
+				width := 0.5
+				if i == len(pageDates)-1 {
+					width = 1
+				}
+				p.line(x, tableTop, x, tableBottom, width)
+			}
+
+			/* Students */
+			for i, entry := range entries {
+				y := tableTop - attendanceHeaderHeight - float64(i+1)*attendanceRowHeight + 5
+				x := float64(attendanceMargin)
+				for j, value := range []string{
+					strconv.Itoa(first + i + 1),
+					entry.Name,
+					entry.StudentID,
+					entry.Department,
+				} {
+					p.text(
+						x+3,
+						y,
+						attendanceFontSize,
+						false,
+						pdfTruncate(value, attendanceFontSize, false, attendanceColumns[j].Width-6),
+					)
+					x += attendanceColumns[j].Width
+				}
+			}
+		}
+	}
+}
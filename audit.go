@@ -0,0 +1,222 @@
+/*
+ * Append-only audit log
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"strings"
+	"time"
+)
+
+/*
+ * Every change to choices, confirmation status, states, schedules, terms,
+ * uploaded data, reverted uploads, restored backups and repaired member
+ * counts is recorded with who made it, from where, and the values before
+ * and after as JSON. Changes are recorded in the same transaction as the
+ * change itself whenever there is one. The table refuses updates and
+ * deletions, see 0005_audit_events in sql/migrations.
+ */
+
+/* The actor of changes made by the server itself, such as schedules */
+const auditSystemActor = "system"
+
+/* The actor of changes made with subcommands, see commands.go */
+const auditCommandActor = "command"
+
+const (
+	auditChoose      = "choose"
+	auditUnchoose    = "unchoose"
+	auditConfirm     = "confirm"
+	auditUnconfirm   = "unconfirm"
+	auditSetState    = "set_state"
+	auditSetSchedule = "set_schedule"
+	auditUpload      = "upload"
+	auditCreateTerm  = "create_term"
+	auditSetTerm     = "set_term"
+	auditRepairCount = "repair_count"
+	auditRestore     = "restore"
+	auditRevert      = "revert_upload"
+)
+
+type auditChoiceT struct {
+	CourseID int   `json:"course_id"`
+	Forced   bool  `json:"forced"`
+	SelTime  int64 `json:"seltime"`
+}
+
+type auditConfirmedT struct {
+	Confirmed bool `json:"confirmed"`
+}
+
+type auditStateT struct {
+	State uint32 `json:"state"`
+}
+
+type auditScheduleT struct {
+	Schedule *time.Time `json:"schedule"`
+}
+
+type auditUploadT struct {
+	Term int64 `json:"term,omitempty"`
+	Rows int   `json:"rows"`
+	/* The upload snapshot keeping what was replaced, see upload_undo.go */
+	Snapshot int64  `json:"snapshot,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+type auditTermT struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	CopyFrom int64  `json:"copy_from,omitempty"`
+}
+
+type auditActiveTermT struct {
+	Term int64 `json:"term"`
+}
+
+type auditSelectedT struct {
+	Selected uint32 `json:"selected"`
+}
+
+/* Marshal a value as JSON, with nil meaning absent */
+func marshalAudit(v any) (*string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, wrapError(errAuditMarshal, err)
+	}
+	s := string(b)
+	return &s, nil
+}
+
+type auditEventT struct {
+	ID      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	IP      string    `json:"ip"`
+	Action  string    `json:"action"`
+	Subject string    `json:"subject"`
+	Before  *string   `json:"before"`
+	After   *string   `json:"after"`
+}
+
+func (event auditEventT) TimeString() string {
+	return event.Time.In(loc).Format(time.DateTime)
+}
+
+/*
+ * The audit log may be searched with the following query parameters, all
+ * optional:
+ *
+ *    actor    user ID of whoever made the change, "system" or "command"
+ *    action   one of the audit* actions
+ *    subject  the user ID, year group, table, term name or course ID changed
+ *    ip       the address the change was made from
+ *    q        text to look for in the before and after values
+ *    from, to time range, as YYYY-MM-DDTHH:MM in local time, with "from"
+ *             inclusive and "to" exclusive
+ */
+type auditFilterT struct {
+	Actor   string
+	Action  string
+	Subject string
+	IP      string
+	Text    string
+	From    *time.Time
+	To      *time.Time
+}
+
+func parseAuditFilter(get func(string) string) (auditFilterT, error) {
+	filter := auditFilterT{
+		Actor:   get("actor"),
+		Action:  get("action"),
+		Subject: get("subject"),
+		IP:      get("ip"),
+		Text:    get("q"),
+		From:    nil,
+		To:      nil,
+	}
+	for _, bound := range []struct {
+		key string
+		dst **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		v := get(bound.key)
+		if v == "" {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02T15:04", v, loc)
+		if err != nil {
+			return filter, wrapAny(errInvalidAuditFilter, bound.key)
+		}
+		*bound.dst = &t
+	}
+	return filter, nil
+}
+
+func (f auditFilterT) conditions(args *sqlArgsT, dialect sqlDialectT) []string {
+	var conds []string
+	if f.Actor != "" {
+		conds = append(conds, "actor = "+args.add(f.Actor))
+	}
+	if f.Action != "" {
+		conds = append(conds, "action = "+args.add(f.Action))
+	}
+	if f.Subject != "" {
+		conds = append(conds, "subject = "+args.add(f.Subject))
+	}
+	if f.IP != "" {
+		conds = append(conds, "ip = "+args.add(f.IP))
+	}
+	if f.Text != "" {
+		pattern := args.add("%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(f.Text) + "%")
+		conds = append(conds, "("+dialect.ilike(dialect.jsonText("before"), pattern)+" OR "+dialect.ilike(dialect.jsonText("after"), pattern)+")")
+	}
+	if f.From != nil {
+		conds = append(conds, "time >= "+args.add(f.From.UnixMicro()))
+	}
+	if f.To != nil {
+		conds = append(conds, "time < "+args.add(f.To.UnixMicro()))
+	}
+	return conds
+}
+
+/* Wraps an uploaded file to record its size and hash as it is read */
+type auditUploadReaderT struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newAuditUploadReader(r io.Reader) *auditUploadReaderT {
+	return &auditUploadReaderT{r: r, hash: sha256.New(), size: 0}
+}
+
+func (u *auditUploadReaderT) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	u.hash.Write(p[:n])
+	u.size += int64(n)
+	return n, err
+}
+
+func (u *auditUploadReaderT) record(rows int, filename string) auditUploadT {
+	return auditUploadT{
+		Term:     0, /* filled in by the store */
+		Rows:     rows,
+		Filename: filename,
+		Size:     u.size,
+		SHA256:   hex.EncodeToString(u.hash.Sum(nil)),
+	}
+}
@@ -0,0 +1,260 @@
+/*
+ * Backups of a whole selection round
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+/*
+ * A backup is a gzipped JSON document holding the courses, choices and
+ * their history, confirmations, expected students and pre-selections of a
+ * term, along with every user and the state and schedule of every year
+ * group. Sessions are left out. Restoring one replaces the data of the
+ * active term, whichever term it was taken from, so that a round could be
+ * put back as it was before a bad upload.
+ *
+ * The version is increased whenever the format changes in a way older
+ * versions of CCASS could not read. Newer versions must keep reading older
+ * backups. Uploads keep what they replace in the same format, see
+ * upload_undo.go.
+ */
+
+const (
+	backupFormat  = "cca-backup"
+	backupVersion = 1
+)
+
+/*
+ * Far more than any school needs, but small enough that a file crafted to
+ * decompress into something huge can't exhaust memory
+ */
+const (
+	backupMaxSize             = 64 << 20
+	backupMaxDecompressedSize = 512 << 20
+)
+
+type backupT struct {
+	Format           string                   `json:"format"`
+	Version          int                      `json:"version"`
+	Created          time.Time                `json:"created"`
+	TermName         string                   `json:"term_name"`
+	Courses          []backupCourseT          `json:"courses"`
+	Users            []backupUserT            `json:"users"`
+	Choices          []backupChoiceT          `json:"choices"`
+	ChoiceEvents     []backupChoiceEventT     `json:"choice_events"`
+	Confirmations    []string                 `json:"confirmations"`
+	ExpectedStudents []backupExpectedStudentT `json:"expected_students"`
+	PreSelections    []backupPreSelectionT    `json:"pre_selections"`
+	States           []backupStateT           `json:"states"`
+}
+
+/*
+ * Courses get new IDs when restored, so choices, their history and
+ * pre-selections refer to courses by the ID they had in the backup.
+ */
+type backupCourseT struct {
+	ID          int    `json:"id"`
+	Max         uint32 `json:"max"`
+	Title       string `json:"title"`
+	Type        string `json:"type"`
+	Group       string `json:"group"`
+	Teacher     string `json:"teacher"`
+	Location    string `json:"location"`
+	CourseID    string `json:"course_id"`
+	SectionID   string `json:"section_id"`
+	YearGroups  uint8  `json:"year_groups"`
+	Forced      bool   `json:"forced"`
+	LegalSexReq string `json:"legal_sex_requirements,omitempty"`
+}
+
+type backupUserT struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Email      string `json:"email"`
+	Department string `json:"department"`
+	LegalSex   string `json:"legal_sex,omitempty"`
+}
+
+type backupChoiceT struct {
+	UserID   string `json:"user_id"`
+	CourseID int    `json:"course_id"`
+	SelTime  int64  `json:"seltime"`
+	Forced   bool   `json:"forced"`
+}
+
+type backupChoiceEventT struct {
+	UserID string `json:"user_id"`
+	/* nil for confirmations */
+	CourseID *int   `json:"course_id"`
+	Kind     string `json:"kind"`
+	Time     int64  `json:"time"`
+}
+
+type backupExpectedStudentT struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	LegalSex string `json:"legal_sex"`
+}
+
+type backupPreSelectionT struct {
+	StudentID int64 `json:"student_id"`
+	CourseID  int   `json:"course_id"`
+}
+
+type backupStateT struct {
+	YearGroup string    `json:"year_group"`
+	State     uint32    `json:"state"`
+	Schedule  time.Time `json:"schedule"`
+}
+
+func newBackup() *backupT {
+	return &backupT{
+		Format:  backupFormat,
+		Version: backupVersion,
+		Created: time.Now(),
+	} //exhaustruct:ignore
+}
+
+func (b *backupT) filename() string {
+	return "cca_backup_" + b.Created.In(loc).Format("2006-01-02_150405") + ".json.gz"
+}
+
+func writeBackup(w io.Writer, b *backupT) error {
+	gz := gzip.NewWriter(w)
+	err := json.NewEncoder(gz).Encode(b)
+	if err != nil {
+		return wrapError(errCannotWriteBackup, err)
+	}
+	err = gz.Close()
+	if err != nil {
+		return wrapError(errCannotWriteBackup, err)
+	}
+	return nil
+}
+
+/*
+ * Read a backup and check that it is consistent, so that restoring it
+ * can't fail half way through because of its contents.
+ */
+func readBackup(r io.Reader) (*backupT, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, wrapError(errBadBackup, err)
+	}
+	data, err := io.ReadAll(io.LimitReader(gz, backupMaxDecompressedSize+1))
+	if err != nil {
+		return nil, wrapError(errBadBackup, err)
+	}
+	if len(data) > backupMaxDecompressedSize {
+		return nil, wrapAny(errBackupTooLarge, "more than "+strconv.Itoa(backupMaxDecompressedSize>>20)+" MiB decompressed")
+	}
+	var b backupT
+	err = json.Unmarshal(data, &b)
+	if err != nil {
+		return nil, wrapError(errBadBackup, err)
+	}
+	if b.Format != backupFormat {
+		return nil, wrapAny(errBadBackup, "not a CCASS backup")
+	}
+	if b.Version > backupVersion {
+		return nil, wrapAny(errBackupTooNew, b.Version)
+	}
+
+	courseIDs := make(map[int]struct{}, len(b.Courses))
+	for _, course := range b.Courses {
+		if !checkCourseType(course.Type) {
+			return nil, wrapAny(errInvalidCourseType, fmt.Sprintf("course %d has type %s", course.ID, course.Type))
+		}
+		if !checkCourseGroup(course.Group) {
+			return nil, wrapAny(errInvalidCourseGroup, fmt.Sprintf("course %d has group %s", course.ID, course.Group))
+		}
+		courseIDs[course.ID] = struct{}{}
+	}
+	userIDs := make(map[string]struct{}, len(b.Users))
+	for _, user := range b.Users {
+		userIDs[user.ID] = struct{}{}
+	}
+	studentIDs := make(map[int64]struct{}, len(b.ExpectedStudents))
+	for _, student := range b.ExpectedStudents {
+		studentIDs[student.ID] = struct{}{}
+	}
+	for _, choice := range b.Choices {
+		if _, ok := courseIDs[choice.CourseID]; !ok {
+			return nil, wrapAny(errBadBackup, fmt.Sprintf("choice of unknown course %d", choice.CourseID))
+		}
+		if _, ok := userIDs[choice.UserID]; !ok {
+			return nil, wrapAny(errBadBackup, "choice of unknown user "+choice.UserID)
+		}
+	}
+	for _, event := range b.ChoiceEvents {
+		if event.CourseID == nil {
+			continue
+		}
+		if _, ok := courseIDs[*event.CourseID]; !ok {
+			return nil, wrapAny(errBadBackup, fmt.Sprintf("choice history of unknown course %d", *event.CourseID))
+		}
+	}
+	for _, userID := range b.Confirmations {
+		if _, ok := userIDs[userID]; !ok {
+			return nil, wrapAny(errBadBackup, "confirmation of unknown user "+userID)
+		}
+	}
+	for _, preSelection := range b.PreSelections {
+		if _, ok := courseIDs[preSelection.CourseID]; !ok {
+			return nil, wrapAny(errBadBackup, fmt.Sprintf("pre-selection of unknown course %d", preSelection.CourseID))
+		}
+		if _, ok := studentIDs[preSelection.StudentID]; !ok {
+			return nil, wrapAny(errBadBackup, fmt.Sprintf("pre-selection for unknown student %d", preSelection.StudentID))
+		}
+	}
+	for _, state := range b.States {
+		if _, ok := states[state.YearGroup]; !ok {
+			return nil, wrapAny(errNoSuchYearGroup, state.YearGroup)
+		}
+		if state.State > 3 {
+			return nil, wrapAny(errInvalidState, state.State)
+		}
+	}
+	return &b, nil
+}
+
+/*
+ * Replace the data of the active term with a backup and start using it,
+ * telling other instances too. Student access must be disabled for every
+ * year group first, as for uploads, and stays disabled, whatever it was
+ * when the backup was taken, so that staff reopen it deliberately. The
+ * schedules are restored, and take effect once access is scheduled again.
+ */
+func restoreBackup(ctx context.Context, actor, ip string, upload auditUploadT, b *backupT) error {
+	if !allStatesDisabled() {
+		return errDisableStudentAccessFirst
+	}
+	err := store.restoreBackup(ctx, getActiveTerm(), actor, ip, upload, b)
+	if err != nil {
+		return err
+	}
+	err = reloadCourses(ctx)
+	if err != nil {
+		return err
+	}
+	notifyCluster(ctx, clusterCourses)
+
+	for _, state := range b.States {
+		schedule := state.Schedule
+		schedules[state.YearGroup].Store(&schedule)
+		notifyCluster(ctx, clusterSchedule, state.YearGroup, strconv.FormatInt(schedule.Unix(), 10))
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+/*
+ * iCalendar feeds of course timetables
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+ * Every user may get a secret token, which is the only thing needed to read
+ * their feed, so that calendar applications could subscribe to it without
+ * logging in. Students get their chosen courses once they have confirmed
+ * them in the active term, and an empty calendar until then, while staff get
+ * the courses of a teacher of their choosing. Each course becomes a weekly
+ * recurring event from the first to the last day of the term, with skipped
+ * dates as exceptions.
+ */
+
+func getCalendarToken(ctx context.Context, userID string) (string, error) {
+	token, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+	return store.getCalendarToken(ctx, userID, token)
+}
+
+/* Replace a user's token, so that old feed URLs stop working */
+func resetCalendarToken(ctx context.Context, userID string) error {
+	token, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	return store.setCalendarToken(ctx, userID, token)
+}
+
+/*
+ * The address of a user's own feed, giving them a token if they haven't got
+ * one, or "" if calendar feeds are disabled
+ */
+func getUserCalendarURL(ctx context.Context, userID string) (string, error) {
+	if !haveTermDates() {
+		return "", nil
+	}
+	token, err := getCalendarToken(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	return calendarURL(token), nil
+}
+
+func calendarURL(token string) string {
+	return strings.TrimSuffix(config.URL, "/") + "/calendar/" + token + ".ics"
+}
+
+func calendarTeacherURL(token, teacher string) string {
+	return calendarURL(token) + "?teacher=" + url.QueryEscape(teacher)
+}
+
+/*
+ * Get the courses a student has chosen, ordered by ID, or none if they
+ * haven't confirmed their choices yet
+ */
+func getUserCourses(ctx context.Context, userID string) ([]*courseT, error) {
+	term := getActiveTerm()
+	confirmed, err := store.getConfirmed(ctx, term, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !confirmed {
+		return nil, nil
+	}
+
+	courseIDs, err := store.getUserChoices(ctx, term, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*courseT
+	for _, courseID := range courseIDs {
+		_course, ok := courses.Load(courseID)
+		if !ok {
+			/* Skip choices of courses that no longer exist */
+			continue
+		}
+		course, ok := _course.(*courseT)
+		if !ok {
+			return nil, errType
+		}
+		result = append(result, course)
+	}
+	return result, nil
+}
+
+const icalTimezone = "BEGIN:VTIMEZONE\r\n" +
+	"TZID:Asia/Shanghai\r\n" +
+	"BEGIN:STANDARD\r\n" +
+	"DTSTART:19700101T000000\r\n" +
+	"TZOFFSETFROM:+0800\r\n" +
+	"TZOFFSETTO:+0800\r\n" +
+	"TZNAME:CST\r\n" +
+	"END:STANDARD\r\n" +
+	"END:VTIMEZONE\r\n"
+
+var icalWeekdays = [...]string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+func icalEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+/* Lines longer than 75 octets are folded, without splitting characters */
+func icalLine(sb *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		sb.WriteString(line[:cut])
+		sb.WriteString("\r\n ")
+		line = line[cut:]
+		/* The leading space counts towards the next line */
+		limit = 74
+	}
+	sb.WriteString(line)
+	sb.WriteString("\r\n")
+}
+
+func icalLocalTime(t time.Time) string {
+	return t.In(loc).Format("20060102T150405")
+}
+
+func writeCalendar(w io.Writer, name string, calendarCourses []*courseT) error {
+	host := "cca"
+	if u, err := url.Parse(config.URL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	until := config.Term.End.AddDate(0, 0, 1).Add(-time.Second).UTC().Format("20060102T150405Z")
+
+	var sb strings.Builder
+	icalLine(&sb, "BEGIN:VCALENDAR")
+	icalLine(&sb, "VERSION:2.0")
+	icalLine(&sb, "PRODID:-//YK Pao School//CCA Selection System//EN")
+	icalLine(&sb, "CALSCALE:GREGORIAN")
+	icalLine(&sb, "METHOD:PUBLISH")
+	icalLine(&sb, "X-WR-CALNAME:"+icalEscape(name))
+	icalLine(&sb, "X-WR-TIMEZONE:Asia/Shanghai")
+	sb.WriteString(icalTimezone)
+
+	sort.Slice(calendarCourses, func(i, j int) bool {
+		return calendarCourses[i].ID < calendarCourses[j].ID
+	})
+	for _, course := range calendarCourses {
+		weekdays := courseGroupWeekdays[course.Group]
+		dates := getTermDates(weekdays)
+		if len(dates) == 0 {
+			continue
+		}
+		times := config.Term.Times[course.Group]
+		first := dates[0]
+
+		byDay := make([]string, 0, len(weekdays))
+		for _, weekday := range weekdays {
+			byDay = append(byDay, icalWeekdays[weekday])
+		}
+
+		var exdates []string
+		for skip := range config.Term.Skip {
+			if skip.Before(first) || skip.After(config.Term.End) {
+				continue
+			}
+			for _, weekday := range weekdays {
+				if skip.Weekday() == weekday {
+					exdates = append(exdates, icalLocalTime(skip.Add(times[0])))
+					break
+				}
+			}
+		}
+		sort.Strings(exdates)
+
+		icalLine(&sb, "BEGIN:VEVENT")
+		icalLine(&sb, "UID:cca-"+strconv.Itoa(course.ID)+"@"+host)
+		icalLine(&sb, "DTSTAMP:"+stamp)
+		icalLine(&sb, "DTSTART;TZID=Asia/Shanghai:"+icalLocalTime(first.Add(times[0])))
+		icalLine(&sb, "DTEND;TZID=Asia/Shanghai:"+icalLocalTime(first.Add(times[1])))
+		icalLine(&sb, "RRULE:FREQ=WEEKLY;BYDAY="+strings.Join(byDay, ",")+";UNTIL="+until)
+		if len(exdates) != 0 {
+			icalLine(&sb, "EXDATE;TZID=Asia/Shanghai:"+strings.Join(exdates, ","))
+		}
+		icalLine(&sb, "SUMMARY:"+icalEscape(course.Title))
+		icalLine(&sb, "LOCATION:"+icalEscape(course.Location))
+		icalLine(&sb, "DESCRIPTION:"+icalEscape(
+			"Teacher: "+course.Teacher+"\n"+
+				"Group: "+courseGroups[course.Group]+"\n"+
+				"Section: "+course.SectionID,
+		))
+		icalLine(&sb, "END:VEVENT")
+	}
+
+	icalLine(&sb, "END:VCALENDAR")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,275 @@
+/*
+ * Keep several instances in step
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Several instances may serve the same PostgreSQL database, e.g. behind a
+ * load balancer or while one is being restarted. Capacity is enforced by
+ * the database, so what each instance keeps in memory is only needed to
+ * show and broadcast, and is kept up to date by notifications on the cca
+ * channel. A notification has the same format as a WebSocket message,
+ * starting with the ID of the instance that sent it:
+ *
+ *    <instance> COUNT <course> <delta>       course members changed
+ *    <instance> STATE <yeargroup> <state>
+ *    <instance> SCHEDULE <yeargroup> <unix time>
+ *    <instance> COURSES                      courses were uploaded
+ *    <instance> TERM <term>                  another term became active
+ *    <instance> ANNOUNCE <id>
+ *    <instance> UNANNOUNCE <id> <year groups>
+ *    <instance> SESSION <user>               a user connected elsewhere
+ *    <instance> RECONCILE <actor>            correct counts that drifted
+ *
+ * Counts are notified in the transaction that changes them, so that they
+ * are only delivered if it commits. They are sent as differences rather
+ * than totals, so they end up right in whichever order they are applied.
+ * Instances ignore their own notifications, as they have already changed
+ * their memory. SQLite only allows one instance, so nothing is sent.
+ */
+
+const clusterChannel = "cca"
+
+const (
+	clusterCount      = "COUNT"
+	clusterState      = "STATE"
+	clusterSchedule   = "SCHEDULE"
+	clusterCourses    = "COURSES"
+	clusterTerm       = "TERM"
+	clusterAnnounce   = "ANNOUNCE"
+	clusterUnannounce = "UNANNOUNCE"
+	clusterSession    = "SESSION"
+	clusterReconcile  = "RECONCILE"
+)
+
+/* How long to wait before listening again after losing the connection */
+const clusterRetryInterval = 5 * time.Second
+
+var instanceID string
+
+func init() {
+	var err error
+	instanceID, err = randomString(4)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func clusterMessage(kind string, args ...string) string {
+	return strings.Join(append([]string{instanceID, kind}, args...), " ")
+}
+
+/*
+ * Tell other instances about a change that has already been made, so a
+ * failure is only logged.
+ */
+func notifyCluster(ctx context.Context, kind string, args ...string) {
+	err := store.notify(ctx, clusterMessage(kind, args...))
+	if err != nil {
+		slog.Error("notify", "kind", kind, "error", err)
+		recordError("notify", err)
+	}
+}
+
+func listenCluster() {
+	for {
+		err := store.listen(context.Background(), resyncCluster, handleClusterMessage)
+		if err == nil {
+			return
+		}
+		slog.Error("listen", "error", err)
+		recordError("listen", err)
+		time.Sleep(clusterRetryInterval)
+	}
+}
+
+func handleClusterMessage(msg string) {
+	mar := strings.Split(msg, " ")
+	if len(mar) < 2 || mar[0] == instanceID {
+		return
+	}
+	err := applyClusterMessage(context.Background(), mar[1], mar[2:])
+	if err != nil {
+		slog.Error("cluster", "msg", msg, "error", err)
+	}
+}
+
+func applyClusterMessage(ctx context.Context, kind string, args []string) error {
+	switch kind {
+	case clusterCount:
+		if len(args) != 2 {
+			return errBadNumberOfArguments
+		}
+		courseID, err := strconv.Atoi(args[0])
+		if err != nil {
+			return wrapError(errInvalidCourseID, err)
+		}
+		delta, err := strconv.ParseInt(args[1], 10, 32)
+		if err != nil {
+			return wrapError(errBadClusterMessage, err)
+		}
+		_course, ok := courses.Load(courseID)
+		if !ok {
+			/* Courses of another term, before we reload */
+			return nil
+		}
+		course, ok := _course.(*courseT)
+		if !ok {
+			return errType
+		}
+		atomic.AddUint32(&course.Selected, uint32(int32(delta)))
+		course.markUpdated()
+	case clusterState:
+		if len(args) != 2 {
+			return errBadNumberOfArguments
+		}
+		state, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return wrapError(errInvalidState, err)
+		}
+		return applyState(args[0], uint32(state))
+	case clusterSchedule:
+		if len(args) != 2 {
+			return errBadNumberOfArguments
+		}
+		_schedule, ok := schedules[args[0]]
+		if !ok {
+			return errNoSuchYearGroup
+		}
+		unix, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return wrapError(errBadClusterMessage, err)
+		}
+		schedule := time.Unix(unix, 0)
+		_schedule.Store(&schedule)
+	case clusterCourses:
+		return reloadCourses(ctx)
+	case clusterTerm:
+		if len(args) != 1 {
+			return errBadNumberOfArguments
+		}
+		term, err := parseTerm(args[0])
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&activeTerm, term)
+		return reloadCourses(ctx)
+	case clusterAnnounce:
+		if len(args) != 1 {
+			return errBadNumberOfArguments
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return wrapError(errBadClusterMessage, err)
+		}
+		announcements, err := store.getAllAnnouncements(ctx)
+		if err != nil {
+			return err
+		}
+		for _, a := range announcements {
+			if a.ID == id {
+				return propagateToYearGroups(a.YearGroups, a.message())
+			}
+		}
+	case clusterUnannounce:
+		if len(args) != 2 {
+			return errBadNumberOfArguments
+		}
+		yearGroups, err := strconv.ParseUint(args[1], 10, 8)
+		if err != nil {
+			return wrapError(errBadClusterMessage, err)
+		}
+		return propagateToYearGroups(uint8(yearGroups), "AD "+args[0])
+	case clusterSession:
+		if len(args) != 1 {
+			return errBadNumberOfArguments
+		}
+		_cancel, ok := cancelPool.Load(args[0])
+		if ok {
+			cancel, ok := _cancel.(*context.CancelFunc)
+			if ok && cancel != nil {
+				(*cancel)()
+			}
+		}
+	case clusterReconcile:
+		if len(args) != 1 {
+			return errBadNumberOfArguments
+		}
+		/* Checking waits for choices to settle, which mustn't hold up the rest */
+		go reconcileForCluster(args[0])
+	default:
+		return wrapAny(errUnknownCommand, kind)
+	}
+	return nil
+}
+
+/*
+ * Catch up on what could have been missed while not listening. Choices
+ * made while catching up may be counted twice, which the reconciler would
+ * notice.
+ */
+func resyncCluster() error {
+	ctx := context.Background()
+
+	term, err := store.getActiveTerm(ctx)
+	if err != nil {
+		return err
+	}
+	dbCourses, err := store.getCourses(ctx, term)
+	if err != nil {
+		return err
+	}
+	reload := term != getActiveTerm() || len(dbCourses) != int(atomic.LoadUint32(&numCourses))
+	for _, dbCourse := range dbCourses {
+		if reload {
+			break
+		}
+		_course, ok := courses.Load(dbCourse.ID)
+		if !ok {
+			reload = true
+			break
+		}
+		course, ok := _course.(*courseT)
+		if !ok {
+			return errType
+		}
+		if atomic.SwapUint32(&course.Selected, dbCourse.Selected) != dbCourse.Selected {
+			course.markUpdated()
+		}
+	}
+	if reload {
+		atomic.StoreInt64(&activeTerm, term)
+		err := reloadCourses(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	for yeargroup, _state := range states {
+		state, schedule, err := store.loadState(ctx, yeargroup)
+		if err != nil {
+			return err
+		}
+		schedules[yeargroup].Store(&schedule)
+		if atomic.LoadUint32(_state) != state {
+			err := applyState(yeargroup, state)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
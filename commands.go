@@ -0,0 +1,531 @@
+/*
+ * Subcommands run instead of the server
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+ * Called with the arguments left after flags, when there are any, after
+ * the configuration has been loaded. Subcommands that change data check it
+ * with the same code as the staff pages, record it in the audit log with
+ * "command" as the actor, and tell running instances sharing a PostgreSQL
+ * database about it.
+ */
+func runCommand(args []string) error {
+	switch args[0] {
+	case "migrate":
+		return commandMigrate(args[1:])
+	case "backup":
+		return commandBackup(args[1:])
+	case "restore":
+		return commandRestore(args[1:])
+	case "import-courses", "import-students", "import-forced":
+		return commandImport(args[0], args[1:])
+	case "export":
+		return commandExport(args[1:])
+	case "state":
+		return commandState(args[1:])
+	case "user":
+		return commandUser(args[1:])
+	case "recount":
+		return commandRecount(args[1:])
+	case "check-config":
+		return commandCheckConfig(args[1:])
+	default:
+		return wrapAny(errUnknownSubcommand, args[0])
+	}
+}
+
+/*
+ * Connect to the database and load what the server would have in memory,
+ * without touching the schema. The store must be closed afterwards.
+ */
+func setupCommand(ctx context.Context) error {
+	err := openDatabase()
+	if err != nil {
+		return err
+	}
+	err = setupTerms(ctx)
+	if err == nil {
+		err = loadStateAndSchedule()
+	}
+	if err == nil {
+		err = setupCourses(ctx)
+	}
+	if err != nil {
+		store.close()
+		return err
+	}
+	return nil
+}
+
+/*
+ * cca migrate           apply pending migrations
+ * cca migrate status    list migrations and when they were applied
+ * cca migrate down [n]  revert the latest n migrations, 1 by default
+ */
+func commandMigrate(args []string) error {
+	ctx := context.Background()
+	err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	if len(args) == 0 {
+		return store.migrateUp(ctx)
+	}
+	switch args[0] {
+	case "up":
+		if len(args) != 1 {
+			return wrapAny(errBadSubcommandArgs, "usage: migrate up")
+		}
+		return store.migrateUp(ctx)
+	case "status":
+		if len(args) != 1 {
+			return wrapAny(errBadSubcommandArgs, "usage: migrate status")
+		}
+		status, err := store.getMigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, s := range status {
+			applied := "pending"
+			if s.Applied != nil {
+				applied = s.Applied.In(loc).Format(time.DateTime)
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return tw.Flush()
+	case "down":
+		steps := 1
+		if len(args) == 2 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return wrapAny(errBadSubcommandArgs, "migrate down takes a positive number of migrations")
+			}
+		} else if len(args) != 1 {
+			return wrapAny(errBadSubcommandArgs, "usage: migrate down [n]")
+		}
+		return store.migrateDown(ctx, steps)
+	default:
+		return wrapAny(errBadSubcommandArgs, "usage: migrate [up|status|down [n]]")
+	}
+}
+
+/*
+ * cca backup file [term]  write a backup of a term, by default the active
+ *                         one, to file, or standard output if it is "-"
+ */
+func commandBackup(args []string) (retErr error) {
+	if len(args) != 1 && len(args) != 2 {
+		return wrapAny(errBadSubcommandArgs, "usage: backup file [term]")
+	}
+	ctx := context.Background()
+	err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	err = setupTerms(ctx)
+	if err != nil {
+		return err
+	}
+	term := getActiveTerm()
+	if len(args) == 2 {
+		term, err = parseTerm(args[1])
+		if err != nil {
+			return err
+		}
+	}
+	b, err := store.getBackup(ctx, term)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "-" {
+		return writeBackup(os.Stdout, b)
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return wrapError(errCannotWriteBackup, err)
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil && retErr == nil {
+			retErr = wrapError(errCannotWriteBackup, err)
+		}
+	}()
+	return writeBackup(f, b)
+}
+
+/*
+ * cca restore file  replace the data of the active term with a backup;
+ *                   running instances sharing a PostgreSQL database pick
+ *                   it up, while SQLite requires CCASS to be stopped
+ */
+func commandRestore(args []string) error {
+	if len(args) != 1 {
+		return wrapAny(errBadSubcommandArgs, "usage: restore file")
+	}
+	ctx := context.Background()
+	err := setupCommand(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return wrapError(errBadBackup, err)
+	}
+	defer f.Close()
+	upload := newAuditUploadReader(f)
+	b, err := readBackup(upload)
+	if err != nil {
+		return err
+	}
+	return restoreBackup(ctx, auditCommandActor, "", upload.record(len(b.Courses), filepath.Base(args[0])), b)
+}
+
+/*
+ * cca import-courses file   replace the courses of the active term
+ * cca import-students file  replace the student list of the active term
+ * cca import-forced file    replace the forced associations of the active term
+ *
+ * The files are CSV in the same format as uploads on the staff home page,
+ * and the uploads could be reverted there in the same way.
+ */
+func commandImport(command string, args []string) error {
+	if len(args) != 1 {
+		return wrapAny(errBadSubcommandArgs, "usage: "+command+" file")
+	}
+	ctx := context.Background()
+	err := setupCommand(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return wrapError(errCannotReadCSV, err)
+	}
+	defer f.Close()
+	upload := newAuditUploadReader(f)
+	filename := filepath.Base(args[0])
+
+	var rows int
+	switch command {
+	case "import-courses":
+		newCourses, err := readCoursesCSV(upload)
+		if err != nil {
+			return err
+		}
+		rows = len(newCourses)
+		err = importCourses(ctx, auditCommandActor, "", upload.record(rows, filename), newCourses)
+		if err != nil {
+			return err
+		}
+	case "import-students":
+		students, err := readStudentsCSV(upload)
+		if err != nil {
+			return err
+		}
+		rows = len(students)
+		err = store.replaceExpectedStudents(ctx, getActiveTerm(), auditCommandActor, "", upload.record(rows, filename), students)
+		if err != nil {
+			return err
+		}
+	case "import-forced":
+		sortedCourses, err := getSortedCourses()
+		if err != nil {
+			return err
+		}
+		preSelections, err := readPreSelectionsCSV(upload, sortedCourses)
+		if err != nil {
+			return err
+		}
+		rows = len(preSelections)
+		err = store.replacePreSelections(ctx, getActiveTerm(), auditCommandActor, "", upload.record(rows, filename), preSelections)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("imported %d rows from %s\n", rows, filename)
+	return nil
+}
+
+/*
+ * cca export choices [key=value ...]   write choices to standard output
+ * cca export students [key=value ...]  write students to standard output
+ *
+ * The keys are the query parameters of /export/choices and
+ * /export/students, see exportFilterT, and profile for choices.
+ */
+func commandExport(args []string) error {
+	if len(args) == 0 || (args[0] != "choices" && args[0] != "students") {
+		return wrapAny(errBadSubcommandArgs, "usage: export choices|students [key=value ...]")
+	}
+	query := url.Values{}
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return wrapAny(errBadSubcommandArgs, "expecting key=value, got "+arg)
+		}
+		query.Add(key, value)
+	}
+
+	/* The filter defaults to the active term, which must be loaded first */
+	ctx := context.Background()
+	err := setupCommand(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	filter, err := parseExportFilter(query)
+	if err != nil {
+		return err
+	}
+	profile, err := parseExportProfile(query)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if args[0] == "choices" {
+		err = writeChoicesExport(ctx, filter, profile, func() (io.Writer, error) {
+			return w, nil
+		})
+	} else {
+		err = writeStudentsExport(ctx, w, filter)
+	}
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return wrapError(errCannotWriteExport, err)
+	}
+	return nil
+}
+
+/*
+ * cca state                                 show the state and schedule of each year group
+ * cca state set yeargroup state [schedule]  change the state of a year group, and
+ *                                           its schedule as YYYY-MM-DDTHH:MM
+ */
+func commandState(args []string) error {
+	usage := wrapAny(errBadSubcommandArgs, "usage: state [set yeargroup state [schedule]]")
+	if len(args) != 0 && (args[0] != "set" || len(args) < 3 || len(args) > 4) {
+		return usage
+	}
+	ctx := context.Background()
+	err := setupCommand(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	if len(args) == 0 {
+		yearGroups := getKeysOfMap(states)
+		sort.Slice(yearGroups, func(i, j int) bool {
+			return yearGroupsNumberBits[yearGroups[i]] < yearGroupsNumberBits[yearGroups[j]]
+		})
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "YEAR GROUP\tSTATE\tSCHEDULE")
+		for _, yeargroup := range yearGroups {
+			fmt.Fprintf(
+				tw,
+				"%s\t%d\t%s\n",
+				yeargroup,
+				atomic.LoadUint32(states[yeargroup]),
+				schedules[yeargroup].Load().In(loc).Format("2006-01-02T15:04"),
+			)
+		}
+		return tw.Flush()
+	}
+
+	yeargroup := args[1]
+	if len(args) == 4 {
+		newSchedule, err := time.ParseInLocation("2006-01-02T15:04", args[3], loc)
+		if err != nil {
+			return wrapError(errInvalidSchedule, err)
+		}
+		err = setSchedule(ctx, yeargroup, &newSchedule, auditCommandActor, "")
+		if err != nil {
+			return wrapError(errCannotSetSchedule, err)
+		}
+	}
+	newState, err := strconv.ParseUint(args[2], 10, 32)
+	if err != nil {
+		return wrapError(errInvalidState, err)
+	}
+	err = setState(ctx, yeargroup, uint32(newState), auditCommandActor, "")
+	if err != nil {
+		return wrapError(errCannotSetState, err)
+	}
+	return nil
+}
+
+/* cca user show id|email  show a user and their choices in the active term */
+func commandUser(args []string) error {
+	if len(args) != 2 || args[0] != "show" {
+		return wrapAny(errBadSubcommandArgs, "usage: user show id|email")
+	}
+	ctx := context.Background()
+	err := setupCommand(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	term := getActiveTerm()
+	users, err := store.getUsers(ctx, term)
+	if err != nil {
+		return err
+	}
+	var user *userT
+	for i := range users {
+		if users[i].ID == args[1] || strings.EqualFold(users[i].Email, args[1]) {
+			user = &users[i]
+			break
+		}
+	}
+	if user == nil {
+		return wrapAny(errNoSuchUser, args[1])
+	}
+	choiceRows, err := store.getChoiceRows(ctx, term)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\t%s\n", user.ID)
+	fmt.Fprintf(tw, "Name\t%s\n", user.Name)
+	fmt.Fprintf(tw, "Email\t%s\n", user.Email)
+	fmt.Fprintf(tw, "Department\t%s\n", user.Department)
+	fmt.Fprintf(tw, "Legal sex\t%s\n", user.LegalSex)
+	fmt.Fprintf(tw, "Confirmed\t%t\n", user.Confirmed)
+	for _, row := range choiceRows {
+		if row.UserID != user.ID {
+			continue
+		}
+		title := "(no such course)"
+		if _course, ok := courses.Load(row.CourseID); ok {
+			if course, ok := _course.(*courseT); ok {
+				title = course.Title
+			}
+		}
+		forced := ""
+		if row.Forced {
+			forced = " (forced)"
+		}
+		fmt.Fprintf(tw, "Choice\t%d %s%s, %s\n", row.CourseID, title, forced, row.SelTime.In(loc).Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+/*
+ * cca recount  list choices that break course rules, like the reconciler,
+ *              and have running instances correct the member counts they
+ *              keep in memory. The counts stored in the database are kept
+ *              by triggers, and the ones loaded here come from them, so
+ *              there is nothing to correct in this process itself.
+ */
+func commandRecount(args []string) error {
+	if len(args) != 0 {
+		return wrapAny(errBadSubcommandArgs, "usage: recount")
+	}
+	ctx := context.Background()
+	err := setupCommand(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	violations, err := findRuleViolations(ctx, getActiveTerm())
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, v := range violations {
+		fmt.Fprintf(tw, "%s\t%s (%s)\t%s: %s\n", v.UserID, v.Name, v.YearGroup, v.Rule, v.Detail)
+	}
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d choices breaking course rules\n", len(violations))
+
+	if config.DB.Type == "postgres" {
+		requestClusterReconcile(ctx, auditCommandActor)
+		fmt.Println("running instances were asked to correct their member counts; what they find is shown on the staff dashboard")
+	}
+	return nil
+}
+
+/*
+ * cca check-config  check that the configuration file is valid, and that
+ *                   the database and TLS certificate it refers to could be
+ *                   used, without writing to the database. The file is
+ *                   loaded before any subcommand runs, so every problem
+ *                   with it has been listed by then.
+ */
+func commandCheckConfig(args []string) error {
+	if len(args) != 0 {
+		return wrapAny(errBadSubcommandArgs, "usage: check-config")
+	}
+	if config.Listen.Trans == "tls" {
+		_, err := tls.LoadX509KeyPair(config.Listen.TLS.Cert, config.Listen.TLS.Key)
+		if err != nil {
+			return err
+		}
+	}
+	err := openDatabaseReadOnly()
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Println("configuration is valid; the database does not exist yet and will be created on first run")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer store.close()
+	status, err := store.getMigrationStatus(context.Background())
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, s := range status {
+		if s.Applied == nil {
+			pending++
+		}
+	}
+	fmt.Printf("configuration is valid; %d migrations pending\n", pending)
+	return nil
+}
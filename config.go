@@ -8,296 +8,289 @@
 package main
 
 import (
-	"bufio"
-	"errors"
+	"bytes"
 	"fmt"
 	"os"
+	"reflect"
+	"sort"
+	"time"
 
 	"codeberg.org/emersion/go-scfg"
 )
 
 /*
- * We use two structs. The first has all of its values as pointers, and scfg
- * unmarshals the configuration to it. Then we take each value, dereference
- * it, and throw it into a normal config struct without pointers, reporting
- * missing values.
- * We should probably use reflection instead. This is stupid.
+ * The configuration, with tags describing how it is loaded, see
+ * config_schema.go. Defaults are documented in docs/cca.scfg.example.
  */
-
-var configWithPointers struct {
-	URL    *string `scfg:"url"`
-	Prod   *bool   `scfg:"prod"`
+var config struct {
+	URL    string `scfg:"url" env:"CCA_URL"`
+	Prod   bool   `scfg:"prod"`
 	Listen struct {
-		Proto *string `scfg:"proto"`
-		Net   *string `scfg:"net"`
-		Addr  *string `scfg:"addr"`
-		Trans *string `scfg:"trans"`
-		TLS   struct {
-			Cert *string `scfg:"cert"`
-			Key  *string `scfg:"key"`
+		Proto string `scfg:"proto" default:"http" check:"oneof=http"`
+		Net   string `scfg:"net" default:"tcp" check:"oneof=tcp|tcp4|tcp6|unix"`
+		Addr  string `scfg:"addr"`
+		Trans string `scfg:"trans" default:"plain" check:"oneof=plain|tls"`
+		/* Required if Trans is "tls" */
+		TLS struct {
+			Cert string `scfg:"cert" default:""`
+			Key  string `scfg:"key" default:""`
 		} `scfg:"tls"`
 	} `scfg:"listen"`
 	DB struct {
-		Type *string `scfg:"type"`
-		Conn *string `scfg:"conn"`
+		Type string `scfg:"type" check:"oneof=postgres|sqlite"`
+		Conn string `scfg:"conn" env:"CCA_DB_CONN"`
 	} `scfg:"db"`
 	Auth struct {
-		Client      *string            `scfg:"client"`
-		Authorize   *string            `scfg:"authorize"`
-		Jwks        *string            `scfg:"jwks"`
-		Token       *string            `scfg:"token"`
-		Expr        *int               `scfg:"expr"`
-		Departments *map[string]string `scfg:"depts"`
-		Udepts      *map[string]string `scfg:"udepts"`
+		Client      string            `scfg:"client" env:"CCA_AUTH_CLIENT"`
+		Authorize   string            `scfg:"authorize"`
+		Jwks        string            `scfg:"jwks"`
+		Token       string            `scfg:"token"`
+		Expr        int               `scfg:"expr" default:"604800" check:"positive"`
+		Departments map[string]string `scfg:"depts"`
+		Udepts      map[string]string `scfg:"udepts" default:""`
 	} `scfg:"auth"`
 	Perf struct {
-		SendQ               *int  `scfg:"sendq"`
-		MessageArgumentsCap *int  `scfg:"msg_args_cap"`
-		MessageBytesCap     *int  `scfg:"msg_bytes_cap"`
-		ReadHeaderTimeout   *int  `scfg:"read_header_timeout"`
-		UsemDelayShiftBits  *int  `scfg:"usem_delay_shift_bits"`
-		PropagateImmediate  *bool `scfg:"propagate_immediate"`
+		SendQ               int  `scfg:"sendq" default:"10" check:"positive"`
+		MessageArgumentsCap int  `scfg:"msg_args_cap" default:"4" check:"nonnegative"`
+		MessageBytesCap     int  `scfg:"msg_bytes_cap" default:"5" check:"nonnegative"`
+		ReadHeaderTimeout   int  `scfg:"read_header_timeout" default:"5" check:"positive"`
+		BroadcastInterval   int  `scfg:"broadcast_interval" default:"500" check:"positive"`
+		DashboardInterval   int  `scfg:"dashboard_interval" default:"2" check:"positive"`
+		PingInterval        int  `scfg:"ping_interval" default:"20" check:"positive"`
+		PingTimeout         int  `scfg:"ping_timeout" default:"10" check:"positive"`
+		IdleTimeout         int  `scfg:"idle_timeout" default:"1800" check:"nonnegative"`
+		PropagateImmediate  bool `scfg:"propagate_immediate" default:"true"`
+		ReconcileInterval   int  `scfg:"reconcile_interval" default:"300" check:"nonnegative"`
+		ReconcileRepair     bool `scfg:"reconcile_repair" default:"false"`
+		UploadUndoWindow    int  `scfg:"upload_undo_window" default:"3600" check:"nonnegative"`
 	} `scfg:"perf"`
+	RateLimit struct {
+		UserRate  float64 `scfg:"user_rate" default:"5" check:"positive"`
+		UserBurst int     `scfg:"user_burst" default:"20" check:"positive"`
+		IPRate    float64 `scfg:"ip_rate" default:"500" check:"positive"`
+		IPBurst   int     `scfg:"ip_burst" default:"1000" check:"positive"`
+		Throttle  int     `scfg:"throttle" default:"10" check:"nonnegative"`
+	} `scfg:"ratelimit"`
+	ExportProfiles exportProfilesConfigT `scfg:"export_profile"`
+	/* nil if omitted, which disables attendance sheets and calendar feeds */
+	Term *struct {
+		Start time.Time  `scfg:"start"`
+		End   time.Time  `scfg:"end"`
+		Skip  termSkipT  `scfg:"skip"`
+		Times termTimesT `scfg:"times"`
+	} `scfg:"term"`
 	Req struct {
 		Y9 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
+			Sport    int `scfg:"sport" check:"nonnegative"`
+			NonSport int `scfg:"non_sport" check:"nonnegative"`
 		} `scfg:"y9"`
 		Y10 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
+			Sport    int `scfg:"sport" check:"nonnegative"`
+			NonSport int `scfg:"non_sport" check:"nonnegative"`
 		} `scfg:"y10"`
 		Y11 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
+			Sport    int `scfg:"sport" check:"nonnegative"`
+			NonSport int `scfg:"non_sport" check:"nonnegative"`
 		} `scfg:"y11"`
 		Y12 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
+			Sport    int `scfg:"sport" check:"nonnegative"`
+			NonSport int `scfg:"non_sport" check:"nonnegative"`
 		} `scfg:"y12"`
 	} `scfg:"req"`
 }
 
-var config struct {
-	URL    string
-	Prod   bool
-	Listen struct {
-		Proto string
-		Net   string
-		Addr  string
-		Trans string
-		TLS   struct {
-			Cert string
-			Key  string
-		}
-	}
-	DB struct {
-		Type string
-		Conn string
-	}
-	Auth struct {
-		Client      string
-		Authorize   string
-		Jwks        string
-		Token       string
-		Expr        int
-		Departments map[string]string
-		Udepts      map[string]string
-	}
-	Perf struct {
-		SendQ               int
-		MessageArgumentsCap int
-		MessageBytesCap     int
-		ReadHeaderTimeout   int
-		UsemDelayShiftBits  int
-		PropagateImmediate  bool
-	}
-	Req struct {
-		Y9 struct {
-			Sport    int
-			NonSport int
-		}
-		Y10 struct {
-			Sport    int
-			NonSport int
-		}
-		Y11 struct {
-			Sport    int
-			NonSport int
-		}
-		Y12 struct {
-			Sport    int
-			NonSport int
-		}
-	}
-}
-
-func fetchConfig(path string) (retErr error) {
-	f, err := os.Open(path)
+/*
+ * Load the configuration file, reporting every problem with it at once
+ * rather than the first one.
+ */
+func fetchConfig(path string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("open config: %w", err)
+		return wrapError(errCannotOpenConfig, err)
 	}
-
-	err = scfg.NewDecoder(bufio.NewReader(f)).Decode(&configWithPointers)
+	block, err := scfg.Read(bytes.NewReader(data))
 	if err != nil {
-		return fmt.Errorf("decode config: %w", err)
+		return wrapError(errCannotDecodeConfig, fmt.Errorf("%s: %w", path, err))
 	}
 
-	if configWithPointers.URL == nil {
-		return errors.New("missing config value: url")
-	}
-	config.URL = *(configWithPointers.URL)
-
-	if configWithPointers.Prod == nil {
-		return errors.New("missing config value: prod")
-	}
-	config.Prod = *(configWithPointers.Prod)
-
-	if configWithPointers.Listen.Proto == nil {
-		return errors.New("missing config value: listen.proto")
-	}
-	config.Listen.Proto = *(configWithPointers.Listen.Proto)
-
-	if configWithPointers.Listen.Net == nil {
-		return errors.New("missing config value: listen.net")
-	}
-	config.Listen.Net = *(configWithPointers.Listen.Net)
-
-	if configWithPointers.Listen.Addr == nil {
-		return errors.New("missing config value: listen.addr")
-	}
-	config.Listen.Addr = *(configWithPointers.Listen.Addr)
-
-	if configWithPointers.Listen.Trans == nil {
-		return errors.New("missing config value: listen.trans")
-	}
-	config.Listen.Trans = *(configWithPointers.Listen.Trans)
+	loader := newConfigLoader(path, data, block)
+	loader.loadBlock(block, 0, "", reflect.ValueOf(&config).Elem())
 
 	if config.Listen.Trans == "tls" {
-		if configWithPointers.Listen.TLS.Cert == nil {
-			return errors.New("missing config value: listen.tls.cert")
+		line := loader.keyLines["listen.tls"]
+		if line == 0 {
+			line = loader.keyLines["listen"]
 		}
-		config.Listen.TLS.Cert = *(configWithPointers.Listen.TLS.Cert)
-
-		if configWithPointers.Listen.TLS.Key == nil {
-			return errors.New("missing config value: listen.tls.key")
+		if config.Listen.TLS.Cert == "" {
+			loader.problem(line, "listen.tls.cert", wrapAny(errMissingConfigValue, "required for trans tls"))
+		}
+		if config.Listen.TLS.Key == "" {
+			loader.problem(line, "listen.tls.key", wrapAny(errMissingConfigValue, "required for trans tls"))
 		}
-		config.Listen.TLS.Key = *(configWithPointers.Listen.TLS.Key)
-	}
-
-	if configWithPointers.DB.Type == nil {
-		return errors.New("missing config value: db.type")
-	}
-	config.DB.Type = *(configWithPointers.DB.Type)
-
-	if configWithPointers.DB.Conn == nil {
-		return errors.New("missing config value: db.conn")
-	}
-	config.DB.Conn = *(configWithPointers.DB.Conn)
-
-	if configWithPointers.Auth.Client == nil {
-		return errors.New("missing config value: auth.client")
 	}
-	config.Auth.Client = *(configWithPointers.Auth.Client)
-
-	if configWithPointers.Auth.Authorize == nil {
-		return errors.New("missing config value: auth.authorize")
+	if config.Term != nil && config.Term.End.Before(config.Term.Start) {
+		loader.problem(loader.keyLines["term.end"], "term.end", wrapAny(errInvalidConfigValue, "must not be before term.start"))
 	}
-	config.Auth.Authorize = *(configWithPointers.Auth.Authorize)
 
-	if configWithPointers.Auth.Jwks == nil {
-		return errors.New("missing config value: auth.jwks")
-	}
-	config.Auth.Jwks = *(configWithPointers.Auth.Jwks)
+	return loader.err()
+}
 
-	if configWithPointers.Auth.Token == nil {
-		return errors.New("missing config value: auth.token")
+/* Dates with no CCAs, which may be split across several skip directives */
+type termSkipT map[time.Time]struct{}
+
+func (skips *termSkipT) loadConfig(loader *configLoaderT, key string, _ int, dirs []*scfg.Directive) {
+	*skips = make(termSkipT)
+	for _, d := range dirs {
+		for _, s := range d.Params {
+			skip, err := time.ParseInLocation(time.DateOnly, s, loc)
+			if err != nil {
+				loader.problem(loader.line(d), key, wrapError(errInvalidConfigValue, err))
+				continue
+			}
+			(*skips)[skip] = struct{}{}
+		}
 	}
-	config.Auth.Token = *(configWithPointers.Auth.Token)
+}
 
-	if configWithPointers.Auth.Expr == nil {
-		return errors.New("missing config value: auth.expr")
-	}
-	config.Auth.Expr = *(configWithPointers.Auth.Expr)
+/* Start and end times of each course group, relative to midnight */
+type termTimesT map[string][2]time.Duration
 
-	if configWithPointers.Auth.Departments == nil {
-		return errors.New("missing config value: auth.depts")
+func (times *termTimesT) loadConfig(loader *configLoaderT, key string, line int, dirs []*scfg.Directive) {
+	*times = make(termTimesT, len(courseGroups))
+	if len(dirs) == 0 {
+		loader.problem(line, key, errMissingConfigValue)
+		return
 	}
-	config.Auth.Departments = *(configWithPointers.Auth.Departments)
-	if config.Auth.Departments == nil {
-		return errors.New("missing config value: auth.depts")
-	}
-
-	if configWithPointers.Auth.Udepts == nil {
-		return errors.New("missing config value: auth.udepts")
+	if len(dirs) > 1 {
+		loader.problem(loader.line(dirs[1]), key, errDuplicateConfigKey)
 	}
-	config.Auth.Udepts = *(configWithPointers.Auth.Udepts)
-	if config.Auth.Udepts == nil {
-		return errors.New("missing config value: auth.udepts")
-	}
-
-	if configWithPointers.Perf.SendQ == nil {
-		return errors.New("missing config value: perf.sendq")
+	d := dirs[0]
+	for _, child := range d.Children {
+		groupKey := joinConfigKey(key, child.Name)
+		if !checkCourseGroup(child.Name) {
+			loader.problem(loader.line(child), groupKey, wrapAny(errInvalidConfigValue, "unknown course group"))
+			continue
+		}
+		if _, ok := (*times)[child.Name]; ok {
+			loader.problem(loader.line(child), groupKey, errDuplicateConfigKey)
+			continue
+		}
+		if len(child.Params) != 2 {
+			loader.problem(loader.line(child), groupKey, wrapAny(errInvalidConfigValue, "start and end times required"))
+			continue
+		}
+		var durations [2]time.Duration
+		valid := true
+		for i, s := range child.Params {
+			t, err := time.Parse("15:04", s)
+			if err != nil {
+				loader.problem(loader.line(child), groupKey, wrapError(errInvalidConfigValue, err))
+				valid = false
+				break
+			}
+			durations[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		}
+		if !valid {
+			continue
+		}
+		if durations[1] <= durations[0] {
+			loader.problem(loader.line(child), groupKey, wrapAny(errInvalidConfigValue, "end must be after start"))
+			continue
+		}
+		(*times)[child.Name] = durations
 	}
-	config.Perf.SendQ = *(configWithPointers.Perf.SendQ)
-
-	if configWithPointers.Perf.MessageArgumentsCap == nil {
-		return errors.New("missing config value: perf.msg_args_cap")
+	groups := getKeysOfMap(courseGroups)
+	sort.Strings(groups)
+	for _, group := range groups {
+		if _, ok := (*times)[group]; !ok {
+			loader.problem(loader.line(d), joinConfigKey(key, group), errMissingConfigValue)
+		}
 	}
-	config.Perf.MessageArgumentsCap = *(configWithPointers.Perf.MessageArgumentsCap)
+}
 
-	if configWithPointers.Perf.MessageBytesCap == nil {
-		return errors.New("missing config value: perf.msg_bytes_cap")
-	}
-	config.Perf.MessageBytesCap = *(configWithPointers.Perf.MessageBytesCap)
+/*
+ * Export profiles are optional and may be repeated, so they're loaded
+ * separately with defaults applied.
+ */
+type exportProfilesConfigT []exportProfileT
 
-	if configWithPointers.Perf.ReadHeaderTimeout == nil {
-		return errors.New("missing config value: perf.read_header_timeout")
+func (profiles *exportProfilesConfigT) loadConfig(loader *configLoaderT, key string, _ int, dirs []*scfg.Directive) {
+	names := make(map[string]struct{})
+	for _, profile := range builtinExportProfiles {
+		names[profile.Name] = struct{}{}
 	}
-	config.Perf.ReadHeaderTimeout = *(configWithPointers.Perf.ReadHeaderTimeout)
 
-	if configWithPointers.Perf.UsemDelayShiftBits == nil {
-		return errors.New("missing config value: perf.usem_delay_shift_bits")
+	*profiles = nil
+	for _, d := range dirs {
+		if len(d.Params) != 1 {
+			loader.problem(loader.line(d), key, wrapAny(errInvalidConfigValue, "exactly one name required"))
+			continue
+		}
+		profileKey := joinConfigKey(key, d.Params[0])
+		if _, ok := names[d.Params[0]]; ok {
+			loader.problem(loader.line(d), profileKey, errDuplicateConfigKey)
+			continue
+		}
+		names[d.Params[0]] = struct{}{}
+
+		var p struct {
+			Format     string               `scfg:"format" default:"csv" check:"oneof=csv|json"`
+			Filename   *string              `scfg:"filename"`
+			TimeFormat string               `scfg:"time_format" default:"2006-01-02T15:04:05Z07:00"`
+			BOM        bool                 `scfg:"bom" default:"false"`
+			Columns    exportColumnsConfigT `scfg:"column"`
+		}
+		loader.loadBlock(d.Children, loader.line(d), profileKey, reflect.ValueOf(&p).Elem())
+
+		profile := exportProfileT{
+			Name:       d.Params[0],
+			Format:     p.Format,
+			Filename:   "cca_choices_{profile}_{date}." + p.Format,
+			TimeFormat: p.TimeFormat,
+			BOM:        p.BOM,
+			Columns:    p.Columns,
+		} //exhaustruct:ignore
+		if p.Filename != nil {
+			profile.Filename = *(p.Filename)
+		}
+		*profiles = append(*profiles, profile)
 	}
-	config.Perf.UsemDelayShiftBits = *(configWithPointers.Perf.UsemDelayShiftBits)
+}
 
-	if configWithPointers.Perf.PropagateImmediate == nil {
-		return errors.New("missing config value: perf.propagate_immediate")
-	}
-	config.Perf.PropagateImmediate = *(configWithPointers.Perf.PropagateImmediate)
+type exportColumnsConfigT []exportColumnT
 
-	if configWithPointers.Req.Y9.Sport == nil {
-		return errors.New("missing config value: req.y9.sport")
-	}
-	config.Req.Y9.Sport = *(configWithPointers.Req.Y9.Sport)
-	if configWithPointers.Req.Y9.NonSport == nil {
-		return errors.New("missing config value: req.y9.non_sport")
+func (columns *exportColumnsConfigT) loadConfig(loader *configLoaderT, key string, line int, dirs []*scfg.Directive) {
+	if len(dirs) == 0 {
+		loader.problem(line, key, wrapAny(errMissingConfigValue, "no columns"))
+		return
 	}
-	config.Req.Y9.NonSport = *(configWithPointers.Req.Y9.NonSport)
-	if configWithPointers.Req.Y10.Sport == nil {
-		return errors.New("missing config value: req.y10.sport")
-	}
-	config.Req.Y10.Sport = *(configWithPointers.Req.Y10.Sport)
-	if configWithPointers.Req.Y10.NonSport == nil {
-		return errors.New("missing config value: req.y10.non_sport")
-	}
-	config.Req.Y10.NonSport = *(configWithPointers.Req.Y10.NonSport)
-	if configWithPointers.Req.Y11.Sport == nil {
-		return errors.New("missing config value: req.y11.sport")
-	}
-	config.Req.Y11.Sport = *(configWithPointers.Req.Y11.Sport)
-	if configWithPointers.Req.Y11.NonSport == nil {
-		return errors.New("missing config value: req.y11.non_sport")
-	}
-	config.Req.Y11.NonSport = *(configWithPointers.Req.Y11.NonSport)
-	if configWithPointers.Req.Y12.Sport == nil {
-		return errors.New("missing config value: req.y12.sport")
-	}
-	config.Req.Y12.Sport = *(configWithPointers.Req.Y12.Sport)
-	if configWithPointers.Req.Y12.NonSport == nil {
-		return errors.New("missing config value: req.y12.non_sport")
+	for _, d := range dirs {
+		if len(d.Params) != 2 {
+			loader.problem(loader.line(d), key, wrapAny(errInvalidConfigValue, "a field and a header required"))
+			continue
+		}
+		var c struct {
+			Value *string           `scfg:"value"`
+			Map   map[string]string `scfg:"map" default:""`
+		}
+		columnKey := joinConfigKey(key, d.Params[1])
+		loader.loadBlock(d.Children, loader.line(d), columnKey, reflect.ValueOf(&c).Elem())
+
+		column := exportColumnT{
+			Field:  d.Params[0],
+			Header: d.Params[1],
+			Value:  c.Value,
+			Map:    c.Map,
+		}
+		if column.Field == "-" {
+			if column.Value == nil {
+				loader.problem(loader.line(d), columnKey, wrapAny(errInvalidConfigValue, "either a field or a value required"))
+				continue
+			}
+		} else if _, ok := exportFields[column.Field]; !ok {
+			loader.problem(loader.line(d), columnKey, wrapAny(errInvalidConfigValue, "unknown field "+column.Field))
+			continue
+		}
+		*columns = append(*columns, column)
 	}
-	config.Req.Y12.NonSport = *(configWithPointers.Req.Y12.NonSport)
-
-	return nil
 }
@@ -0,0 +1,348 @@
+/*
+ * Load configuration according to the config struct
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"codeberg.org/emersion/go-scfg"
+)
+
+/*
+ * The config struct is its own schema. The scfg tag of each field names its
+ * directive, and these tags describe it further:
+ *
+ *   default:"x"  the directive may be omitted, and x is used instead
+ *   check:"c"    the value must be positive, nonnegative, or oneof=a|b|c
+ *   env:"NAME"   the environment variable NAME overrides the file if set,
+ *                so that secrets need not be written in it
+ *
+ * Fields are strings, booleans, ints, float64s, dates in YYYY-MM-DD form,
+ * blocks of string pairs for maps, and blocks for structs. Pointer fields
+ * may be omitted and are nil then. Anything else implements
+ * configLoadableT. Every problem found is collected with its line number,
+ * instead of stopping at the first one, so that all of them could be fixed
+ * in one go.
+ */
+
+type configLoadableT interface {
+	/*
+	 * Load from every directive with the field's name, which might be
+	 * none, in the block starting at line.
+	 */
+	loadConfig(loader *configLoaderT, key string, line int, dirs []*scfg.Directive)
+}
+
+/* Directives that are accepted but ignored, with what to use instead */
+var deprecatedConfigKeys = map[string]string{
+	"perf.usem_delay_shift_bits": "use perf.broadcast_interval instead",
+}
+
+type configProblemT struct {
+	/* 0 if the problem isn't on any particular line */
+	Line int
+	Key  string
+	Err  error
+}
+
+type configLoaderT struct {
+	path string
+	/* scfg keeps line numbers to itself */
+	lines map[*scfg.Directive]int
+	/* The line of each directive loaded, by its full key */
+	keyLines map[string]int
+	problems []configProblemT
+}
+
+func newConfigLoader(path string, data []byte, block scfg.Block) *configLoaderT {
+	return &configLoaderT{
+		path:     path,
+		lines:    configDirectiveLines(data, block),
+		keyLines: make(map[string]int),
+		problems: nil,
+	}
+}
+
+/*
+ * Find the line of each directive the way scfg reads them: one per line
+ * that isn't blank, a comment or a lone closing brace, in order. Words are
+ * only separated by spaces and tabs, and a closing brace must end its line,
+ * exactly as in scfg, which reads a brace followed by whitespace as a
+ * directive named "}". Should this ever disagree with scfg anyway, problems
+ * are reported without line numbers rather than with wrong ones.
+ */
+func configDirectiveLines(data []byte, block scfg.Block) map[*scfg.Directive]int {
+	var lineNumbers []int
+	for i, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSuffix(l, "\r")
+		words := strings.FieldsFunc(l, func(r rune) bool {
+			return r == ' ' || r == '\t'
+		})
+		if len(words) == 0 || words[0][0] == '#' {
+			continue
+		}
+		if len(words) == 1 && l[len(l)-1] == '}' {
+			continue
+		}
+		lineNumbers = append(lineNumbers, i+1)
+	}
+
+	lines := make(map[*scfg.Directive]int)
+	var walk func(block scfg.Block)
+	walk = func(block scfg.Block) {
+		for _, d := range block {
+			lines[d] = len(lines)
+			walk(d.Children)
+		}
+	}
+	walk(block)
+	if len(lines) != len(lineNumbers) {
+		slog.Warn("cannot find the lines of configuration directives, so problems are reported without them")
+		return map[*scfg.Directive]int{}
+	}
+	for d, i := range lines {
+		lines[d] = lineNumbers[i]
+	}
+	return lines
+}
+
+func (loader *configLoaderT) line(d *scfg.Directive) int {
+	return loader.lines[d]
+}
+
+func (loader *configLoaderT) problem(line int, key string, err error) {
+	loader.problems = append(loader.problems, configProblemT{
+		Line: line,
+		Key:  key,
+		Err:  err,
+	})
+}
+
+/* nil if nothing was wrong */
+func (loader *configLoaderT) err() error {
+	if len(loader.problems) == 0 {
+		return nil
+	}
+	problems := slices.Clone(loader.problems)
+	slices.SortStableFunc(problems, func(a, b configProblemT) int {
+		return a.Line - b.Line
+	})
+	return &configErrorT{path: loader.path, problems: problems}
+}
+
+type configErrorT struct {
+	path     string
+	problems []configProblemT
+}
+
+/* One problem per line, like compilers do */
+func (e *configErrorT) Error() string {
+	var sb strings.Builder
+	for i, p := range e.problems {
+		if i != 0 {
+			sb.WriteByte('\n')
+		}
+		if p.Line == 0 {
+			fmt.Fprintf(&sb, "%s: %s: %v", e.path, p.Key, p.Err)
+		} else {
+			fmt.Fprintf(&sb, "%s:%d: %s: %v", e.path, p.Line, p.Key, p.Err)
+		}
+	}
+	return sb.String()
+}
+
+func (e *configErrorT) Unwrap() []error {
+	errs := make([]error, len(e.problems))
+	for i, p := range e.problems {
+		errs[i] = p.Err
+	}
+	return errs
+}
+
+func joinConfigKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+/*
+ * Load the fields of the struct v from a block starting at line, which is
+ * nil if the block was omitted, reporting directives that aren't known.
+ */
+func (loader *configLoaderT) loadBlock(block scfg.Block, line int, prefix string, v reflect.Value) {
+	t := v.Type()
+	known := make(map[string]struct{}, t.NumField())
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, ok := field.Tag.Lookup("scfg")
+		if !ok {
+			continue
+		}
+		known[name] = struct{}{}
+		loader.loadField(field, joinConfigKey(prefix, name), line, block.GetAll(name), v.Field(i))
+	}
+
+	for _, d := range block {
+		if _, ok := known[d.Name]; ok {
+			continue
+		}
+		key := joinConfigKey(prefix, d.Name)
+		if hint, ok := deprecatedConfigKeys[key]; ok {
+			slog.Warn("deprecated configuration directive is ignored", "key", key, "line", loader.line(d), "hint", hint)
+			continue
+		}
+		loader.problem(loader.line(d), key, errUnknownConfigKey)
+	}
+}
+
+func (loader *configLoaderT) loadField(field reflect.StructField, key string, line int, dirs []*scfg.Directive, v reflect.Value) {
+	if loadable, ok := v.Addr().Interface().(configLoadableT); ok {
+		loadable.loadConfig(loader, key, line, dirs)
+		return
+	}
+
+	if len(dirs) > 1 {
+		loader.problem(loader.line(dirs[1]), key, errDuplicateConfigKey)
+	}
+	check := field.Tag.Get("check")
+
+	if env := field.Tag.Get("env"); env != "" {
+		if s, ok := os.LookupEnv(env); ok {
+			slog.Info("configuration value from the environment", "key", key, "variable", env)
+			loader.parseValue(key+" (from "+env+")", 0, s, v, check)
+			return
+		}
+	}
+
+	if len(dirs) == 0 {
+		defaultValue, hasDefault := field.Tag.Lookup("default")
+		switch {
+		case v.Kind() == reflect.Pointer:
+		case hasDefault && v.Kind() == reflect.Map:
+			v.Set(reflect.MakeMap(v.Type()))
+		case hasDefault:
+			loader.parseValue(key, 0, defaultValue, v, check)
+		case v.Kind() == reflect.Struct && v.Type() != reflect.TypeFor[time.Time]():
+			/* Report what's missing from it instead */
+			loader.loadBlock(nil, line, key, v)
+		default:
+			loader.problem(line, key, errMissingConfigValue)
+		}
+		return
+	}
+
+	d := dirs[0]
+	loader.keyLines[key] = loader.line(d)
+	if v.Kind() == reflect.Pointer {
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+
+	switch {
+	case v.Kind() == reflect.Struct && v.Type() != reflect.TypeFor[time.Time]():
+		if d.Children == nil || len(d.Params) != 0 {
+			loader.problem(loader.line(d), key, wrapAny(errInvalidConfigValue, "expected a block"))
+			return
+		}
+		loader.loadBlock(d.Children, loader.line(d), key, v)
+	case v.Kind() == reflect.Map:
+		if d.Children == nil || len(d.Params) != 0 {
+			loader.problem(loader.line(d), key, wrapAny(errInvalidConfigValue, "expected a block"))
+			return
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(d.Children))
+		for _, child := range d.Children {
+			childKey := joinConfigKey(key, child.Name)
+			if len(child.Params) != 1 || child.Children != nil {
+				loader.problem(loader.line(child), childKey, wrapAny(errInvalidConfigValue, "expected one value"))
+				continue
+			}
+			if m.MapIndex(reflect.ValueOf(child.Name)).IsValid() {
+				loader.problem(loader.line(child), childKey, errDuplicateConfigKey)
+				continue
+			}
+			m.SetMapIndex(reflect.ValueOf(child.Name), reflect.ValueOf(child.Params[0]))
+		}
+		v.Set(m)
+	default:
+		if len(d.Params) != 1 || d.Children != nil {
+			loader.problem(loader.line(d), key, wrapAny(errInvalidConfigValue, "expected one value"))
+			return
+		}
+		loader.parseValue(key, loader.line(d), d.Params[0], v, check)
+	}
+}
+
+/* Set v from s, which was found at line, and check it */
+func (loader *configLoaderT) parseValue(key string, line int, s string, v reflect.Value, check string) {
+	var number float64
+	switch {
+	case v.Type() == reflect.TypeFor[time.Time]():
+		t, err := time.ParseInLocation(time.DateOnly, s, loc)
+		if err != nil {
+			loader.problem(line, key, wrapError(errInvalidConfigValue, err))
+			return
+		}
+		v.Set(reflect.ValueOf(t))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			loader.problem(line, key, wrapAny(errInvalidConfigValue, "expected true or false, got "+s))
+			return
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			loader.problem(line, key, wrapAny(errInvalidConfigValue, "expected an integer, got "+s))
+			return
+		}
+		v.SetInt(int64(i))
+		number = float64(i)
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			loader.problem(line, key, wrapAny(errInvalidConfigValue, "expected a number, got "+s))
+			return
+		}
+		v.SetFloat(f)
+		number = f
+	default:
+		loader.problem(line, key, errType)
+		return
+	}
+
+	switch {
+	case check == "":
+	case check == "positive":
+		if number <= 0 {
+			loader.problem(line, key, wrapAny(errInvalidConfigValue, "must be positive"))
+		}
+	case check == "nonnegative":
+		if number < 0 {
+			loader.problem(line, key, wrapAny(errInvalidConfigValue, "must not be negative"))
+		}
+	case strings.HasPrefix(check, "oneof="):
+		allowed := strings.Split(strings.TrimPrefix(check, "oneof="), "|")
+		if !slices.Contains(allowed, s) {
+			loader.problem(line, key, wrapAny(errInvalidConfigValue, "must be one of "+strings.Join(allowed, ", ")))
+		}
+	default:
+		loader.problem(line, key, errType)
+	}
+}
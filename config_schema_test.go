@@ -0,0 +1,169 @@
+/*
+ * Tests for the configuration loader
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"codeberg.org/emersion/go-scfg"
+)
+
+type testConfigT struct {
+	Name  string `scfg:"name"`
+	Count int    `scfg:"count" default:"3" check:"positive"`
+	Mode  string `scfg:"mode" default:"a" check:"oneof=a|b"`
+	Inner struct {
+		Flag bool    `scfg:"flag"`
+		Rate float64 `scfg:"rate" default:"1.5" check:"nonnegative"`
+	} `scfg:"inner"`
+	Pairs map[string]string `scfg:"pairs" default:""`
+	Opt   *struct {
+		X int `scfg:"x"`
+	} `scfg:"opt"`
+}
+
+func loadTestConfig(t *testing.T, data string) (testConfigT, *configLoaderT) {
+	t.Helper()
+	block, err := scfg.Read(bytes.NewReader([]byte(data)))
+	if err != nil {
+		t.Fatalf("cannot parse test configuration: %v", err)
+	}
+	var c testConfigT
+	loader := newConfigLoader("test.scfg", []byte(data), block)
+	loader.loadBlock(block, 0, "", reflect.ValueOf(&c).Elem())
+	return c, loader
+}
+
+func problemLines(loader *configLoaderT) map[string]int {
+	lines := make(map[string]int, len(loader.problems))
+	for _, p := range loader.problems {
+		lines[p.Key] = p.Line
+	}
+	return lines
+}
+
+/* The lines of every directive, in the order scfg read them */
+func directiveLines(block scfg.Block, lines map[*scfg.Directive]int) []int {
+	var result []int
+	for _, d := range block {
+		result = append(result, lines[d])
+		result = append(result, directiveLines(d.Children, lines)...)
+	}
+	return result
+}
+
+func TestConfigDirectiveLines(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		want []int
+	}{
+		{"plain", "a 1\nb {\n\tc 2\n}\nd 3\n", []int{1, 2, 3, 5}},
+		{"comments and blanks", "# x\n\na 1\n  # y\nb {\n\tc 2\n}\n \t\nd 3", []int{3, 5, 6, 9}},
+		{"indented brace", "a 1\nb {\n\tc {\n\t\td 2\n\t}\n}\ne 3\n", []int{1, 2, 3, 4, 7}},
+		{"carriage returns", "a 1\r\nb {\r\n\tc 2\r\n}\r\nd 3\r\n", []int{1, 2, 3, 5}},
+		{"empty block", "a {\n}\nb 1\n", []int{1, 3}},
+		/* scfg reads this as a directive named "}", which is then unknown */
+		{"brace with trailing whitespace", "a 1\n} \nb 2\n", []int{1, 2, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			block, err := scfg.Read(strings.NewReader(tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := directiveLines(block, configDirectiveLines([]byte(tc.data), block))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got lines %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigTrailingBrace(t *testing.T) {
+	_, loader := loadTestConfig(t, "name x\ninner {\n\tflag true\n}\n} \ncount 0\n")
+	want := map[string]int{
+		"}":     5,
+		"count": 6,
+	}
+	if got := problemLines(loader); !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems on lines %v, want %v", got, want)
+	}
+}
+
+func TestConfigLoad(t *testing.T) {
+	c, loader := loadTestConfig(t, "name x\ninner {\n\tflag true\n}\npairs {\n\tk v\n}\n")
+	if err := loader.err(); err != nil {
+		t.Fatalf("unexpected problems: %v", err)
+	}
+	if c.Name != "x" || c.Count != 3 || c.Mode != "a" || !c.Inner.Flag || c.Inner.Rate != 1.5 {
+		t.Errorf("unexpected values: %+v", c)
+	}
+	if c.Pairs["k"] != "v" {
+		t.Errorf("got pairs %v, want k v", c.Pairs)
+	}
+	if c.Opt != nil {
+		t.Errorf("omitted block loaded as %+v", c.Opt)
+	}
+}
+
+func TestConfigOptionalBlock(t *testing.T) {
+	c, loader := loadTestConfig(t, "name x\ninner {\n\tflag true\n}\nopt {\n\tx 2\n}\n")
+	if err := loader.err(); err != nil {
+		t.Fatalf("unexpected problems: %v", err)
+	}
+	if c.Opt == nil || c.Opt.X != 2 {
+		t.Errorf("got block %+v, want x 2", c.Opt)
+	}
+
+	_, loader = loadTestConfig(t, "name x\ninner {\n\tflag true\n}\nopt {\n}\n")
+	if got, want := problemLines(loader), map[string]int{"opt.x": 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems on lines %v, want %v", got, want)
+	}
+}
+
+func TestConfigProblems(t *testing.T) {
+	_, loader := loadTestConfig(t, "# comment\nname x\ncount 0\n\nmode c\ninner {\n\tflag maybe\n\tbogus 1\n}\nname y\nextra 1\n")
+	want := map[string]int{
+		"count":       3,
+		"mode":        5,
+		"inner.flag":  7,
+		"inner.bogus": 8,
+		"name":        10,
+		"extra":       11,
+	}
+	if got := problemLines(loader); !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems on lines %v, want %v", got, want)
+	}
+
+	err := loader.err()
+	if !errors.Is(err, errInvalidConfigValue) || !errors.Is(err, errUnknownConfigKey) ||
+		!errors.Is(err, errDuplicateConfigKey) {
+		t.Errorf("missing error kinds in %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "test.scfg:3: count: ") {
+		t.Errorf("problems not sorted by line: %v", err)
+	}
+}
+
+func TestConfigMissing(t *testing.T) {
+	_, loader := loadTestConfig(t, "count 1\n")
+	want := map[string]int{
+		"name":       0,
+		"inner.flag": 0,
+	}
+	if got := problemLines(loader); !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems on lines %v, want %v", got, want)
+	}
+	if !errors.Is(loader.err(), errMissingConfigValue) {
+		t.Errorf("expected missing values, got %v", loader.err())
+	}
+}
@@ -10,6 +10,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 )
 
 /* Course types, e.g. Sport */
@@ -101,6 +102,16 @@ var courseGroups = map[string]string{
 	tt3: "Tuesday/Thursday CCA3",
 }
 
+/* Which days of the week each course group meets on */
+var courseGroupWeekdays = map[string][]time.Weekday{
+	mw1: {time.Monday, time.Wednesday},
+	mw2: {time.Monday, time.Wednesday},
+	mw3: {time.Monday, time.Wednesday},
+	tt1: {time.Tuesday, time.Thursday},
+	tt2: {time.Tuesday, time.Thursday},
+	tt3: {time.Tuesday, time.Thursday},
+}
+
 /* Populate both */
 
 func populateUserCourseTypesAndGroups(
@@ -109,27 +120,11 @@ func populateUserCourseTypesAndGroups(
 	userCourseGroups *userCourseGroupsT,
 	userID string,
 ) error {
-	rows, err := db.Query(
-		ctx,
-		"SELECT courseid FROM choices WHERE userid = $1",
-		userID,
-	)
+	courseIDs, err := store.getUserChoices(ctx, getActiveTerm(), userID)
 	if err != nil {
-		return fmt.Errorf("get user choices: %w", err)
+		return err
 	}
-	for {
-		if !rows.Next() {
-			err := rows.Err()
-			if err != nil {
-				return fmt.Errorf("read next user choice: %w", err)
-			}
-			break
-		}
-		var thisCourseID int
-		err := rows.Scan(&thisCourseID)
-		if err != nil {
-			return fmt.Errorf("scan user choice: %w", err)
-		}
+	for _, thisCourseID := range courseIDs {
 		var thisGroupName, thisTypeName string
 		_course, ok := courses.Load(thisCourseID)
 		if !ok {
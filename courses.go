@@ -10,38 +10,43 @@ package main
 import (
 	"context"
 	"fmt"
-	"log/slog"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/coder/websocket"
 )
 
 type courseT struct {
 	/*
-	 * Selected is usually accessed atomically, but a lock is still
-	 * necessary as we need to sequentialize compare-with-Max-and-increment
-	 * operations.
-	 * We put Selected before other values to ensure 64-bit alignment on
-	 * all systems, because it needs to be accessed atomically. See the
-	 * "Bugs" section of sync/atomic.
+	 * Version is incremented every time Selected changes, so that the
+	 * broadcasters could tell which courses need to be sent out again.
+	 * It must come first to ensure 64-bit alignment on all systems,
+	 * because it needs to be accessed atomically. See the "Bugs" section
+	 * of sync/atomic.
 	 */
-	Selected     uint32 /* atomic */
-	SelectedLock sync.Mutex
-	ID           int
-	Max          uint32
-	Title        string
-	Type         string
-	Group        string
-	Teacher      string
-	Location     string
-	CourseID     string
-	SectionID    string
-	YearGroups   uint8
-	Usems        sync.Map /* string, *usemT */
-	Forced       bool
-	LegalSexReq  string
+	Version uint64 /* atomic */
+	/*
+	 * Selected follows the count stored in the database, which is what
+	 * capacity is checked against. It is only ever added to, by whoever
+	 * changed the count or on notice from another instance, so that the
+	 * changes could be applied in any order.
+	 */
+	Selected    uint32 /* atomic */
+	ID          int
+	Max         uint32
+	Title       string
+	Type        string
+	Group       string
+	Teacher     string
+	Location    string
+	CourseID    string
+	SectionID   string
+	YearGroups  uint8
+	Forced      bool
+	LegalSexReq string
 }
 
 var courses sync.Map /* int, *courseT */
@@ -51,91 +56,76 @@ var numCourses uint32 /* atomic */
 const staffDepartment = "Staff"
 
 /*
- * Read course information from the database. This should be called during
- * setup.
+ * Read course information of the active term from the database. This
+ * should be called during setup.
  */
 func setupCourses(ctx context.Context) error {
-	rows, err := db.Query(
-		ctx,
-		"SELECT id, nmax, title, ctype, cgroup, teacher, location, course_id, section_id, year_groups, forced, COALESCE(legal_sex_requirements, '') FROM courses",
-	)
+	dbCourses, err := store.getCourses(ctx, getActiveTerm())
 	if err != nil {
-		return fmt.Errorf("get courses from database: %w", err)
+		return err
 	}
-
-	for {
-		if !rows.Next() {
-			err := rows.Err()
-			if err != nil {
-				return fmt.Errorf("read next course: %w", err)
-			}
-			break
-		}
-		currentCourse := courseT{} //exhaustruct:ignore
-		err = rows.Scan(
-			&currentCourse.ID,
-			&currentCourse.Max,
-			&currentCourse.Title,
-			&currentCourse.Type,
-			&currentCourse.Group,
-			&currentCourse.Teacher,
-			&currentCourse.Location,
-			&currentCourse.CourseID,
-			&currentCourse.SectionID,
-			&currentCourse.YearGroups,
-			&currentCourse.Forced,
-			&currentCourse.LegalSexReq,
-		)
-		if err != nil {
-			return fmt.Errorf("scan course: %w", err)
-		}
+	for _, currentCourse := range dbCourses {
 		if !checkCourseType(currentCourse.Type) {
 			return fmt.Errorf("invalid course type in database: %d %s", currentCourse.ID, currentCourse.Type)
 		}
 		if !checkCourseGroup(currentCourse.Group) {
 			return fmt.Errorf("invalid course group in database: %d %s", currentCourse.ID, currentCourse.Group)
 		}
-		var selected1 uint32
-		err := db.QueryRow(
-			ctx,
-			"SELECT COUNT (*) FROM choices WHERE courseid = $1",
-			currentCourse.ID,
-		).Scan(&selected1)
-		if err != nil {
-			return fmt.Errorf("get selected count: %w", err)
-		}
-		/*
-			err = db.QueryRow(
-				ctx,
-				"SELECT COUNT (*) FROM pre_selected WHERE course_id = $1",
-				currentCourse.ID,
-			).Scan(&selected2)
-		*/
-		currentCourse.Selected = selected1
-		courses.Store(currentCourse.ID, &currentCourse)
+		courses.Store(currentCourse.ID, currentCourse)
 		atomic.AddUint32(&numCourses, 1)
 	}
 
 	return nil
 }
 
+/* Throw away the courses in memory and read them again */
+func reloadCourses(ctx context.Context) error {
+	courses.Range(func(key, _ interface{}) bool {
+		courses.Delete(key)
+		return true
+	})
+	atomic.StoreUint32(&numCourses, 0)
+	err := setupCourses(ctx)
+	if err != nil {
+		return wrapError(errWhileSetttingUpCourseTablesAgain, err)
+	}
+	return nil
+}
+
+/*
+ * Give a student the choices pre-selected for them, counting the ones they
+ * didn't already have.
+ */
+func addForcedChoices(ctx context.Context, userID, studentID, ip string, now time.Time) error {
+	courseIDs, err := store.insertForcedChoices(ctx, getActiveTerm(), userID, studentID, ip, now)
+	if err != nil {
+		return err
+	}
+	for _, courseID := range courseIDs {
+		_course, ok := courses.Load(courseID)
+		if !ok {
+			return errNoSuchCourse
+		}
+		course, ok := _course.(*courseT)
+		if !ok {
+			return errType
+		}
+		if course == nil {
+			return errNoSuchCourse
+		}
+
+		atomic.AddUint32(&course.Selected, 1)
+		course.markUpdated()
+	}
+	return nil
+}
+
 func (course *courseT) decrementSelectedAndPropagate(
 	ctx context.Context,
 	conn *websocket.Conn,
 ) error {
-	func() {
-		course.SelectedLock.Lock()
-		defer course.SelectedLock.Unlock()
-		atomic.AddUint32(&course.Selected, ^uint32(0))
-	}()
-	go func() {
-		defer func() {
-			if e := recover(); e != nil {
-				slog.Error("panic", "arg", e)
-			}
-		}()
-		propagateSelectedUpdate(course)
-	}()
+	atomic.AddUint32(&course.Selected, ^uint32(0))
+	course.markUpdated()
 	err := sendSelectedUpdate(ctx, conn, course.ID)
 	if err != nil {
 		return fmt.Errorf("send selected update: %w", err)
@@ -143,6 +133,22 @@ func (course *courseT) decrementSelectedAndPropagate(
 	return nil
 }
 
+/*
+ * This must be called after every change to Selected, so that the new value
+ * is eventually broadcast.
+ */
+func (course *courseT) markUpdated() {
+	atomic.AddUint64(&course.Version, 1)
+}
+
+/* Percentage of seats taken, for display */
+func (course *courseT) FillPercent() uint32 {
+	if course.Max == 0 {
+		return 0
+	}
+	return atomic.LoadUint32(&course.Selected) * 100 / course.Max
+}
+
 var yearGroupsNumberBits = map[string]uint8{"Y9": 1, "Y10": 2, "Y11": 4, "Y12": 8}
 
 func yearGroupsStringToNumber(s string) (uint8, error) {
@@ -163,3 +169,16 @@ func yearGroupsStringToNumber(s string) (uint8, error) {
 	}
 	return spec, nil
 }
+
+func yearGroupsNumberToString(spec uint8) string {
+	names := make([]string, 0, len(yearGroupsNumberBits))
+	for yeargroup, bit := range yearGroupsNumberBits {
+		if spec&bit != 0 {
+			names = append(names, yeargroup)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return yearGroupsNumberBits[names[i]] < yearGroupsNumberBits[names[j]]
+	})
+	return strings.Join(names, " ")
+}
@@ -9,54 +9,199 @@ package main
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"time"
+)
+
+/*
+ * Everything stored in the database is accessed through store, so that the
+ * rest of the program does not care whether it is PostgreSQL or SQLite.
+ * Both backends share the SQL in database_sql.go; see database_postgres.go
+ * and database_sqlite.go for what differs.
+ *
+ * Methods that change data record it in the audit log in the same
+ * transaction, with actor and ip describing who made the change. Methods
+ * taking a term only see and change the data of that term.
+ */
+type storeT interface {
+	close()
+
+	/* Schema migrations, see migrations.go */
+	migrateUp(ctx context.Context) error
+	migrateDown(ctx context.Context, steps int) error
+	getMigrationStatus(ctx context.Context) ([]migrationStatusT, error)
+
+	/* Terms, see terms.go */
+	getTerms(ctx context.Context) ([]termT, error)
+	getActiveTerm(ctx context.Context) (int64, error)
+	createTerm(ctx context.Context, actor, ip, name string, copyFrom int64) (int64, error)
+	setActiveTerm(ctx context.Context, actor, ip string, term int64) error
+
+	/* Users and sessions */
+	getUserBySession(ctx context.Context, session string) (userT, error)
+	upsertUser(ctx context.Context, user userT, session string, expr int64) error
+	getUsers(ctx context.Context, term int64) ([]userT, error)
+	getConfirmed(ctx context.Context, term int64, userID string) (bool, error)
+	setConfirmed(ctx context.Context, term int64, userID, ip string, confirmed bool) error
+	getUnconfirmedStudents(ctx context.Context, term int64) ([]studentRowT, error)
+	getYearGroupCounts(ctx context.Context, term int64) (map[string]yearGroupCountsT, error)
+
+	/* Courses */
+	getCourses(ctx context.Context, term int64) ([]*courseT, error)
+	replaceCourses(ctx context.Context, term int64, actor, ip string, upload auditUploadT, courses []*courseT) error
+
+	/* Choices */
+	getUserChoices(ctx context.Context, term int64, userID string) ([]int, error)
+	insertChoice(ctx context.Context, term int64, userID, ip string, courseID int) (insertChoiceResultT, error)
+	deleteChoice(ctx context.Context, term int64, userID, ip string, courseID int) (bool, error)
+	getChoiceRows(ctx context.Context, term int64) ([]choiceRowT, error)
+	getChoiceCounts(ctx context.Context, term int64) (map[int]uint32, error)
+	repairSelected(ctx context.Context, actor, ip string, courseID int) (uint32, error)
+	getTimedChoices(ctx context.Context, term int64) ([]timedChoiceT, error)
+	getChoiceEvents(ctx context.Context, term int64) ([]choiceEventT, error)
+	streamChoices(ctx context.Context, filter exportFilterT, fn func(c *exportChoiceT) error) ([]danglingChoiceT, error)
+	streamStudents(ctx context.Context, filter exportFilterT, fn func(s *exportStudentT) error) error
+
+	/* States and schedules */
+	loadState(ctx context.Context, yeargroup string) (uint32, time.Time, error)
+	saveState(ctx context.Context, yeargroup string, oldState, newState uint32) (bool, error)
+	saveSchedule(ctx context.Context, yeargroup string, schedule time.Time) error
+
+	/* Expected students and pre-selections */
+	getExpectedStudents(ctx context.Context, term int64) ([]expectedStudentT, error)
+	countExpectedStudents(ctx context.Context, term int64) (int, error)
+	getExpectedLegalSex(ctx context.Context, term int64, studentID string) (string, error)
+	replaceExpectedStudents(ctx context.Context, term int64, actor, ip string, upload auditUploadT, students []expectedStudentT) error
+	replacePreSelections(ctx context.Context, term int64, actor, ip string, upload auditUploadT, preSelections []preSelectionT) error
+	insertForcedChoices(ctx context.Context, term int64, userID, studentID, ip string, seltime time.Time) ([]int, error)
+
+	/* Announcements */
+	getAllAnnouncements(ctx context.Context) ([]announcementT, error)
+	insertAnnouncement(ctx context.Context, a *announcementT) error
+	deleteAnnouncement(ctx context.Context, id int) (uint8, error)
+
+	/* Calendar tokens */
+	getCalendarToken(ctx context.Context, userID, newToken string) (string, error)
+	setCalendarToken(ctx context.Context, userID, token string) error
+	getCalendarUser(ctx context.Context, token string) (userT, error)
+
+	/* Backups, see backup.go */
+	getBackup(ctx context.Context, term int64) (*backupT, error)
+	restoreBackup(ctx context.Context, term int64, actor, ip string, upload auditUploadT, b *backupT) error
+
+	/* Reverting uploads, see upload_undo.go */
+	getLastUpload(ctx context.Context, term int64, since time.Time) (*uploadSnapshotT, error)
+	revertUpload(ctx context.Context, term int64, actor, ip string, id int64, since time.Time) (string, error)
+
+	/* Other instances, see cluster.go */
+	notify(ctx context.Context, msg string) error
+	listen(ctx context.Context, onConnect func() error, fn func(msg string)) error
+
+	/* Audit log, see audit.go */
+	recordAudit(ctx context.Context, actor, ip, action, subject string, before, after any) error
+	streamAuditEvents(ctx context.Context, filter auditFilterT, limit int, fn func(event *auditEventT) error) error
+}
+
+var store storeT
+
+type userT struct {
+	ID         string
+	Name       string
+	Email      string
+	Department string
+	/* Empty if unknown */
+	LegalSex string
+	/* In the term asked for; not filled in by getUserBySession */
+	Confirmed bool
+}
+
+/* Students who have logged in, by year group */
+type yearGroupCountsT struct {
+	Total     int
+	Chosen    int
+	Confirmed int
+}
+
+type insertChoiceResultT int
 
-	"github.com/jackc/pgx/v5/pgxpool"
+const (
+	choiceInserted insertChoiceResultT = iota
+	choiceAlreadyChosen
+	choiceFull
 )
 
-var db *pgxpool.Pool
+type timedChoiceT struct {
+	UserID     string
+	CourseID   int
+	SelTime    time.Time
+	Department string
+}
+
+type choiceEventT struct {
+	UserID string
+	/* nil for confirmations */
+	CourseID *int
+	Kind     string
+	Time     time.Time
+}
+
+/*
+ * A row of the student export, with the user and expected student fields
+ * nil when the student has never logged in or was not expected respectively.
+ */
+type exportStudentT struct {
+	Name         *string
+	Email        *string
+	Department   *string
+	Confirmed    *bool
+	ExpectedID   *int64
+	ExpectedName *string
+}
 
-const pgErrUniqueViolation = "23505"
+type preSelectionT struct {
+	StudentID int64
+	CourseID  int
+}
 
 /*
  * This must be run during setup, before the database is accessed by any
- * means. Otherwise, db would be a null pointer.
+ * means. Otherwise, store would be nil. Pending migrations are applied.
  */
 func setupDatabase() error {
-	var err error
-	if config.DB.Type != "postgres" {
-		return errors.New("only postgres databases are supported")
-	}
-
-	// Parse the connection string into a Config object
-	poolConfig, err := pgxpool.ParseConfig(config.DB.Conn)
+	err := openDatabase()
 	if err != nil {
-		return fmt.Errorf("parse database config: %w", err)
+		return err
 	}
+	return store.migrateUp(context.Background())
+}
 
-	// Configure the connection pool for high concurrency
-	poolConfig.MaxConns = 500                       // Maximum number of connections in the pool
-	poolConfig.MinConns = 10                        // Minimum idle connections to maintain
-	poolConfig.MaxConnLifetime = 5 * time.Hour      // Maximum lifetime of a connection
-	poolConfig.MaxConnIdleTime = 30 * time.Minute   // Maximum idle time before recycling
-	poolConfig.HealthCheckPeriod = 40 * time.Second // How often to check connection health
-
-	// Connection acquisition timeout and cancellation
-	poolConfig.ConnConfig.ConnectTimeout = 5 * time.Second
-
-	// Create context with timeout for initial connection
-	// Create the connection pool with our optimized settings
-	db, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
-	if err != nil {
-		return fmt.Errorf("open database: %w", err)
+/* Connect without touching the schema, for the migrate subcommand */
+func openDatabase() error {
+	var err error
+	switch config.DB.Type {
+	case "postgres":
+		store, err = openPostgres(config.DB.Conn)
+	case "sqlite":
+		store, err = openSQLite(config.DB.Conn)
+	default:
+		return wrapAny(errUnknownDatabaseType, config.DB.Type)
 	}
+	return err
+}
 
-	// Verify the connection works
-	if err := db.Ping(context.Background()); err != nil {
-		return fmt.Errorf("ping database: %w", err)
+/*
+ * Connect to the database without changing anything, not even creating an
+ * SQLite database that doesn't exist yet, for which fs.ErrNotExist is
+ * returned.
+ */
+func openDatabaseReadOnly() error {
+	var err error
+	switch config.DB.Type {
+	case "postgres":
+		store, err = openPostgres(config.DB.Conn)
+	case "sqlite":
+		store, err = openSQLiteReadOnly(config.DB.Conn)
+	default:
+		return wrapAny(errUnknownDatabaseType, config.DB.Type)
 	}
-
-	return nil
+	return err
 }
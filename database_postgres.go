@@ -0,0 +1,173 @@
+/*
+ * PostgreSQL backend
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+/*
+ * Queries go through database/sql like for SQLite, on top of a pgx pool
+ * that is kept around for what only PostgreSQL can do.
+ */
+type pgStoreT struct {
+	sqlStoreT
+	pool *pgxpool.Pool
+}
+
+/* Arbitrary, but must not be used by anything else sharing the database */
+const migrationLockID int64 = 0x636361 /* "cca" */
+
+func openPostgres(conn string) (*pgStoreT, error) {
+	// Parse the connection string into a Config object
+	poolConfig, err := pgxpool.ParseConfig(conn)
+	if err != nil {
+		return nil, fmt.Errorf("parse database config: %w", err)
+	}
+
+	// Configure the connection pool for high concurrency
+	poolConfig.MaxConns = 500                       // Maximum number of connections in the pool
+	poolConfig.MinConns = 10                        // Minimum idle connections to maintain
+	poolConfig.MaxConnLifetime = 5 * time.Hour      // Maximum lifetime of a connection
+	poolConfig.MaxConnIdleTime = 30 * time.Minute   // Maximum idle time before recycling
+	poolConfig.HealthCheckPeriod = 40 * time.Second // How often to check connection health
+
+	// Connection acquisition timeout and cancellation
+	poolConfig.ConnConfig.ConnectTimeout = 5 * time.Second
+
+	// Create the connection pool with our optimized settings
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+
+	// Verify the connection works
+	if err := pool.Ping(context.Background()); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("ping database: %w", err)
+	}
+
+	return &pgStoreT{
+		sqlStoreT: sqlStoreT{db: stdlib.OpenDBFromPool(pool), dialect: pgDialectT{}},
+		pool:      pool,
+	}, nil
+}
+
+func (s *pgStoreT) close() {
+	s.db.Close()
+	s.pool.Close()
+}
+
+type pgDialectT struct{}
+
+func (pgDialectT) migrationsDir() string {
+	return "sql/migrations/postgres"
+}
+
+/*
+ * A session-level advisory lock keeps several instances starting at once
+ * from racing each other.
+ */
+func (pgDialectT) lockMigrations(ctx context.Context, conn *sql.Conn) (func() error, error) {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 102"), err)
+	}
+	return func() error {
+		_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 103"), err)
+		}
+		return nil
+	}, nil
+}
+
+func (pgDialectT) tableExists(ctx context.Context, conn *sql.Conn, table string) (bool, error) {
+	var exists bool
+	err := conn.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists)
+	return exists, err
+}
+
+func (pgDialectT) jsonText(column string) string {
+	return column + "::text"
+}
+
+func (pgDialectT) ilike(expr, pattern string) string {
+	return expr + " ILIKE " + pattern + ` ESCAPE '\'`
+}
+
+func (pgDialectT) studentIDOfEmail(column string) string {
+	id := "regexp_replace(split_part(" + column + ", '@', 1), '^[sS]', '')"
+	return "CASE WHEN " + id + " ~ '^[0-9]{1,18}$' THEN CAST(" + id + " AS BIGINT) END"
+}
+
+/* Delivered to every instance listening, once q commits */
+const pgCheckViolation = "23514"
+
+/*
+ * The trigger raises check_violation, which nothing else inserting into
+ * choices could, as the table has no check constraints
+ */
+func (pgDialectT) isCourseFull(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgCheckViolation
+}
+
+func (pgDialectT) notify(ctx context.Context, q sqlExecerT, msg string) error {
+	_, err := q.ExecContext(ctx, "SELECT pg_notify($1, $2)", clusterChannel, msg)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 146"), err)
+	}
+	return nil
+}
+
+/* Otherwise, each statement would see what was committed before it began */
+func (pgDialectT) snapshotTxOptions() *sql.TxOptions {
+	return &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+}
+
+/*
+ * Pass every notification to fn until the connection fails, calling
+ * onConnect once listening so that whatever was missed could be caught up
+ * on. The connection is closed rather than returned to the pool, as it
+ * would keep listening there.
+ */
+func (s *pgStoreT) listen(ctx context.Context, onConnect func() error, fn func(msg string)) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 147"), err)
+	}
+	defer func() {
+		conn.Conn().Close(context.Background())
+		conn.Release()
+	}()
+
+	_, err = conn.Exec(ctx, "LISTEN "+clusterChannel)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 148"), err)
+	}
+	err = onConnect()
+	if err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 149"), err)
+		}
+		fn(notification.Payload)
+	}
+}
@@ -0,0 +1,2335 @@
+/*
+ * SQL shared by the database backends
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Queries are written for PostgreSQL, using $1, $2, ... for parameters,
+ * and kept to what SQLite understands too. The few expressions that have
+ * to be spelt differently come from the dialect.
+ */
+type sqlDialectT interface {
+	migrationsDir() string
+	/* Take the migration lock on conn, returning how to release it */
+	lockMigrations(ctx context.Context, conn *sql.Conn) (func() error, error)
+	tableExists(ctx context.Context, conn *sql.Conn, table string) (bool, error)
+	/* The text of a JSON column */
+	jsonText(column string) string
+	/* Case-insensitive LIKE, escaped with backslashes */
+	ilike(expr, pattern string) string
+	/*
+	 * The student ID in the local part of an email address as an integer,
+	 * like studentIDFromEmail and strconv.ParseInt, or NULL if it isn't one
+	 */
+	studentIDOfEmail(column string) string
+	/*
+	 * Whether err was raised by the choices_count trigger, when a choice
+	 * would take a course beyond its capacity
+	 */
+	isCourseFull(err error) bool
+	/* Tell other instances, when q commits if it is a transaction */
+	notify(ctx context.Context, q sqlExecerT, msg string) error
+	/* Options for a transaction that sees every table as of one moment */
+	snapshotTxOptions() *sql.TxOptions
+}
+
+type sqlStoreT struct {
+	db      *sql.DB
+	dialect sqlDialectT
+}
+
+/* Satisfied by both the database and transactions */
+type sqlExecerT interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *sqlStoreT) close() {
+	s.db.Close()
+}
+
+/* Terms */
+
+/* Every term along with how much it holds, oldest first */
+func (s *sqlStoreT) getTerms(ctx context.Context) ([]termT, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT t.id, t.name, t.created, (SELECT COUNT(*) FROM courses WHERE term = t.id), (SELECT COUNT(*) FROM expected_students WHERE term = t.id), (SELECT COUNT(*) FROM choices c JOIN courses co ON co.id = c.courseid WHERE co.term = t.id) FROM terms t ORDER BY t.id",
+	)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 114"), err)
+	}
+	defer rows.Close()
+
+	var result []termT
+	for rows.Next() {
+		var term termT
+		var created int64
+		err := rows.Scan(&term.ID, &term.Name, &created, &term.Courses, &term.Students, &term.Choices)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 115"), err)
+		}
+		term.Created = time.Unix(created, 0)
+		result = append(result, term)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 116"), err)
+	}
+	return result, nil
+}
+
+func (s *sqlStoreT) getActiveTerm(ctx context.Context) (int64, error) {
+	var term int64
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT value FROM misc WHERE key = 'active_term'",
+	).Scan(&term)
+	if err != nil {
+		return 0, wrapError(errors.New("unexpected database error 117"), err)
+	}
+	return term, nil
+}
+
+/*
+ * Create a term and return its ID, copying the courses of another term
+ * unless copyFrom is 0. Neither choices nor pre-selections are copied, so
+ * none of the copies are forced.
+ */
+func (s *sqlStoreT) createTerm(
+	ctx context.Context,
+	actor string,
+	ip string,
+	name string,
+	copyFrom int64,
+) (retTerm int64, retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, wrapError(errors.New("unexpected database error 118"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 119"), err)
+			return
+		}
+	}()
+
+	var term int64
+	err = tx.QueryRowContext(
+		ctx,
+		"INSERT INTO terms (name, created) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING RETURNING id",
+		name,
+		time.Now().Unix(),
+	).Scan(&term)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, wrapAny(errTermExists, name)
+		}
+		return 0, wrapError(errors.New("unexpected database error 120"), err)
+	}
+
+	if copyFrom != 0 {
+		err = checkTermExists(ctx, tx, copyFrom)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO courses (term, nmax, title, teacher, location, ctype, cgroup, course_id, section_id, year_groups, forced, legal_sex_requirements) SELECT $1, nmax, title, teacher, location, ctype, cgroup, course_id, section_id, year_groups, false, legal_sex_requirements FROM courses WHERE term = $2 ORDER BY id",
+			term,
+			copyFrom,
+		)
+		if err != nil {
+			return 0, wrapError(errors.New("unexpected database error 121"), err)
+		}
+	}
+
+	err = insertAudit(
+		ctx,
+		tx,
+		actor,
+		ip,
+		auditCreateTerm,
+		name,
+		nil,
+		auditTermT{ID: term, Name: name, CopyFrom: copyFrom},
+	)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, wrapError(errors.New("unexpected database error 122"), err)
+	}
+	return term, nil
+}
+
+func (s *sqlStoreT) setActiveTerm(ctx context.Context, actor, ip string, term int64) (retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 123"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 124"), err)
+			return
+		}
+	}()
+
+	err = checkTermExists(ctx, tx, term)
+	if err != nil {
+		return err
+	}
+	var oldTerm int64
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT value FROM misc WHERE key = 'active_term'",
+	).Scan(&oldTerm)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 125"), err)
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE misc SET value = $1 WHERE key = 'active_term'",
+		term,
+	)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 126"), err)
+	}
+	err = insertAudit(
+		ctx,
+		tx,
+		actor,
+		ip,
+		auditSetTerm,
+		"active_term",
+		auditActiveTermT{oldTerm},
+		auditActiveTermT{term},
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 127"), err)
+	}
+	return nil
+}
+
+func checkTermExists(ctx context.Context, q sqlExecerT, term int64) error {
+	var exists bool
+	err := q.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM terms WHERE id = $1)",
+		term,
+	).Scan(&exists)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 128"), err)
+	}
+	if !exists {
+		return wrapAny(errNoSuchTerm, term)
+	}
+	return nil
+}
+
+/* Users and sessions */
+
+func (s *sqlStoreT) getUserBySession(ctx context.Context, session string) (userT, error) {
+	var user userT
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT id, name, department, email, COALESCE(legal_sex, '') FROM users WHERE session = $1",
+		session,
+	).Scan(&user.ID, &user.Name, &user.Department, &user.Email, &user.LegalSex)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return user, errNoSuchUser
+		}
+		return user, wrapError(errors.New("unexpected database error 29"), err)
+	}
+	return user, nil
+}
+
+/*
+ * Create or update a user as they log in. An empty legal sex leaves the
+ * stored one alone.
+ */
+func (s *sqlStoreT) upsertUser(ctx context.Context, user userT, session string, expr int64) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO users (id, name, email, department, session, expr, legal_sex) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, '')) ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, email = EXCLUDED.email, department = EXCLUDED.department, session = EXCLUDED.session, expr = EXCLUDED.expr, legal_sex = COALESCE(EXCLUDED.legal_sex, users.legal_sex)",
+		user.ID,
+		user.Name,
+		user.Email,
+		user.Department,
+		session,
+		expr,
+		user.LegalSex,
+	)
+	if err != nil {
+		return fmt.Errorf("upsert user: %w", err)
+	}
+	return nil
+}
+
+/* Every user, ordered by email address */
+func (s *sqlStoreT) getUsers(ctx context.Context, term int64) ([]userT, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT id, name, email, department, COALESCE(legal_sex, ''), EXISTS (SELECT 1 FROM confirmations cf WHERE cf.userid = users.id AND cf.term = $1) FROM users ORDER BY email",
+		term,
+	)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 64"), err)
+	}
+	defer rows.Close()
+
+	var result []userT
+	for rows.Next() {
+		var user userT
+		err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Department, &user.LegalSex, &user.Confirmed)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 65"), err)
+		}
+		result = append(result, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 66"), err)
+	}
+	return result, nil
+}
+
+func (s *sqlStoreT) getConfirmed(ctx context.Context, term int64, userID string) (bool, error) {
+	var confirmed bool
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM confirmations WHERE term = $1 AND userid = $2)",
+		term,
+		userID,
+	).Scan(&confirmed)
+	if err != nil {
+		return false, fmt.Errorf("get confirmed status: %w", err)
+	}
+	return confirmed, nil
+}
+
+/*
+ * Set whether a user has confirmed their choices, recording the change in
+ * the choice history and the audit log if it is one.
+ */
+func (s *sqlStoreT) setConfirmed(
+	ctx context.Context,
+	term int64,
+	userID string,
+	ip string,
+	confirmed bool,
+) (retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 98"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 99"), err)
+			return
+		}
+	}()
+
+	query := "DELETE FROM confirmations WHERE term = $1 AND userid = $2"
+	if confirmed {
+		query = "INSERT INTO confirmations (term, userid) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	}
+	result, err := tx.ExecContext(ctx, query, term, userID)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 40"), err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 40"), err)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	action := auditUnconfirm
+	if confirmed {
+		action = auditConfirm
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO choice_events (term, userid, kind, time) VALUES ($1, $2, $3, $4)",
+		term,
+		userID,
+		action,
+		time.Now().UnixMicro(),
+	)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 44"), err)
+	}
+	err = insertAudit(
+		ctx,
+		tx,
+		userID,
+		ip,
+		action,
+		userID,
+		auditConfirmedT{!confirmed},
+		auditConfirmedT{confirmed},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 100"), err)
+	}
+	return nil
+}
+
+/* Students who have logged in but haven't confirmed their choices */
+func (s *sqlStoreT) getUnconfirmedStudents(ctx context.Context, term int64) ([]studentRowT, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT name, email, department FROM users WHERE department <> $1 AND NOT EXISTS (SELECT 1 FROM confirmations cf WHERE cf.userid = users.id AND cf.term = $2) ORDER BY department, name",
+		staffDepartment,
+		term,
+	)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 58"), err)
+	}
+	defer rows.Close()
+
+	var result []studentRowT
+	for rows.Next() {
+		var row studentRowT
+		var email string
+		err := rows.Scan(&row.Name, &email, &row.Department)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 59"), err)
+		}
+		row.StudentID = studentIDFromEmail(email)
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 60"), err)
+	}
+	return result, nil
+}
+
+/* Chosen and Confirmed are in the given term */
+func (s *sqlStoreT) getYearGroupCounts(ctx context.Context, term int64) (map[string]yearGroupCountsT, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT u.department, COUNT(DISTINCT u.id), COUNT(DISTINCT c.userid), COUNT(DISTINCT cf.userid) FROM users u LEFT JOIN (SELECT ch.userid FROM choices ch JOIN courses co ON co.id = ch.courseid WHERE co.term = $2) c ON c.userid = u.id LEFT JOIN confirmations cf ON cf.userid = u.id AND cf.term = $2 WHERE u.department <> $1 GROUP BY u.department",
+		staffDepartment,
+		term,
+	)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 86"), err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]yearGroupCountsT)
+	for rows.Next() {
+		var department string
+		var c yearGroupCountsT
+		err := rows.Scan(&department, &c.Total, &c.Chosen, &c.Confirmed)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 87"), err)
+		}
+		counts[department] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 88"), err)
+	}
+	return counts, nil
+}
+
+/* Courses */
+
+/* Every course of a term by ID, with Selected as stored */
+func (s *sqlStoreT) getCourses(ctx context.Context, term int64) ([]*courseT, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT id, nmax, title, ctype, cgroup, teacher, location, course_id, section_id, year_groups, forced, COALESCE(legal_sex_requirements, ''), selected FROM courses WHERE term = $1 ORDER BY id",
+		term,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get courses from database: %w", err)
+	}
+	defer rows.Close()
+
+	var result []*courseT
+	for rows.Next() {
+		course := &courseT{} //exhaustruct:ignore
+		err := rows.Scan(
+			&course.ID,
+			&course.Max,
+			&course.Title,
+			&course.Type,
+			&course.Group,
+			&course.Teacher,
+			&course.Location,
+			&course.CourseID,
+			&course.SectionID,
+			&course.YearGroups,
+			&course.Forced,
+			&course.LegalSexReq,
+			&course.Selected,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("scan course: %w", err)
+		}
+		result = append(result, course)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read next course: %w", err)
+	}
+	return result, nil
+}
+
+/*
+ * Replace every course of a term, which also clears every choice and its
+ * history and unconfirms everyone in that term.
+ */
+func (s *sqlStoreT) replaceCourses(
+	ctx context.Context,
+	term int64,
+	actor string,
+	ip string,
+	upload auditUploadT,
+	courses []*courseT,
+) (retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 9"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 10"), err)
+			return
+		}
+	}()
+
+	upload.Term = term
+	rowsBefore, err := countRows(ctx, tx, "courses", term)
+	if err != nil {
+		return err
+	}
+	snapshot, err := recordUploadSnapshot(ctx, tx, term, actor, "courses")
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM choices WHERE courseid IN (SELECT id FROM courses WHERE term = $1)", term)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 11"), err)
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM choice_events WHERE term = $1", term)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 77"), err)
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM confirmations WHERE term = $1", term)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 12"), err)
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM courses WHERE term = $1", term)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 13"), err)
+	}
+
+	for _, course := range courses {
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO courses(term, nmax, title, teacher, location, ctype, cgroup, section_id, course_id, legal_sex_requirements, year_groups, forced) VALUES ($11, $1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, false)",
+			course.Max,
+			course.Title,
+			course.Teacher,
+			course.Location,
+			course.Type,
+			course.Group,
+			course.SectionID,
+			course.CourseID,
+			course.LegalSexReq,
+			course.YearGroups,
+			term,
+		)
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 14"), err)
+		}
+	}
+
+	err = insertAudit(
+		ctx,
+		tx,
+		actor,
+		ip,
+		auditUpload,
+		"courses",
+		auditUploadT{Rows: rowsBefore, Term: term, Snapshot: snapshot}, //exhaustruct:ignore
+		upload,
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 15"), err)
+	}
+	return nil
+}
+
+/* Choices */
+
+/* IDs of the courses a user has chosen in a term, in ascending order */
+func (s *sqlStoreT) getUserChoices(ctx context.Context, term int64, userID string) ([]int, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT c.courseid FROM choices c JOIN courses co ON co.id = c.courseid WHERE c.userid = $1 AND co.term = $2 ORDER BY c.courseid",
+		userID,
+		term,
+	)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 73"), err)
+	}
+	defer rows.Close()
+
+	var result []int
+	for rows.Next() {
+		var courseID int
+		err := rows.Scan(&courseID)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 74"), err)
+		}
+		result = append(result, courseID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 75"), err)
+	}
+	return result, nil
+}
+
+/*
+ * Insert a choice, recording it in the choice history and the audit log,
+ * unless the course is already full. Attempts refused for that are still
+ * recorded in the choice history as "full", so that demand beyond
+ * capacity shows up in analytics.
+ */
+func (s *sqlStoreT) insertChoice(
+	ctx context.Context,
+	term int64,
+	userID string,
+	ip string,
+	courseID int,
+) (retResult insertChoiceResultT, retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return choiceFull, wrapError(errors.New("unexpected database error 34"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 35"), err)
+			return
+		}
+	}()
+
+	/*
+	 * The seat is taken and checked against capacity by the choices_count
+	 * trigger, where concurrent choices of a course wait for each other.
+	 */
+	now := time.Now().UnixMicro()
+	result, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO choices (seltime, userid, courseid, forced) VALUES ($1, $2, $3, false) ON CONFLICT DO NOTHING",
+		now,
+		userID,
+		courseID,
+	)
+	if err != nil {
+		if s.dialect.isCourseFull(err) {
+			/* The attempt must outlive the transaction */
+			err = tx.Rollback()
+			if err != nil {
+				return choiceFull, wrapError(errors.New("unexpected database error 180"), err)
+			}
+			_, err = s.db.ExecContext(
+				ctx,
+				"INSERT INTO choice_events (term, userid, courseid, kind, time) VALUES ($4, $1, $2, 'full', $3)",
+				userID,
+				courseID,
+				now,
+				term,
+			)
+			if err != nil {
+				return choiceFull, wrapError(errors.New("unexpected database error 181"), err)
+			}
+			return choiceFull, nil
+		}
+		return choiceFull, wrapError(errors.New("unexpected database error 37"), err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return choiceFull, wrapError(errors.New("unexpected database error 36"), err)
+	}
+	if n == 0 {
+		return choiceAlreadyChosen, nil
+	}
+	err = s.dialect.notify(ctx, tx, clusterMessage(clusterCount, strconv.Itoa(courseID), "1"))
+	if err != nil {
+		return choiceFull, err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO choice_events (term, userid, courseid, kind, time) VALUES ($4, $1, $2, 'choose', $3)",
+		userID,
+		courseID,
+		now,
+		term,
+	)
+	if err != nil {
+		return choiceFull, wrapError(errors.New("unexpected database error 78"), err)
+	}
+	err = insertAudit(
+		ctx,
+		tx,
+		userID,
+		ip,
+		auditChoose,
+		userID,
+		nil,
+		auditChoiceT{CourseID: courseID, Forced: false, SelTime: now},
+	)
+	if err != nil {
+		return choiceFull, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return choiceFull, wrapError(errors.New("unexpected database error 38"), err)
+	}
+	return choiceInserted, nil
+}
+
+/*
+ * Delete a choice, recording it in the choice history and the audit log.
+ * Returns whether there was such a choice.
+ */
+func (s *sqlStoreT) deleteChoice(
+	ctx context.Context,
+	term int64,
+	userID string,
+	ip string,
+	courseID int,
+) (retFound bool, retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, wrapError(errors.New("unexpected database error 94"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 95"), err)
+			return
+		}
+	}()
+
+	var unchosen auditChoiceT
+	err = tx.QueryRowContext(
+		ctx,
+		"DELETE FROM choices WHERE userid = $1 AND courseid = $2 RETURNING courseid, forced, seltime",
+		userID,
+		courseID,
+	).Scan(&unchosen.CourseID, &unchosen.Forced, &unchosen.SelTime)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, wrapError(errors.New("unexpected database error 43"), err)
+	}
+	err = s.dialect.notify(ctx, tx, clusterMessage(clusterCount, strconv.Itoa(courseID), "-1"))
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO choice_events (term, userid, courseid, kind, time) VALUES ($1, $2, $3, 'unchoose', $4)",
+		term,
+		userID,
+		courseID,
+		time.Now().UnixMicro(),
+	)
+	if err != nil {
+		return false, wrapError(errors.New("unexpected database error 96"), err)
+	}
+	err = insertAudit(ctx, tx, userID, ip, auditUnchoose, userID, unchosen, nil)
+	if err != nil {
+		return false, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, wrapError(errors.New("unexpected database error 97"), err)
+	}
+	return true, nil
+}
+
+/*
+ * Every choice in a term along with its student, ordered by course and
+ * selection time
+ */
+func (s *sqlStoreT) getChoiceRows(ctx context.Context, term int64) ([]choiceRowT, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT u.id, u.name, u.email, u.department, c.courseid, c.forced, c.seltime FROM choices c JOIN users u ON u.id = c.userid JOIN courses co ON co.id = c.courseid WHERE co.term = $1 ORDER BY c.courseid, c.seltime, u.name",
+		term,
+	)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 55"), err)
+	}
+	defer rows.Close()
+
+	var result []choiceRowT
+	for rows.Next() {
+		var row choiceRowT
+		var email string
+		var seltime int64
+		err := rows.Scan(
+			&row.UserID,
+			&row.Name,
+			&email,
+			&row.Department,
+			&row.CourseID,
+			&row.Forced,
+			&seltime,
+		)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 56"), err)
+		}
+		row.StudentID = studentIDFromEmail(email)
+		row.SelTime = time.UnixMicro(seltime)
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 57"), err)
+	}
+	return result, nil
+}
+
+/* Number of choices of each course in a term, including courses with none */
+func (s *sqlStoreT) getChoiceCounts(ctx context.Context, term int64) (map[int]uint32, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT co.id, COUNT(c.courseid) FROM courses co LEFT JOIN choices c ON c.courseid = co.id WHERE co.term = $1 GROUP BY co.id",
+		term,
+	)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 129"), err)
+	}
+	defer rows.Close()
+
+	result := make(map[int]uint32)
+	for rows.Next() {
+		var courseID int
+		var count uint32
+		err := rows.Scan(&courseID, &count)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 130"), err)
+		}
+		result[courseID] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 131"), err)
+	}
+	return result, nil
+}
+
+/*
+ * Set the stored member count of a course to the number of its choices,
+ * returning that number.
+ */
+func (s *sqlStoreT) repairSelected(ctx context.Context, actor, ip string, courseID int) (retCount uint32, retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, wrapError(errors.New("unexpected database error 140"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 141"), err)
+			return
+		}
+	}()
+
+	/* Lock the course first so that choices being made wait for us */
+	var before uint32
+	err = tx.QueryRowContext(
+		ctx,
+		"UPDATE courses SET selected = selected WHERE id = $1 RETURNING selected",
+		courseID,
+	).Scan(&before)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, wrapAny(errNoSuchCourse, courseID)
+		}
+		return 0, wrapError(errors.New("unexpected database error 142"), err)
+	}
+	var count uint32
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM choices WHERE courseid = $1", courseID).Scan(&count)
+	if err != nil {
+		return 0, wrapError(errors.New("unexpected database error 143"), err)
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE courses SET selected = $2 WHERE id = $1", courseID, count)
+	if err != nil {
+		return 0, wrapError(errors.New("unexpected database error 144"), err)
+	}
+	err = insertAudit(
+		ctx,
+		tx,
+		actor,
+		ip,
+		auditRepairCount,
+		strconv.Itoa(courseID),
+		auditSelectedT{before},
+		auditSelectedT{count},
+	)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, wrapError(errors.New("unexpected database error 145"), err)
+	}
+	return count, nil
+}
+
+/* Choices in a term of users that still exist, in the order they were made */
+func (s *sqlStoreT) getTimedChoices(ctx context.Context, term int64) ([]timedChoiceT, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT c.userid, c.courseid, c.seltime, u.department FROM choices c JOIN users u ON u.id = c.userid JOIN courses co ON co.id = c.courseid WHERE co.term = $1 ORDER BY c.seltime",
+		term,
+	)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 79"), err)
+	}
+	defer rows.Close()
+
+	var result []timedChoiceT
+	for rows.Next() {
+		var c timedChoiceT
+		var seltime int64
+		err := rows.Scan(&c.UserID, &c.CourseID, &seltime, &c.Department)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 80"), err)
+		}
+		c.SelTime = time.UnixMicro(seltime)
+		result = append(result, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 81"), err)
+	}
+	return result, nil
+}
+
+/* The choice history of a term, oldest first */
+func (s *sqlStoreT) getChoiceEvents(ctx context.Context, term int64) ([]choiceEventT, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT userid, courseid, kind, time FROM choice_events WHERE term = $1 ORDER BY time, id",
+		term,
+	)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 82"), err)
+	}
+	defer rows.Close()
+
+	var result []choiceEventT
+	for rows.Next() {
+		var event choiceEventT
+		var t int64
+		err := rows.Scan(&event.UserID, &event.CourseID, &event.Kind, &t)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 83"), err)
+		}
+		event.Time = time.UnixMicro(t)
+		result = append(result, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 84"), err)
+	}
+	return result, nil
+}
+
+/*
+ * Call fn on every choice matching the filter, ordered by year group and
+ * student name, and return the choices with dangling references. Those
+ * referring to courses that no longer exist can't be told apart by term.
+ */
+func (s *sqlStoreT) streamChoices(
+	ctx context.Context,
+	filter exportFilterT,
+	fn func(c *exportChoiceT) error,
+) ([]danglingChoiceT, error) {
+	var args sqlArgsT
+	term := args.add(filter.Term)
+	conds := []string{"(co.term = " + term + " OR co.id IS NULL)"}
+	conds = append(conds, filter.userConditions(&args)...)
+	conds = append(conds, filter.choiceConditions(&args)...)
+	query := "SELECT c.userid, c.courseid, c.forced, c.seltime, u.name, u.email, u.department, EXISTS (SELECT 1 FROM confirmations cf WHERE cf.userid = c.userid AND cf.term = " + term + "), co.title, co.teacher, co.location, co.ctype, co.cgroup, co.section_id, co.course_id FROM choices c LEFT JOIN users u ON u.id = c.userid LEFT JOIN courses co ON co.id = c.courseid WHERE " +
+		strings.Join(conds, " AND ") +
+		" ORDER BY u.department, u.name, c.courseid"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 67"), err)
+	}
+	defer rows.Close()
+
+	var dangling []danglingChoiceT
+	for rows.Next() {
+		var c exportChoiceT
+		var seltime int64
+		var name, email, userDepartment *string
+		var confirmed *bool
+		var title, teacher, location, courseType, group, sectionID, courseCode *string
+		err := rows.Scan(
+			&c.UserID,
+			&c.CourseID,
+			&c.Forced,
+			&seltime,
+			&name,
+			&email,
+			&userDepartment,
+			&confirmed,
+			&title,
+			&teacher,
+			&location,
+			&courseType,
+			&group,
+			&sectionID,
+			&courseCode,
+		)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 68"), err)
+		}
+		if name == nil {
+			dangling = append(dangling, danglingChoiceT{c.UserID, c.CourseID, "no such user"})
+			continue
+		}
+		if title == nil {
+			dangling = append(dangling, danglingChoiceT{c.UserID, c.CourseID, "no such course"})
+			continue
+		}
+		c.SelTime = time.UnixMicro(seltime)
+		c.Name, c.Email, c.Department, c.Confirmed = *name, *email, *userDepartment, *confirmed
+		c.Title, c.Teacher, c.Location = *title, *teacher, *location
+		c.Type, c.Group, c.SectionID, c.CourseCode = *courseType, *group, *sectionID, *courseCode
+		err = fn(&c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 69"), err)
+	}
+	return dangling, nil
+}
+
+/*
+ * Students who have logged in are matched with expected students by the
+ * numeric part of their email addresses, so that those who have never
+ * logged in could be listed too, after everyone else. Students who have
+ * never logged in are left out if any filter is given.
+ */
+func (s *sqlStoreT) streamStudents(
+	ctx context.Context,
+	filter exportFilterT,
+	fn func(student *exportStudentT) error,
+) error {
+	var args sqlArgsT
+	term := args.add(filter.Term)
+	conds := []string{"u.department IS DISTINCT FROM " + args.add(staffDepartment)}
+	userConds := filter.userConditions(&args)
+	choiceConds := filter.choiceConditions(&args)
+	if len(userConds) != 0 || len(choiceConds) != 0 {
+		conds = append(conds, "u.id IS NOT NULL")
+	}
+	conds = append(conds, userConds...)
+	if len(choiceConds) != 0 {
+		conds = append(conds, "EXISTS (SELECT 1 FROM choices c JOIN courses co ON co.id = c.courseid WHERE c.userid = u.id AND co.term = "+term+" AND "+
+			strings.Join(choiceConds, " AND ")+")")
+	}
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT u.name, u.email, u.department, CASE WHEN u.id IS NULL THEN NULL ELSE EXISTS (SELECT 1 FROM confirmations cf WHERE cf.userid = u.id AND cf.term = "+term+") END, e.id, e.name FROM users u FULL OUTER JOIN (SELECT id, name FROM expected_students WHERE term = "+term+") e ON e.id = "+
+			s.dialect.studentIDOfEmail("u.email")+" WHERE "+
+			strings.Join(conds, " AND ")+
+			" ORDER BY u.id IS NULL, u.department, u.name, e.id",
+		args...,
+	)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 6"), err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var student exportStudentT
+		err := rows.Scan(
+			&student.Name,
+			&student.Email,
+			&student.Department,
+			&student.Confirmed,
+			&student.ExpectedID,
+			&student.ExpectedName,
+		)
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 8"), err)
+		}
+		err = fn(&student)
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return wrapError(errors.New("unexpected database error 7"), err)
+	}
+	return nil
+}
+
+/* States and schedules */
+
+/* Load the state and schedule of a year group, creating them if absent */
+func (s *sqlStoreT) loadState(ctx context.Context, yeargroup string) (uint32, time.Time, error) {
+	var state uint32
+	var schedule time.Time
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT state, schedule FROM states WHERE yeargroup = $1",
+		yeargroup,
+	).Scan(&state, &schedule)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, schedule, wrapError(errors.New("unexpected database error 31"), err)
+		}
+		_, err := s.db.ExecContext(
+			ctx,
+			"INSERT INTO states(yeargroup, state, schedule) VALUES ($1, $2, $3)",
+			yeargroup,
+			state,
+			schedule,
+		)
+		if err != nil {
+			return 0, schedule, wrapError(errors.New("unexpected database error 30"), err)
+		}
+	}
+	return state, schedule, nil
+}
+
+/*
+ * Change the state of a year group if it is still oldState, returning
+ * whether it was, as another instance could have changed it in the meantime.
+ */
+func (s *sqlStoreT) saveState(ctx context.Context, yeargroup string, oldState, newState uint32) (bool, error) {
+	result, err := s.db.ExecContext(
+		ctx,
+		"UPDATE states SET state = $3 WHERE yeargroup = $1 AND state = $2",
+		yeargroup,
+		oldState,
+		newState,
+	)
+	if err != nil {
+		return false, wrapError(errors.New("unexpected database error 32"), err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, wrapError(errors.New("unexpected database error 139"), err)
+	}
+	return n != 0, nil
+}
+
+func (s *sqlStoreT) saveSchedule(ctx context.Context, yeargroup string, schedule time.Time) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		"UPDATE states SET schedule = $2 WHERE yeargroup = $1",
+		yeargroup,
+		schedule,
+	)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 33"), err)
+	}
+	return nil
+}
+
+/* Expected students and pre-selections */
+
+/* Expected students of a term, ordered by ID */
+func (s *sqlStoreT) getExpectedStudents(ctx context.Context, term int64) ([]expectedStudentT, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT id, name, legal_sex FROM expected_students WHERE term = $1 ORDER BY id",
+		term,
+	)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 61"), err)
+	}
+	defer rows.Close()
+
+	var result []expectedStudentT
+	for rows.Next() {
+		var student expectedStudentT
+		err := rows.Scan(&student.ID, &student.Name, &student.LegalSex)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 62"), err)
+		}
+		result = append(result, student)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 63"), err)
+	}
+	return result, nil
+}
+
+func (s *sqlStoreT) countExpectedStudents(ctx context.Context, term int64) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM expected_students WHERE term = $1", term).Scan(&n)
+	if err != nil {
+		return 0, wrapError(errors.New("unexpected database error 85"), err)
+	}
+	return n, nil
+}
+
+/* Empty if the student isn't expected in the term */
+func (s *sqlStoreT) getExpectedLegalSex(ctx context.Context, term int64, studentID string) (string, error) {
+	var legalSex string
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT legal_sex FROM expected_students WHERE term = $1 AND id = $2",
+		term,
+		studentID,
+	).Scan(&legalSex)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("get expected legal sex: %w", err)
+	}
+	return legalSex, nil
+}
+
+func (s *sqlStoreT) replaceExpectedStudents(
+	ctx context.Context,
+	term int64,
+	actor string,
+	ip string,
+	upload auditUploadT,
+	students []expectedStudentT,
+) (retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 21"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 22"), err)
+			return
+		}
+	}()
+
+	upload.Term = term
+	rowsBefore, err := countRows(ctx, tx, "expected_students", term)
+	if err != nil {
+		return err
+	}
+	snapshot, err := recordUploadSnapshot(ctx, tx, term, actor, "expected_students")
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM expected_students WHERE term = $1", term)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 23"), err)
+	}
+	for _, student := range students {
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO expected_students(term, name, id, legal_sex) VALUES ($1, $2, $3, $4)",
+			term,
+			student.Name,
+			student.ID,
+			student.LegalSex,
+		)
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 24"), err)
+		}
+	}
+
+	err = insertAudit(
+		ctx,
+		tx,
+		actor,
+		ip,
+		auditUpload,
+		"expected_students",
+		auditUploadT{Rows: rowsBefore, Term: term, Snapshot: snapshot}, //exhaustruct:ignore
+		upload,
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 25"), err)
+	}
+	return nil
+}
+
+/* Replace every pre-selection of a term, marking their courses as forced */
+func (s *sqlStoreT) replacePreSelections(
+	ctx context.Context,
+	term int64,
+	actor string,
+	ip string,
+	upload auditUploadT,
+	preSelections []preSelectionT,
+) (retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 16"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 17"), err)
+			return
+		}
+	}()
+
+	upload.Term = term
+	rowsBefore, err := countRows(ctx, tx, "pre_selected", term)
+	if err != nil {
+		return err
+	}
+	snapshot, err := recordUploadSnapshot(ctx, tx, term, actor, "pre_selected")
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM pre_selected WHERE term = $1", term)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 18"), err)
+	}
+	for _, preSelection := range preSelections {
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO pre_selected(term, student_id, course_id) VALUES ($1, $2, $3)",
+			term,
+			preSelection.StudentID,
+			preSelection.CourseID,
+		)
+		if err != nil {
+			return fmt.Errorf(
+				"insert pre-selection of course %d for student %d: %w",
+				preSelection.CourseID,
+				preSelection.StudentID,
+				err,
+			)
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			"UPDATE courses SET forced = true WHERE id = $1",
+			preSelection.CourseID,
+		)
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 19"), err)
+		}
+	}
+
+	err = insertAudit(
+		ctx,
+		tx,
+		actor,
+		ip,
+		auditUpload,
+		"pre_selected",
+		auditUploadT{Rows: rowsBefore, Term: term, Snapshot: snapshot}, //exhaustruct:ignore
+		upload,
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 20"), err)
+	}
+	return nil
+}
+
+/*
+ * Give a student the choices pre-selected for them, returning the IDs of
+ * the courses that were not already chosen. Forced choices take seats even
+ * when their courses are full. They are recorded in the choice history and
+ * the audit log as made by the system, from the student's address.
+ */
+func (s *sqlStoreT) insertForcedChoices(
+	ctx context.Context,
+	term int64,
+	userID string,
+	studentID string,
+	ip string,
+	seltime time.Time,
+) (retResult []int, retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 135"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 136"), err)
+			return
+		}
+	}()
+
+	rows, err := tx.QueryContext(
+		ctx,
+		"INSERT INTO choices (userid, courseid, seltime, forced) SELECT $1, course_id, $3, true FROM pre_selected WHERE term = $4 AND student_id = $2 ON CONFLICT DO NOTHING RETURNING courseid",
+		userID,
+		studentID,
+		seltime.UnixMicro(),
+		term,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert pre_selected choices: %w", err)
+	}
+	defer rows.Close()
+
+	var result []int
+	for rows.Next() {
+		var courseID int
+		if err := rows.Scan(&courseID); err != nil {
+			return nil, fmt.Errorf("failed to scan course_id: %w", err)
+		}
+		result = append(result, courseID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over pre_selected rows: %w", err)
+	}
+	rows.Close()
+
+	for _, courseID := range result {
+		err = s.dialect.notify(ctx, tx, clusterMessage(clusterCount, strconv.Itoa(courseID), "1"))
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO choice_events (term, userid, courseid, kind, time) VALUES ($1, $2, $3, 'choose', $4)",
+			term,
+			userID,
+			courseID,
+			seltime.UnixMicro(),
+		)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 179"), err)
+		}
+		err = insertAudit(
+			ctx,
+			tx,
+			auditSystemActor,
+			ip,
+			auditChoose,
+			userID,
+			nil,
+			auditChoiceT{CourseID: courseID, Forced: true, SelTime: seltime.UnixMicro()},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 138"), err)
+	}
+	return result, nil
+}
+
+/* Backups and upload snapshots */
+
+/* Everything in a backup of a term, as of one moment */
+func (s *sqlStoreT) getBackup(ctx context.Context, term int64) (retBackup *backupT, retErr error) {
+	tx, err := s.db.BeginTx(ctx, s.dialect.snapshotTxOptions())
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 150"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 151"), err)
+			return
+		}
+	}()
+
+	b := newBackup()
+	err = tx.QueryRowContext(ctx, "SELECT name FROM terms WHERE id = $1", term).Scan(&b.TermName)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, wrapAny(errNoSuchTerm, term)
+		}
+		return nil, wrapError(errors.New("unexpected database error 152"), err)
+	}
+
+	err = backupCourses(ctx, tx, term, b)
+	if err != nil {
+		return nil, err
+	}
+	err = queryEach(ctx, tx, "users", func(rows *sql.Rows) error {
+		var user backupUserT
+		err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Department, &user.LegalSex)
+		b.Users = append(b.Users, user)
+		return err
+	}, "SELECT id, name, email, department, COALESCE(legal_sex, '') FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	err = backupExpectedStudents(ctx, tx, term, b)
+	if err != nil {
+		return nil, err
+	}
+	err = backupPreSelections(ctx, tx, term, b)
+	if err != nil {
+		return nil, err
+	}
+	err = queryEach(ctx, tx, "states", func(rows *sql.Rows) error {
+		var state backupStateT
+		err := rows.Scan(&state.YearGroup, &state.State, &state.Schedule)
+		b.States = append(b.States, state)
+		return err
+	}, "SELECT yeargroup, state, schedule FROM states ORDER BY yeargroup")
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 153"), err)
+	}
+	return b, nil
+}
+
+/* Call scan on every row of a query, with what naming the rows in errors */
+func queryEach(
+	ctx context.Context,
+	q sqlExecerT,
+	what string,
+	scan func(rows *sql.Rows) error,
+	query string,
+	args ...any,
+) error {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("back up %s: %w", what, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err := scan(rows)
+		if err != nil {
+			return fmt.Errorf("back up %s: %w", what, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("back up %s: %w", what, err)
+	}
+	return nil
+}
+
+/*
+ * The courses of a term, and the choices, choice history and confirmations
+ * that are replaced along with them
+ */
+func backupCourses(ctx context.Context, q sqlExecerT, term int64, b *backupT) error {
+	err := queryEach(ctx, q, "courses", func(rows *sql.Rows) error {
+		var course backupCourseT
+		err := rows.Scan(
+			&course.ID,
+			&course.Max,
+			&course.Title,
+			&course.Type,
+			&course.Group,
+			&course.Teacher,
+			&course.Location,
+			&course.CourseID,
+			&course.SectionID,
+			&course.YearGroups,
+			&course.Forced,
+			&course.LegalSexReq,
+		)
+		b.Courses = append(b.Courses, course)
+		return err
+	}, "SELECT id, nmax, title, ctype, cgroup, teacher, location, course_id, section_id, year_groups, forced, COALESCE(legal_sex_requirements, '') FROM courses WHERE term = $1 ORDER BY id", term)
+	if err != nil {
+		return err
+	}
+	err = queryEach(ctx, q, "choices", func(rows *sql.Rows) error {
+		var choice backupChoiceT
+		err := rows.Scan(&choice.UserID, &choice.CourseID, &choice.SelTime, &choice.Forced)
+		b.Choices = append(b.Choices, choice)
+		return err
+	}, "SELECT c.userid, c.courseid, c.seltime, c.forced FROM choices c JOIN courses co ON co.id = c.courseid WHERE co.term = $1 ORDER BY c.seltime, c.userid, c.courseid", term)
+	if err != nil {
+		return err
+	}
+	err = queryEach(ctx, q, "choice history", func(rows *sql.Rows) error {
+		var event backupChoiceEventT
+		err := rows.Scan(&event.UserID, &event.CourseID, &event.Kind, &event.Time)
+		b.ChoiceEvents = append(b.ChoiceEvents, event)
+		return err
+	}, "SELECT userid, courseid, kind, time FROM choice_events WHERE term = $1 ORDER BY id", term)
+	if err != nil {
+		return err
+	}
+	return queryEach(ctx, q, "confirmations", func(rows *sql.Rows) error {
+		var userID string
+		err := rows.Scan(&userID)
+		b.Confirmations = append(b.Confirmations, userID)
+		return err
+	}, "SELECT userid FROM confirmations WHERE term = $1 ORDER BY userid", term)
+}
+
+func backupExpectedStudents(ctx context.Context, q sqlExecerT, term int64, b *backupT) error {
+	return queryEach(ctx, q, "expected students", func(rows *sql.Rows) error {
+		var student backupExpectedStudentT
+		err := rows.Scan(&student.ID, &student.Name, &student.LegalSex)
+		b.ExpectedStudents = append(b.ExpectedStudents, student)
+		return err
+	}, "SELECT id, name, legal_sex FROM expected_students WHERE term = $1 ORDER BY id", term)
+}
+
+func backupPreSelections(ctx context.Context, q sqlExecerT, term int64, b *backupT) error {
+	return queryEach(ctx, q, "pre-selections", func(rows *sql.Rows) error {
+		var preSelection backupPreSelectionT
+		err := rows.Scan(&preSelection.StudentID, &preSelection.CourseID)
+		b.PreSelections = append(b.PreSelections, preSelection)
+		return err
+	}, "SELECT student_id, course_id FROM pre_selected WHERE term = $1 ORDER BY student_id, course_id", term)
+}
+
+/*
+ * Replace the data of a term with a backup, giving its courses new IDs,
+ * and set the schedules it holds, leaving states as they are. Users missing from the
+ * database are added back, while those present are left as they are.
+ * Uploads before the restore can't be reverted any more.
+ */
+func (s *sqlStoreT) restoreBackup(
+	ctx context.Context,
+	term int64,
+	actor string,
+	ip string,
+	upload auditUploadT,
+	b *backupT,
+) (retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 154"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 155"), err)
+			return
+		}
+	}()
+
+	var termName string
+	err = tx.QueryRowContext(ctx, "SELECT name FROM terms WHERE id = $1", term).Scan(&termName)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return wrapAny(errNoSuchTerm, term)
+		}
+		return wrapError(errors.New("unexpected database error 156"), err)
+	}
+	upload.Term = term
+	rowsBefore, err := countRows(ctx, tx, "courses", term)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM upload_snapshots WHERE term = $1", term)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 166"), err)
+	}
+	/* They refer to both courses and expected students */
+	_, err = tx.ExecContext(ctx, "DELETE FROM pre_selected WHERE term = $1", term)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 157"), err)
+	}
+
+	for _, user := range b.Users {
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO users (id, name, email, department, legal_sex) VALUES ($1, $2, $3, $4, NULLIF($5, '')) ON CONFLICT (id) DO NOTHING",
+			user.ID,
+			user.Name,
+			user.Email,
+			user.Department,
+			user.LegalSex,
+		)
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 158"), err)
+		}
+	}
+	err = restoreExpectedStudents(ctx, tx, term, b)
+	if err != nil {
+		return err
+	}
+	newIDs, err := restoreCourses(ctx, tx, term, b)
+	if err != nil {
+		return err
+	}
+	err = restorePreSelections(ctx, tx, term, b, newIDs)
+	if err != nil {
+		return err
+	}
+	for _, state := range b.States {
+		_, err = tx.ExecContext(
+			ctx,
+			"UPDATE states SET schedule = $2 WHERE yeargroup = $1",
+			state.YearGroup,
+			state.Schedule,
+		)
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 164"), err)
+		}
+	}
+
+	err = insertAudit(
+		ctx,
+		tx,
+		actor,
+		ip,
+		auditRestore,
+		termName,
+		auditUploadT{Rows: rowsBefore, Term: term}, //exhaustruct:ignore
+		upload,
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 165"), err)
+	}
+	return nil
+}
+
+/*
+ * Replace the courses of a term, and everything replaced along with them,
+ * with those in b, returning the new ID of each course by its ID in b. The
+ * pre-selections of the term must have been removed first.
+ */
+func restoreCourses(ctx context.Context, q sqlExecerT, term int64, b *backupT) (map[int]int, error) {
+	for _, query := range []string{
+		"DELETE FROM choices WHERE courseid IN (SELECT id FROM courses WHERE term = $1)",
+		"DELETE FROM choice_events WHERE term = $1",
+		"DELETE FROM confirmations WHERE term = $1",
+		"DELETE FROM courses WHERE term = $1",
+	} {
+		_, err := q.ExecContext(ctx, query, term)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 167"), err)
+		}
+	}
+
+	newIDs := make(map[int]int, len(b.Courses))
+	for _, course := range b.Courses {
+		var id int
+		err := q.QueryRowContext(
+			ctx,
+			"INSERT INTO courses(term, nmax, title, teacher, location, ctype, cgroup, section_id, course_id, legal_sex_requirements, year_groups, forced) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), $11, $12) RETURNING id",
+			term,
+			course.Max,
+			course.Title,
+			course.Teacher,
+			course.Location,
+			course.Type,
+			course.Group,
+			course.SectionID,
+			course.CourseID,
+			course.LegalSexReq,
+			course.YearGroups,
+			course.Forced,
+		).Scan(&id)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 159"), err)
+		}
+		newIDs[course.ID] = id
+	}
+
+	/*
+	 * Forced choices go last, as they may have taken courses beyond their
+	 * capacity, which would make the choices_count trigger refuse the
+	 * others.
+	 */
+	for _, forced := range []bool{false, true} {
+		for _, choice := range b.Choices {
+			if choice.Forced != forced {
+				continue
+			}
+			_, err := q.ExecContext(
+				ctx,
+				"INSERT INTO choices (userid, courseid, seltime, forced) VALUES ($1, $2, $3, $4)",
+				choice.UserID,
+				newIDs[choice.CourseID],
+				choice.SelTime,
+				choice.Forced,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("restore choice of course %d by %s: %w", choice.CourseID, choice.UserID, err)
+			}
+		}
+	}
+	for _, event := range b.ChoiceEvents {
+		var courseID *int
+		if event.CourseID != nil {
+			id := newIDs[*event.CourseID]
+			courseID = &id
+		}
+		_, err := q.ExecContext(
+			ctx,
+			"INSERT INTO choice_events (term, userid, courseid, kind, time) VALUES ($1, $2, $3, $4, $5)",
+			term,
+			event.UserID,
+			courseID,
+			event.Kind,
+			event.Time,
+		)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 162"), err)
+		}
+	}
+	for _, userID := range b.Confirmations {
+		_, err := q.ExecContext(
+			ctx,
+			"INSERT INTO confirmations (term, userid) VALUES ($1, $2)",
+			term,
+			userID,
+		)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 163"), err)
+		}
+	}
+	return newIDs, nil
+}
+
+/* The pre-selections of the term must have been removed first */
+func restoreExpectedStudents(ctx context.Context, q sqlExecerT, term int64, b *backupT) error {
+	_, err := q.ExecContext(ctx, "DELETE FROM expected_students WHERE term = $1", term)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 168"), err)
+	}
+	for _, student := range b.ExpectedStudents {
+		_, err = q.ExecContext(
+			ctx,
+			"INSERT INTO expected_students(term, name, id, legal_sex) VALUES ($1, $2, $3, $4)",
+			term,
+			student.Name,
+			student.ID,
+			student.LegalSex,
+		)
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 160"), err)
+		}
+	}
+	return nil
+}
+
+/*
+ * newIDs maps the course IDs in b to those in the database, or is nil if
+ * they are the same
+ */
+func restorePreSelections(ctx context.Context, q sqlExecerT, term int64, b *backupT, newIDs map[int]int) error {
+	_, err := q.ExecContext(ctx, "DELETE FROM pre_selected WHERE term = $1", term)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 169"), err)
+	}
+	for _, preSelection := range b.PreSelections {
+		courseID := preSelection.CourseID
+		if newIDs != nil {
+			courseID = newIDs[courseID]
+		}
+		_, err = q.ExecContext(
+			ctx,
+			"INSERT INTO pre_selected(term, student_id, course_id) VALUES ($1, $2, $3)",
+			term,
+			preSelection.StudentID,
+			courseID,
+		)
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 161"), err)
+		}
+	}
+	return nil
+}
+
+/*
+ * Keep what an upload is about to replace in table, so that it could be
+ * reverted, and forget what is too old to be. Only the IDs and forced flags
+ * of courses are kept along with pre-selections, as uploading them marks
+ * their courses as forced. Returns the ID of the snapshot, for the audit
+ * log, or 0 if nothing is kept.
+ */
+func recordUploadSnapshot(ctx context.Context, q sqlExecerT, term int64, actor, table string) (int64, error) {
+	now := time.Now()
+	window := time.Duration(config.Perf.UploadUndoWindow) * time.Second
+	_, err := q.ExecContext(ctx, "DELETE FROM upload_snapshots WHERE time < $1", now.Add(-window).UnixMicro())
+	if err != nil {
+		return 0, wrapError(errors.New("unexpected database error 170"), err)
+	}
+	if window == 0 {
+		return 0, nil
+	}
+
+	b := newBackup()
+	switch table {
+	case "courses":
+		err = backupCourses(ctx, q, term, b)
+	case "expected_students":
+		err = backupExpectedStudents(ctx, q, term, b)
+	case "pre_selected":
+		err = backupPreSelections(ctx, q, term, b)
+		if err != nil {
+			return 0, err
+		}
+		err = queryEach(ctx, q, "forced courses", func(rows *sql.Rows) error {
+			var course backupCourseT
+			err := rows.Scan(&course.ID, &course.Forced)
+			b.Courses = append(b.Courses, course)
+			return err
+		}, "SELECT id, forced FROM courses WHERE term = $1 ORDER BY id", term)
+	default:
+		return 0, wrapAny(errUnknownTable, table)
+	}
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return 0, wrapError(errCannotWriteBackup, err)
+	}
+
+	var id int64
+	err = q.QueryRowContext(
+		ctx,
+		"INSERT INTO upload_snapshots (term, tablename, time, actor, data) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		term,
+		table,
+		now.UnixMicro(),
+		actor,
+		string(data),
+	).Scan(&id)
+	if err != nil {
+		return 0, wrapError(errors.New("unexpected database error 171"), err)
+	}
+	return id, nil
+}
+
+/*
+ * The latest upload to a term that has not been reverted, or nil if there
+ * is none since the time given
+ */
+func (s *sqlStoreT) getLastUpload(ctx context.Context, term int64, since time.Time) (*uploadSnapshotT, error) {
+	var snapshot uploadSnapshotT
+	var t int64
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT id, tablename, time, actor FROM upload_snapshots WHERE term = $1 AND reverted IS NULL ORDER BY id DESC LIMIT 1",
+		term,
+	).Scan(&snapshot.ID, &snapshot.Table, &t, &snapshot.Actor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 172"), err)
+	}
+	snapshot.Time = time.UnixMicro(t)
+	if snapshot.Time.Before(since) {
+		return nil, nil
+	}
+	return &snapshot, nil
+}
+
+/*
+ * Put back what the upload with the given ID replaced, if it is still the
+ * latest one to the term and was made since the time given, returning the
+ * table it replaced. Whatever was changed in that table since is lost.
+ */
+func (s *sqlStoreT) revertUpload(
+	ctx context.Context,
+	term int64,
+	actor string,
+	ip string,
+	id int64,
+	since time.Time,
+) (retTable string, retErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", wrapError(errors.New("unexpected database error 173"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 174"), err)
+			return
+		}
+	}()
+
+	var latest int64
+	var table string
+	var t int64
+	var data string
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT id, tablename, time, data FROM upload_snapshots WHERE term = $1 AND reverted IS NULL ORDER BY id DESC LIMIT 1",
+		term,
+	).Scan(&latest, &table, &t, &data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errNoUploadToRevert
+	} else if err != nil {
+		return "", wrapError(errors.New("unexpected database error 175"), err)
+	}
+	if latest != id || time.UnixMicro(t).Before(since) {
+		return "", errNoUploadToRevert
+	}
+	var b backupT
+	err = json.Unmarshal([]byte(data), &b)
+	if err != nil {
+		return "", wrapError(errBadBackup, err)
+	}
+
+	rowsBefore, err := countRows(ctx, tx, table, term)
+	if err != nil {
+		return "", err
+	}
+	var rowsAfter int
+	switch table {
+	case "courses":
+		_, err = restoreCourses(ctx, tx, term, &b)
+		rowsAfter = len(b.Courses)
+	case "expected_students":
+		err = restoreExpectedStudents(ctx, tx, term, &b)
+		rowsAfter = len(b.ExpectedStudents)
+	case "pre_selected":
+		err = restorePreSelections(ctx, tx, term, &b, nil)
+		rowsAfter = len(b.PreSelections)
+		for _, course := range b.Courses {
+			if err != nil {
+				break
+			}
+			_, err = tx.ExecContext(
+				ctx,
+				"UPDATE courses SET forced = $2 WHERE id = $1",
+				course.ID,
+				course.Forced,
+			)
+			if err != nil {
+				err = wrapError(errors.New("unexpected database error 176"), err)
+			}
+		}
+	default:
+		err = wrapAny(errUnknownTable, table)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE upload_snapshots SET reverted = $2 WHERE id = $1",
+		id,
+		time.Now().UnixMicro(),
+	)
+	if err != nil {
+		return "", wrapError(errors.New("unexpected database error 177"), err)
+	}
+	err = insertAudit(
+		ctx,
+		tx,
+		actor,
+		ip,
+		auditRevert,
+		table,
+		auditUploadT{Rows: rowsBefore, Term: term, Snapshot: id}, //exhaustruct:ignore
+		auditUploadT{Rows: rowsAfter, Term: term},                //exhaustruct:ignore
+	)
+	if err != nil {
+		return "", err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", wrapError(errors.New("unexpected database error 178"), err)
+	}
+	return table, nil
+}
+
+/* Other instances */
+
+func (s *sqlStoreT) notify(ctx context.Context, msg string) error {
+	return s.dialect.notify(ctx, s.db, msg)
+}
+
+/* Nothing to listen to unless the backend says otherwise */
+func (s *sqlStoreT) listen(_ context.Context, _ func() error, _ func(msg string)) error {
+	return nil
+}
+
+/* Announcements */
+
+/* Every announcement, newest first */
+func (s *sqlStoreT) getAllAnnouncements(ctx context.Context) ([]announcementT, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT id, body, year_groups, author, created FROM announcements ORDER BY created DESC, id DESC",
+	)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 47"), err)
+	}
+	defer rows.Close()
+
+	var announcements []announcementT
+	for rows.Next() {
+		var a announcementT
+		var created int64
+		err := rows.Scan(&a.ID, &a.Body, &a.YearGroups, &a.Author, &created)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 48"), err)
+		}
+		a.Created = time.Unix(created, 0)
+		announcements = append(announcements, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 49"), err)
+	}
+	return announcements, nil
+}
+
+/* Insert an announcement and set its ID */
+func (s *sqlStoreT) insertAnnouncement(ctx context.Context, a *announcementT) error {
+	err := s.db.QueryRowContext(
+		ctx,
+		"INSERT INTO announcements (body, year_groups, author, created) VALUES ($1, $2, $3, $4) RETURNING id",
+		a.Body,
+		a.YearGroups,
+		a.Author,
+		a.Created.Unix(),
+	).Scan(&a.ID)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 50"), err)
+	}
+	return nil
+}
+
+/* Delete an announcement, returning the year groups it was for */
+func (s *sqlStoreT) deleteAnnouncement(ctx context.Context, id int) (uint8, error) {
+	var yearGroups uint8
+	err := s.db.QueryRowContext(
+		ctx,
+		"DELETE FROM announcements WHERE id = $1 RETURNING year_groups",
+		id,
+	).Scan(&yearGroups)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, errNoSuchAnnouncement
+		}
+		return 0, wrapError(errors.New("unexpected database error 51"), err)
+	}
+	return yearGroups, nil
+}
+
+/* Calendar tokens */
+
+/* Get a user's token, giving them newToken if they have none yet */
+func (s *sqlStoreT) getCalendarToken(ctx context.Context, userID, newToken string) (string, error) {
+	_, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO calendar_tokens (userid, token) VALUES ($1, $2) ON CONFLICT (userid) DO NOTHING",
+		userID,
+		newToken,
+	)
+	if err != nil {
+		return "", wrapError(errors.New("unexpected database error 70"), err)
+	}
+	var token string
+	err = s.db.QueryRowContext(
+		ctx,
+		"SELECT token FROM calendar_tokens WHERE userid = $1",
+		userID,
+	).Scan(&token)
+	if err != nil {
+		return "", wrapError(errors.New("unexpected database error 71"), err)
+	}
+	return token, nil
+}
+
+func (s *sqlStoreT) setCalendarToken(ctx context.Context, userID, token string) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO calendar_tokens (userid, token) VALUES ($1, $2) ON CONFLICT (userid) DO UPDATE SET token = EXCLUDED.token",
+		userID,
+		token,
+	)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 72"), err)
+	}
+	return nil
+}
+
+/* Only the ID, name and department are filled in */
+func (s *sqlStoreT) getCalendarUser(ctx context.Context, token string) (userT, error) {
+	var user userT
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT u.id, u.name, u.department FROM calendar_tokens t JOIN users u ON u.id = t.userid WHERE t.token = $1",
+		token,
+	).Scan(&user.ID, &user.Name, &user.Department)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return user, errNoSuchCalendar
+		}
+		return user, wrapError(errors.New("unexpected database error 76"), err)
+	}
+	return user, nil
+}
+
+/* Audit log */
+
+func (s *sqlStoreT) recordAudit(
+	ctx context.Context,
+	actor string,
+	ip string,
+	action string,
+	subject string,
+	before any,
+	after any,
+) error {
+	return insertAudit(ctx, s.db, actor, ip, action, subject, before, after)
+}
+
+/* before and after are marshalled as JSON, with nil meaning absent */
+func insertAudit(
+	ctx context.Context,
+	q sqlExecerT,
+	actor string,
+	ip string,
+	action string,
+	subject string,
+	before any,
+	after any,
+) error {
+	beforeJSON, err := marshalAudit(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := marshalAudit(after)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(
+		ctx,
+		"INSERT INTO audit_events (time, actor, ip, action, subject, before, after) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		time.Now().UnixMicro(),
+		actor,
+		ip,
+		action,
+		subject,
+		beforeJSON,
+		afterJSON,
+	)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 89"), err)
+	}
+	return nil
+}
+
+/*
+ * Call fn on every matching event, newest first. A limit of 0 means no
+ * limit.
+ */
+func (s *sqlStoreT) streamAuditEvents(
+	ctx context.Context,
+	filter auditFilterT,
+	limit int,
+	fn func(event *auditEventT) error,
+) error {
+	var args sqlArgsT
+	conds := filter.conditions(&args, s.dialect)
+	query := "SELECT id, time, actor, ip, action, subject, " +
+		s.dialect.jsonText("before") + ", " +
+		s.dialect.jsonText("after") + " FROM audit_events"
+	if len(conds) != 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if limit != 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 90"), err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event auditEventT
+		var t int64
+		err := rows.Scan(
+			&event.ID,
+			&t,
+			&event.Actor,
+			&event.IP,
+			&event.Action,
+			&event.Subject,
+			&event.Before,
+			&event.After,
+		)
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 91"), err)
+		}
+		event.Time = time.UnixMicro(t)
+		err = fn(&event)
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return wrapError(errors.New("unexpected database error 92"), err)
+	}
+	return nil
+}
+
+/*
+ * Count the rows of a term in a table that is about to be replaced by an
+ * upload. The table name must be a constant.
+ */
+func countRows(ctx context.Context, q sqlExecerT, table string, term int64) (int, error) {
+	var n int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE term = $1", term).Scan(&n)
+	if err != nil {
+		return 0, wrapError(errors.New("unexpected database error 93"), err)
+	}
+	return n, nil
+}
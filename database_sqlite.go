@@ -0,0 +1,123 @@
+/*
+ * SQLite backend
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+/*
+ * For small schools and demo instances, everything could live in a single
+ * file next to the binary. Transactions take the write lock as soon as
+ * they begin, so that concurrent choices wait for each other instead of
+ * failing to upgrade their locks, and only one instance may use a database
+ * file at a time.
+ */
+func openSQLite(path string) (*sqlStoreT, error) {
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?" + url.Values{
+		"_pragma": {
+			"busy_timeout(5000)",
+			"journal_mode(WAL)",
+			"foreign_keys(1)",
+		},
+		"_txlock": {"immediate"},
+	}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	if err := db.PingContext(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping database: %w", err)
+	}
+	return &sqlStoreT{db: db, dialect: sqliteDialectT{}}, nil
+}
+
+/*
+ * Open an existing database without writing to it, and without switching
+ * it to WAL mode
+ */
+func openSQLiteReadOnly(path string) (*sqlStoreT, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?" + url.Values{
+		"mode":    {"ro"},
+		"_pragma": {"busy_timeout(5000)"},
+	}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	if err := db.PingContext(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping database: %w", err)
+	}
+	return &sqlStoreT{db: db, dialect: sqliteDialectT{}}, nil
+}
+
+type sqliteDialectT struct{}
+
+func (sqliteDialectT) migrationsDir() string {
+	return "sql/migrations/sqlite"
+}
+
+/* Migrations already take the write lock, which is all we need */
+func (sqliteDialectT) lockMigrations(_ context.Context, _ *sql.Conn) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (sqliteDialectT) tableExists(ctx context.Context, conn *sql.Conn, table string) (bool, error) {
+	var exists bool
+	err := conn.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = $1)",
+		table,
+	).Scan(&exists)
+	return exists, err
+}
+
+func (sqliteDialectT) jsonText(column string) string {
+	return column
+}
+
+/* LIKE is already case-insensitive, although only for ASCII */
+func (sqliteDialectT) ilike(expr, pattern string) string {
+	return expr + " LIKE " + pattern + ` ESCAPE '\'`
+}
+
+func (sqliteDialectT) studentIDOfEmail(column string) string {
+	localPart := "substr(" + column + ", 1, instr(" + column + ", '@') - 1)"
+	id := "CASE WHEN " + localPart + " LIKE 's%' THEN substr(" + localPart + ", 2) ELSE " + localPart + " END"
+	return "CASE WHEN length(" + id + ") BETWEEN 1 AND 18 AND " + id + " NOT GLOB '*[^0-9]*' THEN CAST(" + id + " AS INTEGER) END"
+}
+
+/* Only one instance may use the file, so there is nobody to tell */
+/* RAISE(ABORT) in a trigger fails with this extended result code */
+func (sqliteDialectT) isCourseFull(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_TRIGGER
+}
+
+func (sqliteDialectT) notify(_ context.Context, _ sqlExecerT, _ string) error {
+	return nil
+}
+
+/* Transactions in SQLite are serializable already */
+func (sqliteDialectT) snapshotTxOptions() *sql.TxOptions {
+	return nil
+}
@@ -2,61 +2,44 @@ package main
 
 import (
 	"context"
-	"errors"
 	"strconv"
 	"strings"
 )
 
 func getStudentsThatHaveNotConfirmedTheirChoicesYetIncludingThoseWhoHaveNotLoggedInAtAll(ctx context.Context) (res []studentish, err error) {
-	ni, err := queryNameID(ctx, "SELECT name, id FROM expected_students ORDER BY id")
+	term := getActiveTerm()
+	students, err := store.getExpectedStudents(ctx, term)
 	if err != nil {
-		return nil, wrapError(errors.New("unexpected database error 1"), err)
+		return nil, err
+	}
+	ni := make(map[int64]string, len(students))
+	for _, student := range students {
+		ni[student.ID] = student.Name
 	}
 
-	rows, err := db.Query(
-		ctx,
-		"SELECT name, email, department, confirmed FROM users ORDER BY email",
-	)
+	users, err := store.getUsers(ctx, term)
 	if err != nil {
-		return nil, wrapError(errors.New("unexpected database error 2"), err)
+		return nil, err
 	}
-	for {
-		if !rows.Next() {
-			err := rows.Err()
-			if err != nil {
-				return nil, wrapError(errors.New("unexpected database error 3"), err)
-			}
-			break
-		}
-		var currentUserName, currentEmail, currentDepartment string
-		var currentConfirmed bool
-		err := rows.Scan(
-			&currentUserName,
-			&currentEmail,
-			&currentDepartment,
-			&currentConfirmed,
-		)
-		if err != nil {
-			return nil, wrapError(errors.New("unexpected database error 4"), err)
-		}
-		if currentDepartment == staffDepartment {
+	for _, user := range users {
+		if user.Department == staffDepartment {
 			continue
 		}
-		unamepart, _, _ := strings.Cut(currentEmail, "@")
+		unamepart, _, _ := strings.Cut(user.Email, "@")
 		unamepart = strings.TrimPrefix(strings.TrimPrefix(unamepart, "s"), "S")
 		nii, _ := strconv.ParseInt(unamepart, 10, 64)
 		delete(ni, nii)
 
-		if currentConfirmed {
+		if user.Confirmed {
 			continue
 		}
 
 		res = append(
 			res,
 			studentish{
-				Name:       currentUserName,
-				Email:      currentEmail,
-				Department: currentDepartment,
+				Name:       user.Name,
+				Email:      user.Email,
+				Department: user.Department,
 				Status:     "Hasn’t confirmed yet",
 			},
 		)
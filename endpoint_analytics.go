@@ -0,0 +1,101 @@
+/*
+ * Analytics page and its JSON counterpart
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+/* Both take an optional "term" parameter, defaulting to the active term */
+func handleAnalytics(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	_, username, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	term, err := parseTerm(req.URL.Query().Get("term"))
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	analytics, err := getAnalytics(req.Context(), term)
+	if err != nil {
+		return "", -1, err
+	}
+
+	/* Courses that filled first come first, then the most demanded */
+	byFill := append([]courseAnalyticsT(nil), analytics.Courses...)
+	sort.SliceStable(byFill, func(i, j int) bool {
+		a, b := byFill[i], byFill[j]
+		if (a.FilledAt == nil) != (b.FilledAt == nil) {
+			return a.FilledAt != nil
+		}
+		if a.FilledAt != nil && !a.FilledAt.Equal(*b.FilledAt) {
+			return a.FilledAt.Before(*b.FilledAt)
+		}
+		return a.DemandRatio > b.DemandRatio
+	})
+
+	err = tmpl.ExecuteTemplate(
+		w,
+		"analytics",
+		struct {
+			Name            string
+			Analytics       analyticsT
+			Courses         []courseAnalyticsT
+			SparklineWidth  int
+			SparklineHeight int
+		}{
+			username,
+			analytics,
+			byFill,
+			analyticsSparklineWidth,
+			analyticsSparklineHeight,
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
+
+func handleAnalyticsJSON(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	_, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	term, err := parseTerm(req.URL.Query().Get("term"))
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	analytics, err := getAnalytics(req.Context(), term)
+	if err != nil {
+		return "", -1, err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(analytics)
+	if err != nil {
+		return "", -1, wrapError(errHTTPWrite, err)
+	}
+	return "", -1, nil
+}
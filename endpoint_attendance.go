@@ -0,0 +1,57 @@
+/*
+ * Attendance sheets as PDF
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+/*
+ * /attendance takes the same "course" and "teacher" parameters as /rosters,
+ * and produces a PDF with one attendance sheet for each selected course.
+ */
+func handleAttendance(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	_, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+	if !haveTermDates() {
+		return "", http.StatusNotFound, errNoTermDates
+	}
+
+	rosters, err := getRosters(req.Context())
+	if err != nil {
+		return "", -1, err
+	}
+	selected, name, statusCode, err := selectRosters(rosters, req.URL.Query())
+	if err != nil {
+		return "", statusCode, err
+	}
+	filename := "cca_attendance"
+	if name != "" {
+		filename += "_" + name
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set(
+		"Content-Disposition",
+		"attachment;filename*=UTF-8''"+url.PathEscape(filename+".pdf"),
+	)
+	err = writeAttendanceSheets(w, selected)
+	if err != nil {
+		return "", -1, wrapError(errHTTPWrite, err)
+	}
+	return "", -1, nil
+}
@@ -0,0 +1,174 @@
+/*
+ * Search and export the audit log
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/* Events shown on the page; exports have no limit */
+const auditPageLimit = 200
+
+/*
+ * /audit takes the parameters described at auditFilterT, and "format=csv"
+ * to download every matching event instead of viewing the latest ones.
+ */
+func handleAudit(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	_, username, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	query := req.URL.Query()
+	filter, err := parseAuditFilter(query.Get)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	if query.Get("format") == "csv" {
+		return exportAudit(w, req, filter)
+	}
+
+	var events []auditEventT
+	err = store.streamAuditEvents(
+		req.Context(),
+		filter,
+		auditPageLimit,
+		func(event *auditEventT) error {
+			events = append(events, *event)
+			return nil
+		},
+	)
+	if err != nil {
+		return "", -1, err
+	}
+
+	query.Set("format", "csv")
+	err = tmpl.ExecuteTemplate(
+		w,
+		"audit",
+		struct {
+			Name    string
+			Query   url.Values
+			Actions []string
+			Events  []auditEventT
+			Limit   int
+			CSVURL  string
+		}{
+			username,
+			req.URL.Query(),
+			[]string{
+				auditChoose,
+				auditUnchoose,
+				auditConfirm,
+				auditUnconfirm,
+				auditSetState,
+				auditSetSchedule,
+				auditUpload,
+				auditCreateTerm,
+				auditSetTerm,
+				auditRepairCount,
+				auditRestore,
+				auditRevert,
+			},
+			events,
+			auditPageLimit,
+			"./audit?" + query.Encode(),
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
+
+func exportAudit(
+	w http.ResponseWriter,
+	req *http.Request,
+	filter auditFilterT,
+) (string, int, error) {
+	var csvWriter *csv.Writer
+	start := func() error {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set(
+			"Content-Disposition",
+			"attachment;filename=cca_audit_"+time.Now().In(loc).Format(time.DateOnly)+".csv",
+		)
+		_, err := w.Write([]byte{0xEF, 0xBB, 0xBF}) // utf8 bom for excel
+		if err != nil {
+			return wrapError(errHTTPWrite, err)
+		}
+		csvWriter = csv.NewWriter(w)
+		err = csvWriter.Write([]string{
+			"ID",
+			"Time",
+			"Actor",
+			"IP",
+			"Action",
+			"Subject",
+			"Before",
+			"After",
+		})
+		if err != nil {
+			return wrapError(errHTTPWrite, err)
+		}
+		return nil
+	}
+
+	err := store.streamAuditEvents(
+		req.Context(),
+		filter,
+		0,
+		func(event *auditEventT) error {
+			if csvWriter == nil {
+				err := start()
+				if err != nil {
+					return err
+				}
+			}
+			err := csvWriter.Write([]string{
+				strconv.FormatInt(event.ID, 10),
+				event.Time.In(loc).Format(time.RFC3339Nano),
+				event.Actor,
+				event.IP,
+				event.Action,
+				event.Subject,
+				stringOrEmpty(event.Before),
+				stringOrEmpty(event.After),
+			})
+			if err != nil {
+				return wrapError(errHTTPWrite, err)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return "", -1, err
+	}
+	if csvWriter == nil {
+		err = start()
+		if err != nil {
+			return "", -1, err
+		}
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return "", -1, wrapError(errHTTPWrite, err)
+	}
+	return "", -1, nil
+}
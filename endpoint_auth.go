@@ -14,12 +14,10 @@ import (
 	"log/slog"
 	"net/http"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"github.com/MicahParks/keyfunc/v3"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 )
 
 var myKeyfunc keyfunc.Keyfunc
@@ -172,154 +170,42 @@ func handleAuth(w http.ResponseWriter, req *http.Request) (string, int, error) {
 		return "", http.StatusBadRequest, errors.New("your email address seems to be invalid. Please contact s22537@stu.ykpaoschool.cn")
 	}
 
-	var legalSex string
 	studentID := strings.TrimPrefix(strings.TrimPrefix(localpart, "s"), "S")
 
-	tx, err := db.Begin(req.Context())
-	if err != nil {
-		return "", -1, fmt.Errorf("begin transaction: %w", err)
-	}
-	/*
-		defer func(ctx context.Context) {
-			if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
-				log.Printf("failed to rollback transaction: %v", err)
-			}
-		}(req.Context())
-	*/
-
-	_ = db.QueryRow( // TODO: No legal sex
-		req.Context(),
-		"SELECT legal_sex from expected_students WHERE id = $1",
-		studentID,
-	).Scan(&legalSex)
-
-	if legalSex != "" {
-		_, err = db.Exec(
-			req.Context(),
-			"INSERT INTO users (id, name, email, department, session, expr, confirmed, legal_sex) VALUES ($1, $2, $3, $4, $5, $6, false, $7)",
-			claims.Oid,
-			claims.Name,
-			claims.Email,
-			department,
-			cookieValue,
-			exprU,
-			legalSex,
-		)
-		if err != nil {
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) && pgErr.Code == pgErrUniqueViolation {
-				_, err := db.Exec(
-					req.Context(),
-					"UPDATE users SET (name, email, department, session, expr, legal_sex) = ($1, $2, $3, $4, $5, $7) WHERE id = $6",
-					claims.Name,
-					claims.Email,
-					department,
-					cookieValue,
-					exprU,
-					claims.Oid,
-					legalSex,
-				)
-				if err != nil {
-					return "", -1, fmt.Errorf("update user: %w", err)
-				}
-			} else {
-				return "", -1, fmt.Errorf("insert user: %w", err)
-			}
-		}
-	} else {
-		if department != "Staff" {
-			slog.Warn("student with unknown legal sex", "studentID", studentID, "oid", claims.Oid, "email", claims.Email, "name", claims.Name)
-		}
+	legalSex, _ := store.getExpectedLegalSex(req.Context(), getActiveTerm(), studentID) // TODO: No legal sex
 
-		_, err = db.Exec(
-			req.Context(),
-			"INSERT INTO users (id, name, email, department, session, expr, confirmed) VALUES ($1, $2, $3, $4, $5, $6, false)",
-			claims.Oid,
-			claims.Name,
-			claims.Email,
-			department,
-			cookieValue,
-			exprU,
-		)
-		if err != nil {
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) && pgErr.Code == pgErrUniqueViolation {
-				_, err := db.Exec(
-					req.Context(),
-					"UPDATE users SET (name, email, department, session, expr) = ($1, $2, $3, $4, $5) WHERE id = $6",
-					claims.Name,
-					claims.Email,
-					department,
-					cookieValue,
-					exprU,
-					claims.Oid,
-				)
-				if err != nil {
-					return "", -1, fmt.Errorf("update user: %w", err)
-				}
-			} else {
-				return "", -1, fmt.Errorf("insert user: %w", err)
-			}
-		}
+	if legalSex == "" && department != "Staff" {
+		slog.Warn("student with unknown legal sex", "studentID", studentID, "oid", claims.Oid, "email", claims.Email, "name", claims.Name)
 	}
 
-	log.Printf("%s (%s, %s) just authenticated", claims.Name, claims.Email, claims.Oid)
-
-	err = tx.Commit(req.Context())
+	err = store.upsertUser(
+		req.Context(),
+		userT{
+			ID:         claims.Oid,
+			Name:       claims.Name,
+			Email:      claims.Email,
+			Department: department,
+			LegalSex:   legalSex,
+			Confirmed:  false,
+		},
+		cookieValue,
+		exprU,
+	)
 	if err != nil {
-		return "", -1, fmt.Errorf("commit transaction: %w", err)
+		return "", -1, err
 	}
 
+	log.Printf("%s (%s, %s) just authenticated", claims.Name, claims.Email, claims.Oid)
+
 	if department == "Staff" {
 		http.Redirect(w, req, "/", http.StatusSeeOther)
 		return "", -1, nil
 	}
 
 	// TODO: Do this in the root page instead
-	rows, err := db.Query(req.Context(), `SELECT course_id FROM pre_selected WHERE student_id = $1`, studentID)
+	err = addForcedChoices(req.Context(), claims.Oid, studentID, getRemoteIP(req), now)
 	if err != nil {
-		return "", http.StatusInternalServerError, fmt.Errorf("failed to fetch pre_selected choices: %w", err)
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var courseID int
-		if err := rows.Scan(&courseID); err != nil {
-			return "", http.StatusInternalServerError, fmt.Errorf("failed to scan course_id: %w", err)
-		}
-
-		_, err = db.Exec(req.Context(),
-			`INSERT INTO choices (userid, courseid, seltime, forced) VALUES ($1, $2, $3, true)`,
-			claims.Oid, courseID, now.UnixMicro())
-		if err != nil {
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) && pgErr.Code == pgErrUniqueViolation {
-				continue
-			}
-			return "", http.StatusInternalServerError, fmt.Errorf("failed to insert choice for course %d: %w", courseID, err)
-		}
-
-		_course, ok := courses.Load(courseID)
-		if !ok {
-			return "", -1, errNoSuchCourse
-		}
-		course, ok := _course.(*courseT)
-		if !ok {
-			return "", -1, errType
-		}
-		if course == nil {
-			return "", -1, errNoSuchCourse
-		}
-
-		func() {
-			course.SelectedLock.Lock()
-			defer course.SelectedLock.Unlock()
-			atomic.AddUint32(&course.Selected, 1)
-		}()
-	}
-
-	if err := rows.Err(); err != nil {
-		return "", http.StatusInternalServerError, fmt.Errorf("error iterating over pre_selected rows: %w", err)
+		return "", http.StatusInternalServerError, err
 	}
 
 	http.Redirect(w, req, "/", http.StatusSeeOther)
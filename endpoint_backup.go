@@ -0,0 +1,95 @@
+/*
+ * Download and restore backups
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+/* Download a backup of the term in the "term" query parameter, by default the active one */
+func handleBackup(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	term, err := parseTerm(req.URL.Query().Get("term"))
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	b, err := store.getBackup(req.Context(), term)
+	if errors.Is(err, errNoSuchTerm) {
+		return "", http.StatusNotFound, err
+	} else if err != nil {
+		return "", -1, err
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set(
+		"Content-Disposition",
+		"attachment;filename*=UTF-8''"+url.PathEscape(b.filename()),
+	)
+	err = writeBackup(w, b)
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
+
+/* Replace the data of the active term with the backup uploaded as "backup" */
+func handleRestore(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	if !allStatesDisabled() {
+		return "", http.StatusBadRequest, errDisableStudentAccessFirst
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, backupMaxSize)
+	file, fileHeader, err := req.FormFile("backup")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return "", http.StatusRequestEntityTooLarge, wrapError(errBackupTooLarge, err)
+	} else if err != nil {
+		return "", http.StatusBadRequest, wrapError(errFormNoFile, err)
+	}
+
+	upload := newAuditUploadReader(file)
+	b, err := readBackup(upload)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	err = restoreBackup(
+		req.Context(),
+		userID,
+		getRemoteIP(req),
+		upload.record(len(b.Courses), fileHeader.Filename),
+		b,
+	)
+	if err != nil {
+		return "", -1, err
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return "", -1, nil
+}
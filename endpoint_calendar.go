@@ -0,0 +1,101 @@
+/*
+ * Calendar feed endpoints
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+/*
+ * /calendar/<token>.ics is read by calendar applications, which don't have
+ * our session cookie, so the token is the only credential. Staff feeds need
+ * a "teacher" parameter.
+ */
+func handleCalendar(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	if !haveTermDates() {
+		return "", http.StatusNotFound, errNoTermDates
+	}
+	token, ok := strings.CutSuffix(strings.TrimPrefix(req.URL.Path, "/calendar/"), ".ics")
+	if !ok || token == "" || strings.Contains(token, "/") {
+		return "", http.StatusNotFound, errNoSuchCalendar
+	}
+
+	user, err := store.getCalendarUser(req.Context(), token)
+	if errors.Is(err, errNoSuchCalendar) {
+		return "", http.StatusNotFound, err
+	} else if err != nil {
+		return "", -1, err
+	}
+	userID, username, department := user.ID, user.Name, user.Department
+
+	var name string
+	var calendarCourses []*courseT
+	if department == staffDepartment {
+		teacher := req.URL.Query().Get("teacher")
+		if teacher == "" {
+			return "", http.StatusBadRequest, errNoSuchTeacher
+		}
+		sortedCourses, err := getSortedCourses()
+		if err != nil {
+			return "", -1, err
+		}
+		for _, course := range sortedCourses {
+			if course.Teacher == teacher {
+				calendarCourses = append(calendarCourses, course)
+			}
+		}
+		if calendarCourses == nil {
+			return "", http.StatusNotFound, wrapAny(errNoSuchTeacher, teacher)
+		}
+		name = "CCAs: " + teacher
+	} else {
+		calendarCourses, err = getUserCourses(req.Context(), userID)
+		if err != nil {
+			return "", -1, err
+		}
+		name = "CCAs: " + username
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	err = writeCalendar(w, name, calendarCourses)
+	if err != nil {
+		return "", -1, wrapError(errHTTPWrite, err)
+	}
+	return "", -1, nil
+}
+
+func handleResetCalendar(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+
+	err = resetCalendarToken(req.Context(), userID)
+	if err != nil {
+		return "", -1, err
+	}
+
+	if department == staffDepartment {
+		http.Redirect(w, req, "/rosters", http.StatusSeeOther)
+	} else {
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+	}
+	return "", -1, nil
+}
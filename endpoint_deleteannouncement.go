@@ -0,0 +1,45 @@
+/*
+ * Let staff delete announcements
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+func handleDeleteAnnouncement(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	_, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	err = req.ParseForm()
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errMalformedForm, err)
+	}
+
+	id, err := strconv.Atoi(req.PostFormValue("id"))
+	if err != nil {
+		return "", http.StatusBadRequest, errNoSuchAnnouncement
+	}
+
+	err = deleteAnnouncement(req.Context(), id)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return "", -1, nil
+}
@@ -1,5 +1,5 @@
 /*
- * Staff page
+ * Export choices
  *
  * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
  * SPDX-License-Identifier: AGPL-3.0-or-later
@@ -8,13 +8,19 @@
 package main
 
 import (
-	"encoding/csv"
-	"errors"
-	"fmt"
+	"io"
 	"net/http"
-	"strings"
+	"net/url"
+	"time"
 )
 
+/*
+ * Rows are streamed from a single query straight to the writer of the
+ * export profile selected by the "profile" query parameter, which defaults
+ * to the original CSV format. Choices referring to users or courses that no
+ * longer exist are reported at the end, instead of failing the whole export.
+ * See exportFilterT for the other accepted query parameters.
+ */
 func handleExportChoices(
 	w http.ResponseWriter,
 	req *http.Request,
@@ -24,118 +30,29 @@ func handleExportChoices(
 		return "", -1, err
 	}
 	if department != staffDepartment {
-		return "", http.StatusForbidden, errors.New("staff only")
+		return "", http.StatusForbidden, errStaffOnly
 	}
 
-	type userCacheT struct {
-		Name       string
-		StudentID  string
-		Department string
+	query := req.URL.Query()
+	filter, err := parseExportFilter(query)
+	if err != nil {
+		return "", http.StatusBadRequest, err
 	}
-	userCacheMap := make(map[string]userCacheT)
-
-	rows, err := db.Query(req.Context(), "SELECT userid, courseid FROM choices")
+	profile, err := parseExportProfile(query)
 	if err != nil {
-		return "", -1, fmt.Errorf("query choices: %w", err)
+		return "", http.StatusBadRequest, err
 	}
-	output := make([][]string, 0)
-	for {
-		if !rows.Next() {
-			err := rows.Err()
-			if err != nil {
-				return "", -1, fmt.Errorf("read next choice: %w", err)
-			}
-			break
-		}
-		var currentUserID,
-			currentUserName,
-			currentStudentID,
-			currentDepartment string
-		var currentCourseID int
-		err := rows.Scan(&currentUserID, &currentCourseID)
-		if err != nil {
-			return "", -1, fmt.Errorf("scan choice: %w", err)
-		}
-		currentUserCache, ok := userCacheMap[currentUserID]
-		if ok {
-			currentUserName = currentUserCache.Name
-			currentDepartment = currentUserCache.Department
-			currentStudentID = currentUserCache.StudentID
-		} else {
-			var currentUserEmail string
-			err := db.QueryRow(
-				req.Context(),
-				"SELECT name, email, department FROM users WHERE id = $1",
-				currentUserID,
-			).Scan(
-				&currentUserName,
-				&currentUserEmail,
-				&currentDepartment,
-			)
-			if err != nil {
-				return "", -1, fmt.Errorf("scan user info: %w", err)
-			}
-			before, _, found := strings.Cut(currentUserEmail, "@")
-			if found {
-				currentStudentID, _ = strings.CutPrefix(returnFirst(strings.CutPrefix(before, "s")), "S")
-			} else {
-				currentStudentID = currentUserEmail
-			}
-			userCacheMap[currentUserID] = userCacheT{
-				Name:       currentUserName,
-				StudentID:  currentStudentID,
-				Department: currentDepartment,
-			}
-		}
 
-		_course, ok := courses.Load(currentCourseID)
-		if !ok {
-			return "", -1, fmt.Errorf("no such course: %d", currentCourseID)
-		}
-		course := _course.(*courseT)
-		if course == nil {
-			return "", -1, fmt.Errorf("no such course with broken state: %d", currentCourseID)
-		}
-		output = append(
-			output,
-			[]string{
-				currentUserName,
-				currentStudentID,
-				currentDepartment,
-				course.Title,
-				course.Group,
-				course.SectionID,
-				course.CourseID,
-			},
+	err = writeChoicesExport(req.Context(), filter, profile, func() (io.Writer, error) {
+		w.Header().Set("Content-Type", profile.contentType())
+		w.Header().Set(
+			"Content-Disposition",
+			"attachment;filename*=UTF-8''"+url.PathEscape(profile.filename(time.Now())),
 		)
-	}
-
-	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
-	w.Header().Set("Content-Disposition", "attachment;filename=cca_choices.csv")
-	_, err = w.Write([]byte{0xEF, 0xBB, 0xBF}) // utf8 bom because excel
-	if err != nil {
-		return "", -1, fmt.Errorf("write http stream: %w", err)
-	}
-	csvWriter := csv.NewWriter(w)
-	err = csvWriter.Write([]string{
-		"Student Name",
-		"Student ID",
-		"Grade/Year",
-		"Group/Activity",
-		"Container",
-		"Section ID",
-		"Course ID",
+		return w, nil
 	})
 	if err != nil {
-		return "", -1, fmt.Errorf("write http stream: %w", err)
-	}
-	err = csvWriter.WriteAll(output)
-	if err != nil {
-		return "", -1, fmt.Errorf("write http stream: %w", err)
-	}
-	csvWriter.Flush()
-	if csvWriter.Error() != nil {
-		return "", -1, fmt.Errorf("write http stream: %w", err)
+		return "", -1, err
 	}
 	return "", -1, nil
 }
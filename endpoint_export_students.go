@@ -1,5 +1,5 @@
 /*
- * Staff page
+ * Export student confirmation status as CSV
  *
  * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
  * SPDX-License-Identifier: AGPL-3.0-or-later
@@ -8,14 +8,16 @@
 package main
 
 import (
-	"encoding/csv"
-	"errors"
-	"fmt"
 	"net/http"
-	"strconv"
-	"strings"
 )
 
+/*
+ * Students who have logged in are matched with expected students by the
+ * numeric part of their email addresses, in the same query, so that those
+ * who have never logged in could be listed too. Rows are streamed straight
+ * to the CSV writer. See exportFilterT for the accepted query parameters;
+ * students who have never logged in are left out if any filter is given.
+ */
 func handleExportStudents(
 	w http.ResponseWriter,
 	req *http.Request,
@@ -25,73 +27,13 @@ func handleExportStudents(
 		return "", -1, err
 	}
 	if department != staffDepartment {
-		return "", -1, errStaffOnly
-	}
-
-	ni, err := queryNameID(req.Context(), "SELECT name, id FROM expected_students")
-	if err != nil {
-		return "", -1, wrapError(errors.New("unexpected database error 5"), err)
+		return "", http.StatusForbidden, errStaffOnly
 	}
 
-	rows, err := db.Query(
-		req.Context(),
-		"SELECT name, email, department, confirmed FROM users",
-	)
+	filter, err := parseExportFilter(req.URL.Query())
 	if err != nil {
-		return "", -1, wrapError(errors.New("unexpected database error 6"), err)
+		return "", http.StatusBadRequest, err
 	}
-	output := make([][]string, 0)
-	for {
-		if !rows.Next() {
-			err := rows.Err()
-			if err != nil {
-				return "", -1, wrapError(errors.New("unexpected database error 7"), err)
-			}
-			break
-		}
-		var currentUserName, currentEmail, currentDepartment string
-		var currentConfirmed bool
-		err := rows.Scan(
-			&currentUserName,
-			&currentEmail,
-			&currentDepartment,
-			&currentConfirmed,
-		)
-		if err != nil {
-			return "", -1, wrapError(errors.New("unexpected database error 8"), err)
-		}
-		unamepart, _, _ := strings.Cut(currentEmail, "@")
-		unamepart = strings.TrimPrefix(strings.TrimPrefix(unamepart, "s"), "S")
-		nii, _ := strconv.ParseInt(unamepart, 10, 64)
-		delete(ni, nii)
-
-		if currentDepartment == staffDepartment {
-			continue
-		}
-
-		output = append(
-			output,
-			[]string{
-				currentUserName,
-				currentEmail,
-				currentDepartment,
-				strconv.FormatBool(currentConfirmed),
-			},
-		)
-	}
-
-	for k, v := range ni {
-		output = append(
-			output,
-			[]string{
-				v,
-				"s" + strconv.FormatInt(k, 10) + "@ykpaoschool.cn",
-				"Unknown",
-				"never logged in",
-			},
-		)
-	}
-
 	w.Header().Set(
 		"Content-Type",
 		"text/csv; charset=utf-8",
@@ -100,28 +42,9 @@ func handleExportStudents(
 		"Content-Disposition",
 		"attachment;filename=cca_students.csv",
 	)
-	_, err = w.Write([]byte{0xEF, 0xBB, 0xBF}) // utf8 bom for excel
+	err = writeStudentsExport(req.Context(), w, filter)
 	if err != nil {
-		return "", -1, fmt.Errorf("write http stream: %w", err)
-	}
-	csvWriter := csv.NewWriter(w)
-	err = csvWriter.Write([]string{
-		"Student Name",
-		"Student ID",
-		"Grade/Year",
-		"Confirmed",
-	})
-	if err != nil {
-		return "", -1, errHTTPWrite
-	}
-	err = csvWriter.WriteAll(output)
-	if err != nil {
-		return "", -1, errHTTPWrite
-	}
-	csvWriter.Flush()
-	if csvWriter.Error() != nil {
-		return "", -1, errHTTPWrite
+		return "", -1, err
 	}
-
 	return "", -1, nil
 }
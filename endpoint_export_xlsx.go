@@ -0,0 +1,152 @@
+/*
+ * Export choices and student status as an XLSX workbook
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+/* Takes an optional "term" parameter, defaulting to the active term */
+func handleExportXLSX(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	_, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	term, err := parseTerm(req.URL.Query().Get("term"))
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	sortedCourses, err := getTermCourses(req.Context(), term)
+	if err != nil {
+		return "", -1, err
+	}
+	coursesByID := make(map[int]*courseT, len(sortedCourses))
+	for _, course := range sortedCourses {
+		coursesByID[course.ID] = course
+	}
+	choiceRows, err := store.getChoiceRows(req.Context(), term)
+	if err != nil {
+		return "", -1, err
+	}
+	unconfirmed, err := store.getUnconfirmedStudents(req.Context(), term)
+	if err != nil {
+		return "", -1, err
+	}
+	neverLoggedIn, err := getNeverLoggedIn(req.Context(), term)
+	if err != nil {
+		return "", -1, err
+	}
+
+	choicesSheet := xlsxSheetT{
+		Name: "Choices",
+		Header: []string{
+			"Student Name",
+			"Student ID",
+			"Grade/Year",
+			"Group/Activity",
+			"Container",
+			"Section ID",
+			"Course ID",
+			"Forced",
+			"Selection Time",
+		},
+		Rows: make([][]interface{}, 0, len(choiceRows)),
+	}
+	rosters := make(map[int][][]interface{})
+	for _, row := range choiceRows {
+		course, ok := coursesByID[row.CourseID]
+		if !ok {
+			return "", -1, wrapAny(errNoSuchCourse, row.CourseID)
+		}
+		choicesSheet.Rows = append(choicesSheet.Rows, []interface{}{
+			row.Name,
+			row.StudentID,
+			row.Department,
+			course.Title,
+			course.Group,
+			course.SectionID,
+			course.CourseID,
+			row.Forced,
+			row.SelTime,
+		})
+		rosters[row.CourseID] = append(rosters[row.CourseID], []interface{}{
+			row.Name,
+			row.StudentID,
+			row.Department,
+			row.Forced,
+			row.SelTime,
+		})
+	}
+
+	sheets := make([]xlsxSheetT, 0, len(sortedCourses)+3)
+	sheets = append(sheets, choicesSheet)
+
+	unconfirmedSheet := xlsxSheetT{
+		Name:   "Unconfirmed",
+		Header: []string{"Student Name", "Student ID", "Grade/Year"},
+		Rows:   make([][]interface{}, 0, len(unconfirmed)),
+	}
+	for _, s := range unconfirmed {
+		unconfirmedSheet.Rows = append(unconfirmedSheet.Rows, []interface{}{
+			s.Name,
+			s.StudentID,
+			s.Department,
+		})
+	}
+	sheets = append(sheets, unconfirmedSheet)
+
+	neverLoggedInSheet := xlsxSheetT{
+		Name:   "Never Logged In",
+		Header: []string{"Student Name", "Student ID", "Legal Sex"},
+		Rows:   make([][]interface{}, 0, len(neverLoggedIn)),
+	}
+	for _, s := range neverLoggedIn {
+		neverLoggedInSheet.Rows = append(neverLoggedInSheet.Rows, []interface{}{
+			s.Name,
+			s.ID,
+			s.LegalSex,
+		})
+	}
+	sheets = append(sheets, neverLoggedInSheet)
+
+	for _, course := range sortedCourses {
+		sheets = append(sheets, xlsxSheetT{
+			Name: strconv.Itoa(course.ID) + " " + course.Title,
+			Header: []string{
+				"Student Name",
+				"Student ID",
+				"Grade/Year",
+				"Forced",
+				"Selection Time",
+			},
+			Rows: rosters[course.ID],
+		})
+	}
+
+	w.Header().Set(
+		"Content-Type",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	)
+	w.Header().Set(
+		"Content-Disposition",
+		"attachment;filename=cca_export.xlsx",
+	)
+	err = writeXLSX(w, sheets)
+	if err != nil {
+		return "", -1, wrapError(errHTTPWrite, err)
+	}
+	return "", -1, nil
+}
@@ -14,8 +14,6 @@ import (
 	"strings"
 	"sync/atomic"
 	"time"
-
-	"github.com/jackc/pgx/v5/pgconn"
 )
 
 func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error) {
@@ -118,6 +116,27 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 			ee = append(ee, v.Email)
 		}
 
+		announcements, err := getAnnouncements(req.Context(), department)
+		if err != nil {
+			return "", -1, err
+		}
+
+		terms, err := store.getTerms(req.Context())
+		if err != nil {
+			return "", -1, err
+		}
+		var termName string
+		for _, term := range terms {
+			if term.ID == getActiveTerm() {
+				termName = term.Name
+			}
+		}
+
+		lastUpload, err := getLastUpload(req.Context())
+		if err != nil {
+			return "", -1, err
+		}
+
 		err = tmpl.ExecuteTemplate(
 			w,
 			"staff",
@@ -127,10 +146,16 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 					S     uint32
 					Sched *string
 				}
-				StatesOr uint32
-				Groups   *map[string]groupT
-				Students []studentish
-				Ee       []string
+				StatesOr       uint32
+				Groups         *map[string]groupT
+				Students       []studentish
+				Ee             []string
+				YearGroups     []string
+				CourseTypes    []string
+				ExportProfiles []string
+				Announcements  []announcementT
+				TermName       string
+				LastUpload     *uploadSnapshotT
 			}{
 				username,
 				StatesDereferenced,
@@ -144,6 +169,12 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 				&_groups,
 				studentishes,
 				ee,
+				[]string{"Y9", "Y10", "Y11", "Y12"},
+				[]string{sport, nonSport},
+				getExportProfileNames(),
+				announcements,
+				termName,
+				lastUpload,
 			},
 		)
 		if err != nil {
@@ -157,15 +188,27 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 		return "", -1, errNoSuchYearGroup
 	}
 	if atomic.LoadUint32(_state) == 0 {
-		err := tmpl.ExecuteTemplate(
+		announcements, err := getAnnouncements(req.Context(), department)
+		if err != nil {
+			return "", -1, err
+		}
+		calendarURL, err := getUserCalendarURL(req.Context(), userID)
+		if err != nil {
+			return "", -1, err
+		}
+		err = tmpl.ExecuteTemplate(
 			w,
 			"student_disabled",
 			struct {
-				Name       string
-				Department string
+				Name          string
+				Department    string
+				Announcements []announcementT
+				CalendarURL   string
 			}{
 				username,
 				department,
+				announcements,
+				calendarURL,
 			},
 		)
 		if err != nil {
@@ -197,52 +240,14 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 	studentID := userpart[1:]
 
 	// TODO
-	rows, err := db.Query(req.Context(), `SELECT course_id FROM pre_selected WHERE student_id = $1`, studentID)
+	err = addForcedChoices(req.Context(), userID, studentID, getRemoteIP(req), time.Now())
 	if err != nil {
-		return "", http.StatusInternalServerError, fmt.Errorf("failed to fetch pre_selected choices: %w", err)
+		return "", http.StatusInternalServerError, err
 	}
-	defer rows.Close()
-
-	now := time.Now()
-
-	for rows.Next() {
-		var courseID int
-		if err := rows.Scan(&courseID); err != nil {
-			return "", http.StatusInternalServerError, fmt.Errorf("failed to scan course_id: %w", err)
-		}
 
-		_, err = db.Exec(req.Context(),
-			`INSERT INTO choices (userid, courseid, seltime, forced) VALUES ($1, $2, $3, true)`,
-			userID, courseID, now.UnixMicro())
-		if err != nil {
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) && pgErr.Code == pgErrUniqueViolation {
-				continue
-			}
-			return "", http.StatusInternalServerError, fmt.Errorf("failed to insert choice for course %d: %w", courseID, err)
-		}
-
-		_course, ok := courses.Load(courseID)
-		if !ok {
-			return "", -1, errNoSuchCourse
-		}
-		course, ok := _course.(*courseT)
-		if !ok {
-			return "", -1, errType
-		}
-		if course == nil {
-			return "", -1, errNoSuchCourse
-		}
-
-		func() {
-			course.SelectedLock.Lock()
-			defer course.SelectedLock.Unlock()
-			atomic.AddUint32(&course.Selected, 1)
-		}()
-	}
-
-	if err := rows.Err(); err != nil {
-		return "", http.StatusInternalServerError, fmt.Errorf("error iterating over pre_selected rows: %w", err)
+	calendarURL, err := getUserCalendarURL(req.Context(), userID)
+	if err != nil {
+		return "", -1, err
 	}
 
 	err = tmpl.ExecuteTemplate(
@@ -256,6 +261,7 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 				Sport    int
 				NonSport int
 			}
+			CalendarURL string
 		}{
 			username,
 			department,
@@ -264,6 +270,7 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 				Sport    int
 				NonSport int
 			}{sportRequired, nonSportRequired},
+			calendarURL,
 		},
 	)
 	if err != nil {
@@ -0,0 +1,57 @@
+/*
+ * Let staff post announcements
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+func handleNewAnnouncement(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	_, username, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	err = req.ParseForm()
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errMalformedForm, err)
+	}
+
+	body := strings.TrimSpace(req.PostFormValue("body"))
+	if body == "" {
+		return "", http.StatusBadRequest, errEmptyAnnouncement
+	}
+	if utf8.RuneCountInString(body) > announcementMaxLength {
+		return "", http.StatusBadRequest, errAnnouncementTooLong
+	}
+
+	/* Targeting no year groups at all means targeting all of them */
+	yearGroups, err := yearGroupsStringToNumber(
+		strings.Join(req.PostForm["target"], " "),
+	)
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errYearGroupSpecString, err)
+	}
+
+	err = createAnnouncement(req.Context(), body, yearGroups, username)
+	if err != nil {
+		return "", -1, err
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return "", -1, nil
+}
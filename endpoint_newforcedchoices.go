@@ -8,16 +8,7 @@
 package main
 
 import (
-	"context"
-	"encoding/csv"
-	"errors"
-	"fmt"
-	"io"
 	"net/http"
-	"strconv"
-	"strings"
-
-	"github.com/jackc/pgx/v5"
 )
 
 func handleNewForcedChoices(w http.ResponseWriter, req *http.Request) (string, int, error) {
@@ -25,7 +16,7 @@ func handleNewForcedChoices(w http.ResponseWriter, req *http.Request) (string, i
 		return "", http.StatusMethodNotAllowed, errPostOnly
 	}
 
-	_, _, department, _, _, err := getUserInfoFromRequest(req)
+	userID, _, department, _, _, err := getUserInfoFromRequest(req)
 	if err != nil {
 		return "", -1, err
 	}
@@ -45,156 +36,26 @@ func handleNewForcedChoices(w http.ResponseWriter, req *http.Request) (string, i
 		return "", http.StatusBadRequest, errNotACSV
 	}
 
-	csvReader := csv.NewReader(file)
-	titleLine, err := csvReader.Read()
+	sortedCourses, err := getSortedCourses()
 	if err != nil {
-		return "", http.StatusBadRequest, wrapError(errCannotReadCSV, err)
-	}
-	if titleLine == nil {
-		return "", -1, errUnexpectedNilCSVLine
-	}
-	if len(titleLine) > 0 {
-		titleLine[0] = strings.TrimPrefix(titleLine[0], "\uFEFF")
-	}
-	if len(titleLine) != 2 {
-		return "", -1, wrapAny(
-			errBadCSVFormat,
-			"expecting 2 fields on the first line (Student ID, Section ID)",
-		)
-	}
-	var studentIDIndex, sectionIDIndex int = -1, -1
-	for i, v := range titleLine {
-		switch v {
-		case "Student ID":
-			studentIDIndex = i
-		case "Section ID":
-			sectionIDIndex = i
-		}
-	}
-
-	if studentIDIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
-			errMissingCSVColumn,
-			"Student ID",
-		)
+		return "", -1, err
 	}
-	if sectionIDIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
-			errMissingCSVColumn,
-			"Section ID",
-		)
+	upload := newAuditUploadReader(file)
+	preSelections, err := readPreSelectionsCSV(upload, sortedCourses)
+	if err != nil {
+		return "", http.StatusBadRequest, err
 	}
 
-	lineNumber := 1
-	ok, statusCode, err := func(ctx context.Context) (
-		retBool bool,
-		retStatus int,
-		retErr error,
-	) {
-		tx, err := db.Begin(ctx)
-		if err != nil {
-			return false, -1, wrapError(errors.New("unexpected database error 16"), err)
-		}
-		defer func() {
-			err := tx.Rollback(ctx)
-			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
-				retBool, retStatus, retErr = false, -1, wrapError(
-					errors.New("unexpected database error 17"),
-					err,
-				)
-				return
-			}
-		}()
-		_, err = tx.Exec(
-			ctx,
-			"DELETE FROM pre_selected",
-		)
-		if err != nil {
-			return false, -1, wrapError(errors.New("unexpected database error 18"), err)
-		}
-
-		for {
-			lineNumber++
-			line, err := csvReader.Read()
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					break
-				}
-				return false, -1, wrapError(
-					errCannotReadCSV,
-					err,
-				)
-			}
-			if line == nil {
-				return false, -1, wrapError(
-					errCannotReadCSV,
-					errUnexpectedNilCSVLine,
-				)
-			}
-			if len(line) != 2 {
-				return false, -1, wrapAny(
-					errInsufficientFields,
-					fmt.Sprintf(
-						"line %d has a wrong number of items",
-						lineNumber,
-					),
-				)
-			}
-
-			studentID, err := strconv.ParseInt(line[studentIDIndex], 10, 64)
-			if err != nil {
-				return false, -1, wrapAny(
-					errBadCSVFormat,
-					fmt.Sprintf(
-						"line %d, ID is not a number; make sure that you only submit clean numbers e.g. 12345 as the student ID, don't use s12345/S12345",
-						lineNumber,
-					),
-				)
-			}
-
-			sectionID := line[sectionIDIndex]
-
-			var courseID int
-			err = tx.QueryRow(
-				ctx,
-				"INSERT INTO pre_selected(student_id, course_id) VALUES ($1, (SELECT id FROM courses WHERE section_id = $2)) RETURNING course_id",
-				studentID, sectionID,
-			).Scan(&courseID)
-			if err != nil {
-				return false, -1, fmt.Errorf("while inserting line %d: %w", lineNumber, err)
-			}
-
-			_, err = tx.Exec(
-				ctx,
-				"UPDATE courses SET forced = true WHERE id = $1",
-				courseID,
-			)
-			if err != nil {
-				return false, -1, wrapError(errors.New("unexpected database error 19"), err)
-			}
-
-			_course, ok := courses.Load(courseID)
-			if !ok {
-				return false, -1, errNoSuchCourse
-			}
-			course, ok := _course.(*courseT)
-			if !ok {
-				return false, -1, errType
-			}
-			if course == nil {
-				return false, -1, errNoSuchCourse
-			}
-
-			// atomic.AddUint32(&course.Selected, 1)
-		}
-		err = tx.Commit(ctx)
-		if err != nil {
-			return false, -1, wrapError(errors.New("unexpected database error 20"), err)
-		}
-		return true, -1, nil
-	}(req.Context())
-	if !ok {
-		return "", statusCode, err
+	err = store.replacePreSelections(
+		req.Context(),
+		getActiveTerm(),
+		userID,
+		getRemoteIP(req),
+		upload.record(len(preSelections), fileHeader.Filename),
+		preSelections,
+	)
+	if err != nil {
+		return "", -1, err
 	}
 
 	http.Redirect(w, req, "/", http.StatusSeeOther)
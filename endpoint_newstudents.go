@@ -8,16 +8,7 @@
 package main
 
 import (
-	"context"
-	"encoding/csv"
-	"errors"
-	"fmt"
-	"io"
 	"net/http"
-	"strconv"
-	"strings"
-
-	"github.com/jackc/pgx/v5"
 )
 
 func handleNewStudents(w http.ResponseWriter, req *http.Request) (string, int, error) {
@@ -25,7 +16,7 @@ func handleNewStudents(w http.ResponseWriter, req *http.Request) (string, int, e
 		return "", http.StatusMethodNotAllowed, errPostOnly
 	}
 
-	_, _, department, _, _, err := getUserInfoFromRequest(req)
+	userID, _, department, _, _, err := getUserInfoFromRequest(req)
 	if err != nil {
 		return "", -1, err
 	}
@@ -42,170 +33,25 @@ func handleNewStudents(w http.ResponseWriter, req *http.Request) (string, int, e
 		return "", http.StatusBadRequest, errNotACSV
 	}
 
-	csvReader := csv.NewReader(file)
-	titleLine, err := csvReader.Read()
+	upload := newAuditUploadReader(file)
+	students, err := readStudentsCSV(upload)
 	if err != nil {
-		return "", http.StatusBadRequest, wrapError(errCannotReadCSV, err)
-	}
-	if titleLine == nil {
-		return "", -1, errUnexpectedNilCSVLine
-	}
-	if len(titleLine) > 0 {
-		titleLine[0] = strings.TrimPrefix(titleLine[0], "\uFEFF")
+		return "", http.StatusBadRequest, err
 	}
-	if len(titleLine) != 3 {
-		return "", -1, wrapAny(
-			errBadCSVFormat,
-			"expecting 3 fields on the first line (Name, ID, Legal Sex)",
-		)
-	}
-	var nameIndex, idIndex, legalSexIndex int = -1, -1, -1
-	for i, v := range titleLine {
-		switch v {
-		case "Name":
-			nameIndex = i
-		case "ID":
-			idIndex = i
-		case "Legal Sex":
-			legalSexIndex = i
-		}
-	}
-
-	if nameIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
-			errMissingCSVColumn,
-			"Name",
-		)
-	}
-	if idIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
-			errMissingCSVColumn,
-			"ID",
-		)
-	}
-	if legalSexIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
-			errMissingCSVColumn,
-			"Legal Sex",
-		)
-	}
-
-	lineNumber := 1
-	ok, statusCode, err := func(ctx context.Context) (
-		retBool bool,
-		retStatus int,
-		retErr error,
-	) {
-		tx, err := db.Begin(ctx)
-		if err != nil {
-			return false, -1, wrapError(errors.New("unexpected database error 21"), err)
-		}
-		defer func() {
-			err := tx.Rollback(ctx)
-			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
-				retBool, retStatus, retErr = false, -1, wrapError(
-					errors.New("unexpected database error 22"),
-					err,
-				)
-				return
-			}
-		}()
-		_, err = tx.Exec(
-			ctx,
-			"DELETE FROM expected_students",
-		)
-		if err != nil {
-			return false, -1, wrapError(errors.New("unexpected database error 23"), err)
-		}
-
-		for {
-			lineNumber++
-			line, err := csvReader.Read()
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					break
-				}
-				return false, -1, wrapError(
-					errCannotReadCSV,
-					err,
-				)
-			}
-			if line == nil {
-				return false, -1, wrapError(
-					errCannotReadCSV,
-					errUnexpectedNilCSVLine,
-				)
-			}
-			if len(line) != 3 {
-				return false, -1, wrapAny(
-					errInsufficientFields,
-					fmt.Sprintf(
-						"line %d has a wrong number of items",
-						lineNumber,
-					),
-				)
-			}
 
-			id, err := strconv.ParseInt(line[idIndex], 10, 64)
-			if err != nil {
-				return false, -1, wrapAny(
-					errBadCSVFormat,
-					fmt.Sprintf(
-						"line %d, ID is not a number; make sure that you only submit clean numbers e.g. 12345 as the student ID, don't use s12345/S12345",
-						lineNumber,
-					),
-				)
-			}
-
-			name := line[nameIndex]
-			legalSex := line[legalSexIndex]
-
-			_, err = tx.Exec(
-				ctx,
-				"INSERT INTO expected_students(name, id, legal_sex) VALUES ($1, $2, $3)",
-				name, id, legalSex,
-			)
-			if err != nil {
-				return false, -1, wrapError(
-					errors.New("unexpected database error 24"),
-					err,
-				)
-			}
-		}
-		err = tx.Commit(ctx)
-		if err != nil {
-			return false, -1, wrapError(errors.New("unexpected database error 25"), err)
-		}
-		return true, -1, nil
-	}(req.Context())
-	if !ok {
-		return "", statusCode, err
+	err = store.replaceExpectedStudents(
+		req.Context(),
+		getActiveTerm(),
+		userID,
+		getRemoteIP(req),
+		upload.record(len(students), fileHeader.Filename),
+		students,
+	)
+	if err != nil {
+		return "", -1, err
 	}
 
 	http.Redirect(w, req, "/", http.StatusSeeOther)
 
 	return "", -1, nil
 }
-
-func queryNameID(ctx context.Context, query string, args ...any) (result map[int64]string, err error) {
-	result = make(map[int64]string)
-	var rows pgx.Rows
-
-	if rows, err = db.Query(ctx, query, args...); err != nil {
-		return nil, wrapError(errors.New("unexpected database error 26"), err)
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var name string
-		var id int64
-		if err = rows.Scan(&name, &id); err != nil {
-			return nil, wrapError(errors.New("unexpected database error 27"), err)
-		}
-		result[id] = name
-	}
-	if err = rows.Err(); err != nil {
-		return nil, wrapError(errors.New("unexpected database error 28"), err)
-	}
-	return result, nil
-}
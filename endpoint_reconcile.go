@@ -0,0 +1,76 @@
+/*
+ * Run the reconciler on demand
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"net/http"
+)
+
+/* Check the active term and show what was found, without changing anything */
+func handleReconcile(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, username, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	report, err := reconcile(req.Context(), false, "", "")
+	if err != nil {
+		return "", -1, err
+	}
+	return renderReconcile(w, username, report)
+}
+
+/*
+ * Check the active term and correct the member counts that have drifted,
+ * here and on every other instance
+ */
+func handleReconcileRepair(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, username, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	report, err := reconcile(req.Context(), true, userID, getRemoteIP(req))
+	if err != nil {
+		return "", -1, err
+	}
+	requestClusterReconcile(req.Context(), userID)
+	return renderReconcile(w, username, report)
+}
+
+func renderReconcile(w http.ResponseWriter, username string, report *reconcileReportT) (string, int, error) {
+	err := tmpl.ExecuteTemplate(
+		w,
+		"reconcile",
+		struct {
+			Name     string
+			Report   *reconcileReportT
+			Interval int
+			Repair   bool
+		}{
+			username,
+			report,
+			config.Perf.ReconcileInterval,
+			config.Perf.ReconcileRepair,
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
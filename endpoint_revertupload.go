@@ -0,0 +1,55 @@
+/*
+ * Revert the latest upload
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+/*
+ * Revert the upload in the "id" form field, which the staff home page shows
+ * while it is still the latest one
+ */
+func handleRevertUpload(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	if !allStatesDisabled() {
+		return "", http.StatusBadRequest, errDisableStudentAccessFirst
+	}
+
+	err = req.ParseForm()
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errMalformedForm, err)
+	}
+	id, err := strconv.ParseInt(req.PostFormValue("id"), 10, 64)
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errMalformedForm, err)
+	}
+
+	err = revertLastUpload(req.Context(), userID, getRemoteIP(req), id)
+	if errors.Is(err, errNoUploadToRevert) {
+		return "", http.StatusConflict, err
+	} else if err != nil {
+		return "", -1, err
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return "", -1, nil
+}
@@ -0,0 +1,200 @@
+/*
+ * Course rosters as printable HTML, CSV, or a ZIP archive of everything
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+/*
+ * /rosters takes an optional "course" (the internal course ID) or "teacher"
+ * parameter to narrow down the rosters shown, and "format=csv" to download
+ * them instead of viewing a printable page.
+ */
+func handleRosters(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	userID, username, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	rosters, err := getRosters(req.Context())
+	if err != nil {
+		return "", -1, err
+	}
+	teachers := getRosterTeachers(rosters)
+	/* Left empty if calendar feeds are disabled */
+	var teacherCalendars map[string]string
+	if haveTermDates() {
+		calendarToken, err := getCalendarToken(req.Context(), userID)
+		if err != nil {
+			return "", -1, err
+		}
+		teacherCalendars = make(map[string]string, len(teachers))
+		for _, teacher := range teachers {
+			teacherCalendars[teacher] = calendarTeacherURL(calendarToken, teacher)
+		}
+	}
+
+	query := req.URL.Query()
+	selected, name, statusCode, err := selectRosters(rosters, query)
+	if err != nil {
+		return "", statusCode, err
+	}
+	filename := "cca_rosters"
+	if name != "" {
+		filename += "_" + name
+	}
+
+	if query.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set(
+			"Content-Disposition",
+			"attachment;filename*=UTF-8''"+url.PathEscape(filename+".csv"),
+		)
+		_, err = w.Write([]byte{0xEF, 0xBB, 0xBF}) // utf8 bom for excel
+		if err != nil {
+			return "", -1, wrapError(errHTTPWrite, err)
+		}
+		err = writeRostersCSV(w, selected)
+		if err != nil {
+			return "", -1, wrapError(errHTTPWrite, err)
+		}
+		return "", -1, nil
+	}
+
+	var attendanceURL string
+	if haveTermDates() {
+		attendanceURL = "./attendance?" + query.Encode()
+	}
+	query.Set("format", "csv")
+	err = tmpl.ExecuteTemplate(
+		w,
+		"rosters",
+		struct {
+			Name             string
+			Rosters          []rosterT
+			Teachers         []string
+			All              []rosterT
+			CSVURL           string
+			AttendanceURL    string
+			TeacherCalendars map[string]string
+		}{
+			username,
+			selected,
+			teachers,
+			rosters,
+			"./rosters?" + query.Encode(),
+			attendanceURL,
+			teacherCalendars,
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
+
+/*
+ * Narrow down rosters by the "course" or "teacher" query parameter. The name
+ * returned is suitable for use in file names, and is empty if every roster
+ * is selected.
+ */
+func selectRosters(rosters []rosterT, query url.Values) ([]rosterT, string, int, error) {
+	if courseIDStr := query.Get("course"); courseIDStr != "" {
+		courseID, err := strconv.Atoi(courseIDStr)
+		if err != nil {
+			return nil, "", http.StatusBadRequest, wrapError(errInvalidCourseID, err)
+		}
+		for _, roster := range rosters {
+			if roster.Course.ID == courseID {
+				return []rosterT{roster}, rosterCourseFilename(roster.Course), -1, nil
+			}
+		}
+		return nil, "", http.StatusNotFound, wrapAny(errNoSuchCourse, courseID)
+	}
+	if teacher := query.Get("teacher"); teacher != "" {
+		selected := filterRostersByTeacher(rosters, teacher)
+		if selected == nil {
+			return nil, "", http.StatusNotFound, wrapAny(errNoSuchTeacher, teacher)
+		}
+		return selected, sanitizeFilename(teacher), -1, nil
+	}
+	return rosters, "", -1, nil
+}
+
+/*
+ * /rosters/zip contains a CSV for each course under courses/ and one for each
+ * teacher under teachers/.
+ */
+func handleRostersZip(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	_, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	rosters, err := getRosters(req.Context())
+	if err != nil {
+		return "", -1, err
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set(
+		"Content-Disposition",
+		"attachment;filename=cca_rosters.zip",
+	)
+	zw := zip.NewWriter(w)
+	writeFile := func(name string, rosters []rosterT) error {
+		fw, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write([]byte{0xEF, 0xBB, 0xBF}) // utf8 bom for excel
+		if err != nil {
+			return err
+		}
+		return writeRostersCSV(fw, rosters)
+	}
+	for _, roster := range rosters {
+		err := writeFile(
+			"courses/"+rosterCourseFilename(roster.Course)+".csv",
+			[]rosterT{roster},
+		)
+		if err != nil {
+			return "", -1, wrapError(errHTTPWrite, err)
+		}
+	}
+	for _, teacher := range getRosterTeachers(rosters) {
+		err := writeFile(
+			"teachers/"+sanitizeFilename(teacher)+".csv",
+			filterRostersByTeacher(rosters, teacher),
+		)
+		if err != nil {
+			return "", -1, wrapError(errHTTPWrite, err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return "", -1, wrapError(errHTTPWrite, err)
+	}
+	return "", -1, nil
+}
@@ -0,0 +1,156 @@
+/*
+ * Create, switch and browse terms
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * /terms lists every term and shows the courses of the one given by the
+ * "term" parameter, defaulting to the active term. Terms other than the
+ * active one are read-only, but may still be exported.
+ */
+func handleTerms(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, username, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	term, err := parseTerm(req.URL.Query().Get("term"))
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	terms, err := store.getTerms(req.Context())
+	if err != nil {
+		return "", -1, err
+	}
+	var viewing *termT
+	for i := range terms {
+		if terms[i].ID == term {
+			viewing = &terms[i]
+		}
+	}
+	if viewing == nil {
+		return "", http.StatusNotFound, wrapAny(errNoSuchTerm, term)
+	}
+	termCourses, err := getTermCourses(req.Context(), term)
+	if err != nil {
+		return "", -1, err
+	}
+
+	err = tmpl.ExecuteTemplate(
+		w,
+		"terms",
+		struct {
+			Name      string
+			Terms     []termT
+			Active    int64
+			Viewing   *termT
+			Courses   []*courseT
+			CanSwitch bool
+		}{
+			username,
+			terms,
+			getActiveTerm(),
+			viewing,
+			termCourses,
+			allStatesDisabled(),
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
+
+/*
+ * Create a term from the "name" form field, copying the courses of the term
+ * in "copy" unless it is empty. The new term is not made active.
+ */
+func handleNewTerm(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	err = req.ParseForm()
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errMalformedForm, err)
+	}
+
+	name := strings.TrimSpace(req.PostFormValue("name"))
+	if name == "" {
+		return "", http.StatusBadRequest, errEmptyTermName
+	}
+	var copyFrom int64
+	if s := req.PostFormValue("copy"); s != "" {
+		copyFrom, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return "", http.StatusBadRequest, wrapAny(errInvalidTerm, s)
+		}
+	}
+
+	term, err := store.createTerm(req.Context(), userID, getRemoteIP(req), name, copyFrom)
+	if errors.Is(err, errTermExists) || errors.Is(err, errNoSuchTerm) {
+		return "", http.StatusBadRequest, err
+	} else if err != nil {
+		return "", -1, err
+	}
+
+	http.Redirect(w, req, "/terms?term="+strconv.FormatInt(term, 10), http.StatusSeeOther)
+	return "", -1, nil
+}
+
+/* Make the term in the "term" form field the active one */
+func handleActivateTerm(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	err = req.ParseForm()
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errMalformedForm, err)
+	}
+	s := req.PostFormValue("term")
+	term, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return "", http.StatusBadRequest, wrapAny(errInvalidTerm, s)
+	}
+
+	err = switchTerm(req.Context(), userID, getRemoteIP(req), term)
+	if errors.Is(err, errDisableStudentAccessFirst) || errors.Is(err, errNoSuchTerm) {
+		return "", http.StatusBadRequest, err
+	} else if err != nil {
+		return "", -1, err
+	}
+
+	http.Redirect(w, req, "/terms", http.StatusSeeOther)
+	return "", -1, nil
+}
@@ -8,6 +8,7 @@
 package main
 
 import (
+	"errors"
 	"log/slog"
 	"net/http"
 	"sync/atomic"
@@ -54,6 +55,19 @@ func handleWs(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if department == staffDepartment {
+		err = handleStaffConn(req.Context(), c, userID)
+		if err != nil {
+			slog.Error(
+				"websocket",
+				"user", userID,
+				"error", err,
+			)
+			_ = writeText(req.Context(), c, "E :"+err.Error())
+		}
+		return
+	}
+
 	_state, ok := states[department]
 	if !ok {
 		_ = writeText(req.Context(), c, "E :"+
@@ -66,13 +80,30 @@ func handleWs(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = handleConn(req.Context(), c, userID, department, legalSex)
+	err = handleConn(
+		req.Context(),
+		c,
+		userID,
+		department,
+		legalSex,
+		getRemoteIP(req),
+	)
 	if err != nil {
 		slog.Error(
 			"websocket",
 			"user", userID,
 			"error", err,
 		)
+		/*
+		 * Clients going away is business as usual and not worth
+		 * showing on the staff dashboard.
+		 */
+		if !errors.Is(err, errCannotReceiveMessage) &&
+			!errors.Is(err, errWsHandlerContextCanceled) &&
+			!errors.Is(err, errIdleTimeout) &&
+			!errors.Is(err, errHeartbeatFailed) {
+			recordError(req.URL.Path, err)
+		}
 		_ = writeText(req.Context(), c, "E :"+err.Error())
 		return
 	}
@@ -65,7 +65,43 @@ var (
 	errInvalidYearGroupOrCourseType     = errors.New("invalid year group or course type (something is broken)")
 	errYearGroupSpecString              = errors.New("invalid year group specification string")
 	errNotForYourYearGroup              = errors.New("this course is not part of your year group")
-	// errInvalidCourseID                  = errors.New("invalid course id")
+	errIdleTimeout                      = errors.New("connection closed after being idle for too long")
+	errNoSuchAnnouncement               = errors.New("no such announcement")
+	errEmptyAnnouncement                = errors.New("announcements must not be empty")
+	errAnnouncementTooLong              = errors.New("announcement is too long")
+	errHeartbeatFailed                  = errors.New("connection closed as the client stopped responding to heartbeats")
+	errInvalidCourseID                  = errors.New("invalid course id")
+	errNoSuchTeacher                    = errors.New("no such teacher")
+	errInvalidExportFilter              = errors.New("invalid export filter")
+	errNoSuchExportProfile              = errors.New("no such export profile")
+	errNoSuchCalendar                   = errors.New("no such calendar")
+	errNoTermDates                      = errors.New("attendance sheets and calendar feeds are disabled, as the term block is missing from the configuration")
+	errAuditMarshal                     = errors.New("cannot marshal audit values")
+	errInvalidAuditFilter               = errors.New("invalid audit log filter")
+	errBadMigrations                    = errors.New("bad embedded migrations")
+	errDatabaseTooNew                   = errors.New("database has migrations unknown to this version")
+	errUnknownSubcommand                = errors.New("unknown subcommand")
+	errBadSubcommandArgs                = errors.New("bad subcommand arguments")
+	errUnknownDatabaseType              = errors.New("db.type must be \"postgres\" or \"sqlite\"")
+	errUnknownSection                   = errors.New("no course with this section ID")
+	errInvalidCourseMax                 = errors.New("invalid course capacity")
+	errNoSuchTerm                       = errors.New("no such term")
+	errInvalidTerm                      = errors.New("invalid term")
+	errTermExists                       = errors.New("a term with this name already exists")
+	errEmptyTermName                    = errors.New("terms must have a name")
+	errCountDrift                       = errors.New("courses whose member counts differ from the database")
+	errStateChanged                     = errors.New("the state was changed elsewhere in the meantime; reload and try again")
+	errBadClusterMessage                = errors.New("bad message from another instance")
+	errBadBackup                        = errors.New("bad backup")
+	errBackupTooNew                     = errors.New("backup was made by a newer version")
+	errBackupTooLarge                   = errors.New("backup is too large")
+	errCannotWriteBackup                = errors.New("cannot write backup")
+	errNoUploadToRevert                 = errors.New("there is no recent upload to revert, or another upload was made since")
+	errUnknownTable                     = errors.New("unknown table")
+	errCannotWriteExport                = errors.New("cannot write export")
+	errInvalidConfigValue               = errors.New("invalid configuration value")
+	errUnknownConfigKey                 = errors.New("unknown configuration directive")
+	errDuplicateConfigKey               = errors.New("configuration directive given more than once")
 )
 
 func wrapError(a, b error) error {
@@ -0,0 +1,195 @@
+/*
+ * Data shared by the various exports
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type choiceRowT struct {
+	UserID     string
+	Name       string
+	StudentID  string
+	Department string
+	CourseID   int
+	Forced     bool
+	SelTime    time.Time
+}
+
+type studentRowT struct {
+	Name       string
+	StudentID  string
+	Department string
+}
+
+type expectedStudentT struct {
+	ID       int64
+	Name     string
+	LegalSex string
+}
+
+/* Expected students of a term who have never logged in, ordered by ID */
+func getNeverLoggedIn(ctx context.Context, term int64) ([]expectedStudentT, error) {
+	students, err := store.getExpectedStudents(ctx, term)
+	if err != nil {
+		return nil, err
+	}
+	users, err := store.getUsers(ctx, term)
+	if err != nil {
+		return nil, err
+	}
+	loggedIn := make(map[int64]struct{}, len(users))
+	for _, user := range users {
+		id, err := strconv.ParseInt(studentIDFromEmail(user.Email), 10, 64)
+		if err == nil {
+			loggedIn[id] = struct{}{}
+		}
+	}
+
+	result := make([]expectedStudentT, 0, len(students))
+	for _, s := range students {
+		if _, ok := loggedIn[s.ID]; !ok {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+/* Courses ordered by ID */
+func getSortedCourses() ([]*courseT, error) {
+	var result []*courseT
+	var err error
+	courses.Range(func(_, value interface{}) bool {
+		course, ok := value.(*courseT)
+		if !ok {
+			err = errType
+			return false
+		}
+		result = append(result, course)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+/*
+ * Stream the choices matching a filter in the format of an export profile
+ * to the writer returned by start, which is only called once the query has
+ * succeeded, so that database errors could still be reported properly.
+ */
+func writeChoicesExport(
+	ctx context.Context,
+	filter exportFilterT,
+	profile exportProfileT,
+	start func() (io.Writer, error),
+) error {
+	var exportWriter exportWriterT
+	begin := func() error {
+		w, err := start()
+		if err != nil {
+			return err
+		}
+		exportWriter, err = newExportWriter(w, profile)
+		if err != nil {
+			return wrapError(errCannotWriteExport, err)
+		}
+		return nil
+	}
+	dangling, err := store.streamChoices(
+		ctx,
+		filter,
+		func(c *exportChoiceT) error {
+			if exportWriter == nil {
+				err := begin()
+				if err != nil {
+					return err
+				}
+			}
+			err := exportWriter.write(profile.record(c))
+			if err != nil {
+				return wrapError(errCannotWriteExport, err)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if exportWriter == nil {
+		err = begin()
+		if err != nil {
+			return err
+		}
+	}
+	err = exportWriter.finish(dangling)
+	if err != nil {
+		return wrapError(errCannotWriteExport, err)
+	}
+	return nil
+}
+
+/* Stream the students matching a filter to w as CSV */
+func writeStudentsExport(ctx context.Context, w io.Writer, filter exportFilterT) error {
+	_, err := w.Write([]byte{0xEF, 0xBB, 0xBF}) // utf8 bom for excel
+	if err != nil {
+		return wrapError(errCannotWriteExport, err)
+	}
+	csvWriter := csv.NewWriter(w)
+	err = csvWriter.Write([]string{
+		"Student Name",
+		"Student ID",
+		"Grade/Year",
+		"Confirmed",
+	})
+	if err != nil {
+		return wrapError(errCannotWriteExport, err)
+	}
+
+	err = store.streamStudents(ctx, filter, func(student *exportStudentT) error {
+		var record []string
+		if student.Name != nil {
+			record = []string{
+				*student.Name,
+				*student.Email,
+				*student.Department,
+				strconv.FormatBool(*student.Confirmed),
+			}
+		} else {
+			record = []string{
+				*student.ExpectedName,
+				"s" + strconv.FormatInt(*student.ExpectedID, 10) + "@ykpaoschool.cn",
+				"Unknown",
+				"never logged in",
+			}
+		}
+		err := csvWriter.Write(record)
+		if err != nil {
+			return wrapError(errCannotWriteExport, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return wrapError(errCannotWriteExport, err)
+	}
+	return nil
+}
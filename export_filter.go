@@ -0,0 +1,167 @@
+/*
+ * Filters for exports
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Exports accept the following query parameters, all optional:
+ *
+ *    term       ID of the term to export, defaulting to the active one
+ *    yeargroup  year groups of students, may be repeated
+ *    type       course types, may be repeated
+ *    group      course groups, may be repeated
+ *    section    section IDs, may be repeated
+ *    confirmed  "true" or "false"
+ *    from, to   selection time range, as YYYY-MM-DDTHH:MM in local time,
+ *               with "from" inclusive and "to" exclusive
+ *
+ * Repeated parameters match any of their values, while different parameters
+ * must all match. In student exports, course-related filters select students
+ * with at least one matching choice.
+ */
+type exportFilterT struct {
+	Term       int64
+	YearGroups []string
+	Types      []string
+	Groups     []string
+	Sections   []string
+	Confirmed  *bool
+	From       *time.Time
+	To         *time.Time
+}
+
+func nonEmptyValues(query url.Values, key string) []string {
+	var result []string
+	for _, v := range query[key] {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func parseExportFilter(query url.Values) (exportFilterT, error) {
+	var f exportFilterT
+
+	var err error
+	f.Term, err = parseTerm(query.Get("term"))
+	if err != nil {
+		return f, err
+	}
+
+	f.YearGroups = nonEmptyValues(query, "yeargroup")
+	for _, yeargroup := range f.YearGroups {
+		if _, ok := yearGroupsNumberBits[yeargroup]; !ok {
+			return f, wrapAny(errNoSuchYearGroup, yeargroup)
+		}
+	}
+
+	f.Types = nonEmptyValues(query, "type")
+	for _, courseType := range f.Types {
+		if !checkCourseType(courseType) {
+			return f, wrapAny(errInvalidCourseType, courseType)
+		}
+	}
+
+	f.Groups = nonEmptyValues(query, "group")
+	for _, group := range f.Groups {
+		if !checkCourseGroup(group) {
+			return f, wrapAny(errInvalidCourseGroup, group)
+		}
+	}
+
+	f.Sections = nonEmptyValues(query, "section")
+
+	if s := query.Get("confirmed"); s != "" {
+		confirmed, err := strconv.ParseBool(s)
+		if err != nil {
+			return f, wrapError(errInvalidExportFilter, err)
+		}
+		f.Confirmed = &confirmed
+	}
+
+	for _, bound := range []struct {
+		key string
+		dst **time.Time
+	}{
+		{"from", &f.From},
+		{"to", &f.To},
+	} {
+		s := query.Get(bound.key)
+		if s == "" {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02T15:04", s, loc)
+		if err != nil {
+			return f, wrapError(errInvalidExportFilter, err)
+		}
+		*bound.dst = &t
+	}
+
+	return f, nil
+}
+
+type sqlArgsT []any
+
+/* Append an argument and return its placeholder */
+func (args *sqlArgsT) add(v any) string {
+	*args = append(*args, v)
+	return "$" + strconv.Itoa(len(*args))
+}
+
+/* Append each value as an argument and return a parenthesized list */
+func (args *sqlArgsT) addList(values []string) string {
+	placeholders := make([]string, len(values))
+	for i, v := range values {
+		placeholders[i] = args.add(v)
+	}
+	return "(" + strings.Join(placeholders, ", ") + ")"
+}
+
+/* Conditions on the users table, aliased as u */
+func (f exportFilterT) userConditions(args *sqlArgsT) []string {
+	var conds []string
+	if len(f.YearGroups) != 0 {
+		conds = append(conds, "u.department IN "+args.addList(f.YearGroups))
+	}
+	if f.Confirmed != nil {
+		cond := "EXISTS (SELECT 1 FROM confirmations cf WHERE cf.userid = u.id AND cf.term = " + args.add(f.Term) + ")"
+		if !*f.Confirmed {
+			cond = "NOT " + cond
+		}
+		conds = append(conds, cond)
+	}
+	return conds
+}
+
+/* Conditions on the choices and courses tables, aliased as c and co */
+func (f exportFilterT) choiceConditions(args *sqlArgsT) []string {
+	var conds []string
+	if len(f.Types) != 0 {
+		conds = append(conds, "co.ctype IN "+args.addList(f.Types))
+	}
+	if len(f.Groups) != 0 {
+		conds = append(conds, "co.cgroup IN "+args.addList(f.Groups))
+	}
+	if len(f.Sections) != 0 {
+		conds = append(conds, "co.section_id IN "+args.addList(f.Sections))
+	}
+	if f.From != nil {
+		conds = append(conds, "c.seltime >= "+args.add(f.From.UnixMicro()))
+	}
+	if f.To != nil {
+		conds = append(conds, "c.seltime < "+args.add(f.To.UnixMicro()))
+	}
+	return conds
+}
@@ -0,0 +1,335 @@
+/*
+ * Export profiles for student information systems
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * An export profile describes how choices are written out: the file format,
+ * which fields go into which columns under which headers, how values are
+ * rewritten, and how the downloaded file is named. Besides the built-in
+ * profiles below, more may be defined with export_profile blocks in the
+ * configuration file.
+ */
+
+type exportColumnT struct {
+	Field  string
+	Header string
+	/* If set, every row gets this value instead of the field's */
+	Value *string
+	/* Values found here are replaced, after formatting */
+	Map map[string]string
+}
+
+type exportProfileT struct {
+	Name   string
+	Format string /* "csv" or "json" */
+	/*
+	 * {profile}, {date} and {time} are replaced with the profile name,
+	 * the current date as YYYY-MM-DD and the current time as HHMMSS.
+	 */
+	Filename   string
+	TimeFormat string /* Go time layout */
+	BOM        bool
+	Columns    []exportColumnT
+}
+
+type exportChoiceT struct {
+	UserID     string
+	CourseID   int
+	Name       string
+	Email      string
+	Department string
+	Confirmed  bool
+	Title      string
+	Teacher    string
+	Location   string
+	Type       string
+	Group      string
+	SectionID  string
+	CourseCode string
+	Forced     bool
+	SelTime    time.Time
+}
+
+var exportFields = map[string]func(c *exportChoiceT, timeFormat string) string{
+	"student_name": func(c *exportChoiceT, _ string) string { return c.Name },
+	"student_id":   func(c *exportChoiceT, _ string) string { return studentIDFromEmail(c.Email) },
+	"email":        func(c *exportChoiceT, _ string) string { return c.Email },
+	"year_group":   func(c *exportChoiceT, _ string) string { return c.Department },
+	"confirmed":    func(c *exportChoiceT, _ string) string { return strconv.FormatBool(c.Confirmed) },
+	"course_title": func(c *exportChoiceT, _ string) string { return c.Title },
+	"teacher":      func(c *exportChoiceT, _ string) string { return c.Teacher },
+	"location":     func(c *exportChoiceT, _ string) string { return c.Location },
+	"course_type":  func(c *exportChoiceT, _ string) string { return c.Type },
+	"course_group": func(c *exportChoiceT, _ string) string { return c.Group },
+	"course_group_name": func(c *exportChoiceT, _ string) string {
+		return courseGroups[c.Group]
+	},
+	"section_id":         func(c *exportChoiceT, _ string) string { return c.SectionID },
+	"course_id":          func(c *exportChoiceT, _ string) string { return c.CourseCode },
+	"internal_course_id": func(c *exportChoiceT, _ string) string { return strconv.Itoa(c.CourseID) },
+	"forced":             func(c *exportChoiceT, _ string) string { return strconv.FormatBool(c.Forced) },
+	"selection_time": func(c *exportChoiceT, timeFormat string) string {
+		return c.SelTime.In(loc).Format(timeFormat)
+	},
+}
+
+/* Columns for the generic profiles, covering every field */
+var exportGenericColumns = []exportColumnT{
+	{"student_name", "Student Name", nil, nil},
+	{"student_id", "Student ID", nil, nil},
+	{"email", "Email", nil, nil},
+	{"year_group", "Year Group", nil, nil},
+	{"confirmed", "Confirmed", nil, nil},
+	{"course_title", "Course Title", nil, nil},
+	{"teacher", "Teacher", nil, nil},
+	{"location", "Location", nil, nil},
+	{"course_type", "Course Type", nil, nil},
+	{"course_group", "Course Group", nil, nil},
+	{"section_id", "Section ID", nil, nil},
+	{"course_id", "Course ID", nil, nil},
+	{"internal_course_id", "Internal Course ID", nil, nil},
+	{"forced", "Forced", nil, nil},
+	{"selection_time", "Selection Time", nil, nil},
+}
+
+const defaultExportProfile = "default"
+
+var builtinExportProfiles = []exportProfileT{
+	{
+		/* The original format of /export/choices */
+		Name:       defaultExportProfile,
+		Format:     "csv",
+		Filename:   "cca_choices.csv",
+		TimeFormat: time.RFC3339,
+		BOM:        true,
+		Columns: []exportColumnT{
+			{"student_name", "Student Name", nil, nil},
+			{"student_id", "Student ID", nil, nil},
+			{"year_group", "Grade/Year", nil, nil},
+			{"course_title", "Group/Activity", nil, nil},
+			{"course_group", "Container", nil, nil},
+			{"section_id", "Section ID", nil, nil},
+			{"course_id", "Course ID", nil, nil},
+		},
+	},
+	{
+		Name:       "generic_csv",
+		Format:     "csv",
+		Filename:   "cca_choices_{date}.csv",
+		TimeFormat: time.RFC3339,
+		BOM:        true,
+		Columns:    exportGenericColumns,
+	},
+	{
+		Name:       "generic_json",
+		Format:     "json",
+		Filename:   "cca_choices_{date}.json",
+		TimeFormat: time.RFC3339,
+		BOM:        false,
+		Columns:    exportGenericColumns,
+	},
+}
+
+/* Built-in profiles followed by configured ones, in a stable order */
+func getExportProfiles() []exportProfileT {
+	return append(append([]exportProfileT(nil), builtinExportProfiles...), config.ExportProfiles...)
+}
+
+func getExportProfile(name string) (exportProfileT, bool) {
+	for _, profile := range getExportProfiles() {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return exportProfileT{}, false //exhaustruct:ignore
+}
+
+/* The profile in the "profile" query parameter, by default the original one */
+func parseExportProfile(query url.Values) (exportProfileT, error) {
+	name := query.Get("profile")
+	if name == "" {
+		name = defaultExportProfile
+	}
+	profile, ok := getExportProfile(name)
+	if !ok {
+		return profile, wrapAny(errNoSuchExportProfile, name)
+	}
+	return profile, nil
+}
+
+func getExportProfileNames() []string {
+	profiles := getExportProfiles()
+	names := make([]string, 0, len(profiles))
+	for _, profile := range profiles {
+		names = append(names, profile.Name)
+	}
+	return names
+}
+
+func (profile exportProfileT) filename(now time.Time) string {
+	now = now.In(loc)
+	return sanitizeFilename(strings.NewReplacer(
+		"{profile}", profile.Name,
+		"{date}", now.Format(time.DateOnly),
+		"{time}", now.Format("150405"),
+	).Replace(profile.Filename))
+}
+
+func (profile exportProfileT) contentType() string {
+	if profile.Format == "json" {
+		return "application/json; charset=utf-8"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+func (profile exportProfileT) record(c *exportChoiceT) []string {
+	record := make([]string, len(profile.Columns))
+	for i, column := range profile.Columns {
+		if column.Value != nil {
+			record[i] = *column.Value
+			continue
+		}
+		record[i] = exportFields[column.Field](c, profile.TimeFormat)
+		if mapped, ok := column.Map[record[i]]; ok {
+			record[i] = mapped
+		}
+	}
+	return record
+}
+
+type danglingChoiceT struct {
+	UserID   string `json:"user_id"`
+	CourseID int    `json:"course_id"`
+	Problem  string `json:"problem"`
+}
+
+/*
+ * Writers stream records in a profile's format. CSV output ends with a
+ * trailer section listing dangling references after a blank line, while
+ * JSON output is an object with "records" and "dangling" arrays, each
+ * record being an object keyed by column headers in column order.
+ */
+type exportWriterT interface {
+	write(record []string) error
+	finish(dangling []danglingChoiceT) error
+}
+
+func newExportWriter(w io.Writer, profile exportProfileT) (exportWriterT, error) {
+	if profile.BOM {
+		_, err := w.Write([]byte{0xEF, 0xBB, 0xBF}) // utf8 bom because excel
+		if err != nil {
+			return nil, err
+		}
+	}
+	headers := make([]string, len(profile.Columns))
+	for i, column := range profile.Columns {
+		headers[i] = column.Header
+	}
+	if profile.Format == "json" {
+		_, err := io.WriteString(w, `{"records":[`)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonExportWriterT{w: w, headers: headers, first: true}, nil
+	}
+	csvWriter := csv.NewWriter(w)
+	err := csvWriter.Write(headers)
+	if err != nil {
+		return nil, err
+	}
+	return &csvExportWriterT{csvWriter}, nil
+}
+
+type csvExportWriterT struct {
+	w *csv.Writer
+}
+
+func (cw *csvExportWriterT) write(record []string) error {
+	return cw.w.Write(record)
+}
+
+func (cw *csvExportWriterT) finish(dangling []danglingChoiceT) error {
+	if len(dangling) != 0 {
+		err := cw.w.WriteAll([][]string{
+			{},
+			{"Dangling references"},
+			{"User ID", "Course ID", "Problem"},
+		})
+		if err != nil {
+			return err
+		}
+		for _, d := range dangling {
+			err := cw.w.Write([]string{
+				d.UserID,
+				strconv.Itoa(d.CourseID),
+				d.Problem,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type jsonExportWriterT struct {
+	w       io.Writer
+	headers []string
+	first   bool
+}
+
+func (jw *jsonExportWriterT) write(record []string) error {
+	var sb strings.Builder
+	if !jw.first {
+		sb.WriteByte(',')
+	}
+	jw.first = false
+	sb.WriteByte('{')
+	for i, header := range jw.headers {
+		if i != 0 {
+			sb.WriteByte(',')
+		}
+		k, err := json.Marshal(header)
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(record[i])
+		if err != nil {
+			return err
+		}
+		sb.Write(k)
+		sb.WriteByte(':')
+		sb.Write(v)
+	}
+	sb.WriteByte('}')
+	_, err := io.WriteString(jw.w, sb.String())
+	return err
+}
+
+func (jw *jsonExportWriterT) finish(dangling []danglingChoiceT) error {
+	if dangling == nil {
+		dangling = []danglingChoiceT{}
+	}
+	d, err := json.Marshal(dangling)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(jw.w, `],"dangling":`+string(d)+"}\n")
+	return err
+}
@@ -153,7 +153,57 @@ function setup_socket_handlers(): void {
 		toggle_elements(DOM_STATES.need_connection, false);
 		toggle_elements(DOM_STATES.broken_connection, true);
 	});
-	socket.send('HELLO');
+}
+
+function handle_snapshot_message(state: string, confirmed: string, requirements: string, course_list: string, choice_list = ''): void {
+	requirements.split(',').forEach(requirement => {
+		if (!requirement) {
+			return;
+		}
+		const [course_type, minimum] = requirement.split('=');
+		const required_element = document.getElementById(`${course_type}-required`);
+		if (required_element) {
+			required_element.textContent = minimum;
+		}
+	});
+
+	course_list.split(',').forEach(course => {
+		if (!course) {
+			return;
+		}
+		const [course_id, selected, max] = course.split(':');
+		const selected_element = document.getElementById(`selected${course_id}`);
+		const max_element = document.getElementById(`max${course_id}`);
+		if (selected_element) {
+			selected_element.textContent = selected;
+		}
+		if (max_element) {
+			max_element.textContent = max;
+		}
+	});
+
+	document.querySelectorAll('.coursecheckbox').forEach(chk => {
+		const checkbox = chk as HTMLInputElement;
+		checkbox.checked = false;
+		checkbox.indeterminate = false;
+	});
+	document.querySelectorAll('[id$="-chosen"]').forEach(counter => {
+		counter.textContent = '0';
+	});
+
+	if (state === 'START') {
+		handle_start_state();
+	} else {
+		handle_stop_state();
+	}
+
+	if (confirmed === 'YC') {
+		handle_confirmation_state();
+	} else {
+		handle_unconfirmation_state();
+	}
+
+	handle_hi_message(choice_list);
 }
 
 function handle_hi_message(course_list = ''): void {
@@ -175,6 +225,30 @@ function handle_hi_message(course_list = ''): void {
 	}
 }
 
+function handle_announcement(id: string, created: string, body: string): void {
+	handle_announcement_deletion(id);
+
+	const container = document.getElementById('announcements')!;
+	const announcement = document.createElement('div');
+	announcement.id = `announcement${id}`;
+	announcement.className = 'announcement message-box';
+
+	const time = document.createElement('p');
+	time.className = 'announcement-time';
+	time.textContent = new Date(parseInt(created) * 1000).toLocaleString();
+
+	const text = document.createElement('p');
+	text.className = 'announcement-body';
+	text.textContent = body;
+
+	announcement.append(time, text);
+	container.prepend(announcement);
+}
+
+function handle_announcement_deletion(id: string): void {
+	document.getElementById(`announcement${id}`)?.remove();
+}
+
 function handle_course_removal(course_id: string): void {
 	const checkbox = document.getElementById(`tick${course_id}`) as HTMLInputElement;
 	checkbox.checked = false;
@@ -293,10 +367,17 @@ function handle_socket_message(event: MessageEvent): void {
 
 	const message_handlers: Record<string, () => void> = {
 		'E': () => alert(args[0]),
+		'A': () => handle_announcement(args[0], args[1], args[2]),
+		'AD': () => handle_announcement_deletion(args[0]),
 		'HI': () => handle_hi_message(...args),
+		'SNAP': () => handle_snapshot_message(args[0], args[1], args[2], args[3], args[4]),
 		'U': () => alert('Your session is broken or has expired. You are unauthenticated and the server will reject your commands.'),
 		'N': () => handle_course_removal(args[0]),
-		'M': () => handle_course_max_update(args[0], args[1]),
+		'M': () => {
+			for (let i = 0; i + 1 < args.length; i += 2) {
+				handle_course_max_update(args[i], args[i + 1]);
+			}
+		},
 		'R': () => handle_course_rejection(args[0], args[1]),
 		'RU': () => handle_course_unconfirm_rejection(args[0], args[1]),
 		'Y': () => handle_course_approval(args[0]),
@@ -0,0 +1,444 @@
+/*
+ * Read and apply uploaded course, student and forced association lists
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+ * The lists are read the same way whether they were uploaded by staff or
+ * given to a subcommand, see commands.go. Errors from reading them are the
+ * uploader's fault.
+ */
+
+/*
+ * Read a course list with the columns Title, Max, Teacher, Location, Type,
+ * Group, Section ID, Course ID, Year Groups and Legal Sex Requirements, in
+ * any order.
+ */
+func readCoursesCSV(r io.Reader) ([]*courseT, error) {
+	csvReader := csv.NewReader(r)
+	titleLine, err := csvReader.Read()
+	if err != nil {
+		return nil, wrapError(errCannotReadCSV, err)
+	}
+	if titleLine == nil {
+		return nil, errUnexpectedNilCSVLine
+	}
+	if len(titleLine) > 0 {
+		titleLine[0] = strings.TrimPrefix(titleLine[0], "\uFEFF")
+	}
+	if len(titleLine) != 10 {
+		return nil, wrapAny(
+			errBadCSVFormat,
+			"expecting 10 fields on the first line",
+		)
+	}
+	var titleIndex, maxIndex, teacherIndex, locationIndex,
+		typeIndex, groupIndex, sectionIDIndex,
+		courseIDIndex, yearGroupsIndex, legalSexIndex int = -1, -1, -1, -1, -1, -1, -1, -1, -1, -1
+	for i, v := range titleLine {
+		switch v {
+		case "Title":
+			titleIndex = i
+		case "Max":
+			maxIndex = i
+		case "Teacher":
+			teacherIndex = i
+		case "Location":
+			locationIndex = i
+		case "Type":
+			typeIndex = i
+		case "Group":
+			groupIndex = i
+		case "Section ID":
+			sectionIDIndex = i
+		case "Course ID":
+			courseIDIndex = i
+		case "Year Groups":
+			yearGroupsIndex = i
+		case "Legal Sex Requirements":
+			legalSexIndex = i
+		default:
+			return nil, wrapAny(
+				errBadCSVFormat,
+				fmt.Sprintf(
+					"unexpected field \"%s\" on the first line",
+					v,
+				),
+			)
+		}
+	}
+
+	if titleIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Title",
+		)
+	}
+	if maxIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Max",
+		)
+	}
+	if teacherIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Teacher",
+		)
+	}
+	if locationIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Location",
+		)
+	}
+	if typeIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Type",
+		)
+	}
+	if groupIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Group",
+		)
+	}
+	if courseIDIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Course ID",
+		)
+	}
+	if sectionIDIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Section ID",
+		)
+	}
+	if yearGroupsIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Year Groups",
+		)
+	}
+
+	var newCourses []*courseT
+	for lineNumber := 2; ; lineNumber++ {
+		line, err := csvReader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, wrapError(
+				errCannotReadCSV,
+				err,
+			)
+		}
+		if line == nil {
+			return nil, wrapError(
+				errCannotReadCSV,
+				errUnexpectedNilCSVLine,
+			)
+		}
+		if len(line) != 10 {
+			return nil, wrapAny(
+				errInsufficientFields,
+				fmt.Sprintf(
+					"line %d has a wrong number of items",
+					lineNumber,
+				),
+			)
+		}
+		if !checkCourseType(line[typeIndex]) {
+			return nil, wrapAny(errInvalidCourseType,
+				fmt.Sprintf(
+					"line %d has invalid course type \"%s\"\nallowed course types: %s",
+					lineNumber,
+					line[typeIndex],
+					strings.Join(
+						getKeysOfMap(courseTypes),
+						", ",
+					),
+				),
+			)
+		}
+		if !checkCourseGroup(line[groupIndex]) {
+			return nil, wrapAny(errInvalidCourseGroup,
+				fmt.Sprintf(
+					"line %d has invalid course group \"%s\"\nallowed course groups: %s",
+					lineNumber,
+					line[groupIndex],
+					strings.Join(
+						getKeysOfMap(courseGroups),
+						", ",
+					),
+				),
+			)
+		}
+		yearGroupsSpec, err := yearGroupsStringToNumber(line[yearGroupsIndex])
+		if err != nil {
+			return nil, err
+		}
+		courseMax, err := strconv.ParseUint(line[maxIndex], 10, 32)
+		if err != nil {
+			return nil, wrapAny(
+				errInvalidCourseMax,
+				fmt.Sprintf("line %d", lineNumber),
+			)
+		}
+
+		//exhaustruct:ignore
+		newCourses = append(newCourses, &courseT{
+			Max:         uint32(courseMax),
+			Title:       line[titleIndex],
+			Teacher:     line[teacherIndex],
+			Location:    line[locationIndex],
+			Type:        line[typeIndex],
+			Group:       line[groupIndex],
+			SectionID:   line[sectionIDIndex],
+			CourseID:    line[courseIDIndex],
+			YearGroups:  yearGroupsSpec,
+			LegalSexReq: line[legalSexIndex],
+		})
+	}
+	return newCourses, nil
+}
+
+/* Read a student list with the columns Name, ID and Legal Sex */
+func readStudentsCSV(r io.Reader) ([]expectedStudentT, error) {
+	csvReader := csv.NewReader(r)
+	titleLine, err := csvReader.Read()
+	if err != nil {
+		return nil, wrapError(errCannotReadCSV, err)
+	}
+	if titleLine == nil {
+		return nil, errUnexpectedNilCSVLine
+	}
+	if len(titleLine) > 0 {
+		titleLine[0] = strings.TrimPrefix(titleLine[0], "\uFEFF")
+	}
+	if len(titleLine) != 3 {
+		return nil, wrapAny(
+			errBadCSVFormat,
+			"expecting 3 fields on the first line (Name, ID, Legal Sex)",
+		)
+	}
+	var nameIndex, idIndex, legalSexIndex int = -1, -1, -1
+	for i, v := range titleLine {
+		switch v {
+		case "Name":
+			nameIndex = i
+		case "ID":
+			idIndex = i
+		case "Legal Sex":
+			legalSexIndex = i
+		}
+	}
+
+	if nameIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Name",
+		)
+	}
+	if idIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"ID",
+		)
+	}
+	if legalSexIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Legal Sex",
+		)
+	}
+
+	var students []expectedStudentT
+	for lineNumber := 2; ; lineNumber++ {
+		line, err := csvReader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, wrapError(
+				errCannotReadCSV,
+				err,
+			)
+		}
+		if line == nil {
+			return nil, wrapError(
+				errCannotReadCSV,
+				errUnexpectedNilCSVLine,
+			)
+		}
+		if len(line) != 3 {
+			return nil, wrapAny(
+				errInsufficientFields,
+				fmt.Sprintf(
+					"line %d has a wrong number of items",
+					lineNumber,
+				),
+			)
+		}
+
+		id, err := strconv.ParseInt(line[idIndex], 10, 64)
+		if err != nil {
+			return nil, wrapAny(
+				errBadCSVFormat,
+				fmt.Sprintf(
+					"line %d, ID is not a number; make sure that you only submit clean numbers e.g. 12345 as the student ID, don't use s12345/S12345",
+					lineNumber,
+				),
+			)
+		}
+
+		students = append(students, expectedStudentT{
+			ID:       id,
+			Name:     line[nameIndex],
+			LegalSex: line[legalSexIndex],
+		})
+	}
+	return students, nil
+}
+
+/*
+ * Read a forced association list with the columns Student ID and Section ID,
+ * where sections are looked up in termCourses.
+ */
+func readPreSelectionsCSV(r io.Reader, termCourses []*courseT) ([]preSelectionT, error) {
+	csvReader := csv.NewReader(r)
+	titleLine, err := csvReader.Read()
+	if err != nil {
+		return nil, wrapError(errCannotReadCSV, err)
+	}
+	if titleLine == nil {
+		return nil, errUnexpectedNilCSVLine
+	}
+	if len(titleLine) > 0 {
+		titleLine[0] = strings.TrimPrefix(titleLine[0], "\uFEFF")
+	}
+	if len(titleLine) != 2 {
+		return nil, wrapAny(
+			errBadCSVFormat,
+			"expecting 2 fields on the first line (Student ID, Section ID)",
+		)
+	}
+	var studentIDIndex, sectionIDIndex int = -1, -1
+	for i, v := range titleLine {
+		switch v {
+		case "Student ID":
+			studentIDIndex = i
+		case "Section ID":
+			sectionIDIndex = i
+		}
+	}
+
+	if studentIDIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Student ID",
+		)
+	}
+	if sectionIDIndex == -1 {
+		return nil, wrapAny(
+			errMissingCSVColumn,
+			"Section ID",
+		)
+	}
+
+	sections := make(map[string]int)
+	for _, course := range termCourses {
+		sections[course.SectionID] = course.ID
+	}
+
+	var preSelections []preSelectionT
+	for lineNumber := 2; ; lineNumber++ {
+		line, err := csvReader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, wrapError(
+				errCannotReadCSV,
+				err,
+			)
+		}
+		if line == nil {
+			return nil, wrapError(
+				errCannotReadCSV,
+				errUnexpectedNilCSVLine,
+			)
+		}
+		if len(line) != 2 {
+			return nil, wrapAny(
+				errInsufficientFields,
+				fmt.Sprintf(
+					"line %d has a wrong number of items",
+					lineNumber,
+				),
+			)
+		}
+
+		studentID, err := strconv.ParseInt(line[studentIDIndex], 10, 64)
+		if err != nil {
+			return nil, wrapAny(
+				errBadCSVFormat,
+				fmt.Sprintf(
+					"line %d, ID is not a number; make sure that you only submit clean numbers e.g. 12345 as the student ID, don't use s12345/S12345",
+					lineNumber,
+				),
+			)
+		}
+
+		courseID, ok := sections[line[sectionIDIndex]]
+		if !ok {
+			return nil, wrapAny(
+				errUnknownSection,
+				fmt.Sprintf("line %d, %q", lineNumber, line[sectionIDIndex]),
+			)
+		}
+
+		preSelections = append(preSelections, preSelectionT{
+			StudentID: studentID,
+			CourseID:  courseID,
+		})
+	}
+	return preSelections, nil
+}
+
+/*
+ * Replace the courses of the active term and start using them, telling
+ * other instances too. Student access must be disabled for every year
+ * group first.
+ */
+func importCourses(ctx context.Context, actor, ip string, upload auditUploadT, newCourses []*courseT) error {
+	if !allStatesDisabled() {
+		return errDisableStudentAccessFirst
+	}
+	err := store.replaceCourses(ctx, getActiveTerm(), actor, ip, upload, newCourses)
+	if err != nil {
+		return err
+	}
+	err = reloadCourses(ctx)
+	if err != nil {
+		return err
+	}
+	notifyCluster(ctx, clusterCourses)
+	return nil
+}
@@ -52,6 +52,13 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	if flag.NArg() != 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	slog.Info("setting up templates")
 	tmpl, err = template.ParseFS(runFS, "templates/*")
 	if err != nil {
@@ -108,11 +115,31 @@ func main() {
 	setHandler("/{$}", handleIndex)
 	setHandler("/export/choices", handleExportChoices)
 	setHandler("/export/students", handleExportStudents)
+	setHandler("/export/xlsx", handleExportXLSX)
+	setHandler("/rosters", handleRosters)
+	setHandler("/rosters/zip", handleRostersZip)
+	setHandler("/attendance", handleAttendance)
+	setHandler("/calendar/", handleCalendar)
+	setHandler("/calendar/reset", handleResetCalendar)
+	setHandler("/analytics", handleAnalytics)
+	setHandler("/analytics/json", handleAnalyticsJSON)
+	setHandler("/audit", handleAudit)
+	setHandler("/terms", handleTerms)
+	setHandler("/terms/new", handleNewTerm)
+	setHandler("/terms/activate", handleActivateTerm)
+	setHandler("/reconcile", handleReconcile)
+	setHandler("/reconcile/repair", handleReconcileRepair)
+	setHandler("/backup", handleBackup)
+	setHandler("/restore", handleRestore)
+	setHandler("/metrics", handleMetrics)
 	setHandler("/auth", handleAuth)
 	setHandler("/state", handleState)
 	setHandler("/newcourses", handleNewCourses)
 	setHandler("/newstudents", handleNewStudents)
 	setHandler("/newforcedchoices", handleNewForcedChoices)
+	setHandler("/revertupload", handleRevertUpload)
+	setHandler("/newannouncement", handleNewAnnouncement)
+	setHandler("/deleteannouncement", handleDeleteAnnouncement)
 
 	var l net.Listener
 
@@ -175,6 +202,11 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	slog.Info("setting up terms")
+	if err := setupTerms(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+
 	slog.Info("setting up courses")
 	err = setupCourses(context.Background())
 	if err != nil {
@@ -188,6 +220,18 @@ func main() {
 
 	go pollState()
 
+	go listenCluster()
+
+	go pruneLimiters()
+
+	go reconcilePeriodically()
+
+	for yeargroup := range chanPool {
+		go broadcastSelectedUpdates(yeargroup)
+	}
+
+	go broadcastStaffDashboard()
+
 	if config.Listen.Proto == "http" {
 		slog.Info("serving http")
 		srv := &http.Server{
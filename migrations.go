@@ -0,0 +1,320 @@
+/*
+ * Versioned schema migrations
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+ * Migrations live in sql/migrations/<backend> as NNNN_name.up.sql and
+ * NNNN_name.down.sql, numbered from 0001 without gaps. Each one is applied
+ * in its own transaction along with its row in schema_migrations, while
+ * the backend makes sure that several instances starting at once don't race
+ * each other. Both backends keep the same numbering, so that a change to the
+ * schema is one migration for each of them.
+ *
+ * Databases created by hand from the old sql/schema.sql have no
+ * schema_migrations table; if the courses table already exists, the first
+ * migration is taken to be applied. Later migrations are written to be
+ * harmless on such databases.
+ */
+
+//go:embed sql/migrations/postgres/*.sql sql/migrations/sqlite/*.sql
+var migrationsFS embed.FS
+
+type migrationT struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type migrationStatusT struct {
+	migrationT
+	Applied *time.Time
+}
+
+var migrationFilenameRegexp = regexp.MustCompile(`^([0-9]{4})_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+func getMigrations(dir string) ([]migrationT, error) {
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if err != nil {
+		return nil, wrapError(errBadMigrations, err)
+	}
+	byVersion := make(map[int]*migrationT)
+	for _, entry := range entries {
+		m := migrationFilenameRegexp.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, wrapAny(errBadMigrations, entry.Name())
+		}
+		version, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, wrapError(errBadMigrations, err)
+		}
+		content, err := fs.ReadFile(migrationsFS, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, wrapError(errBadMigrations, err)
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &migrationT{Version: version, Name: m[2], Up: "", Down: ""}
+			byVersion[version] = migration
+		} else if migration.Name != m[2] {
+			return nil, wrapAny(errBadMigrations, entry.Name())
+		}
+		if m[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]migrationT, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return nil, wrapAny(errBadMigrations, fmt.Sprintf("missing version %04d", i+1))
+		}
+		if migration.Up == "" || migration.Down == "" {
+			return nil, wrapAny(errBadMigrations, fmt.Sprintf("%04d needs both up and down", migration.Version))
+		}
+	}
+	return migrations, nil
+}
+
+/*
+ * Run fn on a connection holding the migration lock, with
+ * schema_migrations set up, and with the versions applied so far.
+ */
+func (s *sqlStoreT) withMigrationLock(
+	ctx context.Context,
+	fn func(conn *sql.Conn, applied map[int]time.Time) error,
+) (retErr error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 101"), err)
+	}
+	defer conn.Close()
+
+	unlock, err := s.dialect.lockMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := unlock()
+		if err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	_, err = conn.ExecContext(
+		ctx,
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied BIGINT NOT NULL)",
+	)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 104"), err)
+	}
+
+	applied, err := getAppliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		exists, err := s.dialect.tableExists(ctx, conn, "courses")
+		if err != nil {
+			return wrapError(errors.New("unexpected database error 108"), err)
+		}
+		if exists {
+			now := time.Now()
+			_, err := conn.ExecContext(
+				ctx,
+				"INSERT INTO schema_migrations (version, name, applied) VALUES (1, 'initial', $1)",
+				now.Unix(),
+			)
+			if err != nil {
+				return wrapError(errors.New("unexpected database error 109"), err)
+			}
+			applied[1] = now
+		}
+	}
+
+	return fn(conn, applied)
+}
+
+/* The versions recorded in schema_migrations, which must exist */
+func getAppliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied FROM schema_migrations")
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 105"), err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var t int64
+		err := rows.Scan(&version, &t)
+		if err != nil {
+			return nil, wrapError(errors.New("unexpected database error 106"), err)
+		}
+		applied[version] = time.Unix(t, 0)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errors.New("unexpected database error 107"), err)
+	}
+	return applied, nil
+}
+
+func runMigration(ctx context.Context, conn *sql.Conn, migration migrationT, up bool) (retErr error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 110"), err)
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errors.New("unexpected database error 111"), err)
+		}
+	}()
+
+	if up {
+		_, err = tx.ExecContext(ctx, migration.Up)
+		if err != nil {
+			return fmt.Errorf("apply migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO schema_migrations (version, name, applied) VALUES ($1, $2, $3)",
+			migration.Version,
+			migration.Name,
+			time.Now().Unix(),
+		)
+	} else {
+		_, err = tx.ExecContext(ctx, migration.Down)
+		if err != nil {
+			return fmt.Errorf("revert migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			"DELETE FROM schema_migrations WHERE version = $1",
+			migration.Version,
+		)
+	}
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 112"), err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return wrapError(errors.New("unexpected database error 113"), err)
+	}
+	return nil
+}
+
+/* Apply every pending migration, in order */
+func (s *sqlStoreT) migrateUp(ctx context.Context) error {
+	migrations, err := getMigrations(s.dialect.migrationsDir())
+	if err != nil {
+		return err
+	}
+	return s.withMigrationLock(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		for version := range applied {
+			if version > len(migrations) {
+				return wrapAny(errDatabaseTooNew, version)
+			}
+		}
+		for _, migration := range migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			slog.Info("applying migration", "version", migration.Version, "name", migration.Name)
+			err := runMigration(ctx, conn, migration, true)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/* Revert the latest steps applied migrations, newest first */
+func (s *sqlStoreT) migrateDown(ctx context.Context, steps int) error {
+	migrations, err := getMigrations(s.dialect.migrationsDir())
+	if err != nil {
+		return err
+	}
+	return s.withMigrationLock(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			if _, ok := applied[migrations[i].Version]; !ok {
+				continue
+			}
+			slog.Info("reverting migration", "version", migrations[i].Version, "name", migrations[i].Name)
+			err := runMigration(ctx, conn, migrations[i], false)
+			if err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+/*
+ * Only reads the database, without taking the migration lock, so that it
+ * could be used to check a database. Every migration is pending if
+ * schema_migrations doesn't exist yet.
+ */
+func (s *sqlStoreT) getMigrationStatus(ctx context.Context) ([]migrationStatusT, error) {
+	migrations, err := getMigrations(s.dialect.migrationsDir())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 182"), err)
+	}
+	defer conn.Close()
+
+	applied := make(map[int]time.Time)
+	exists, err := s.dialect.tableExists(ctx, conn, "schema_migrations")
+	if err != nil {
+		return nil, wrapError(errors.New("unexpected database error 183"), err)
+	}
+	if exists {
+		applied, err = getAppliedMigrations(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var status []migrationStatusT
+	for _, migration := range migrations {
+		m := migrationStatusT{migration, nil}
+		if t, ok := applied[migration.Version]; ok {
+			m.Applied = &t
+		}
+		status = append(status, m)
+	}
+	return status, nil
+}
@@ -11,7 +11,9 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"log/slog"
+	"net"
 	"net/http"
+	"strings"
 )
 
 func wstr(w http.ResponseWriter, code int, msg string) {
@@ -43,6 +45,18 @@ func randomString(sz int) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(r), nil
 }
 
+/*
+ * Get the IP address of the client, without the port. We are usually exposed
+ * directly to clients, so headers such as X-Forwarded-For are not trusted.
+ */
+func getRemoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
 func getKeysOfMap[K comparable, V any](i map[K]V) []K {
 	o := make([]K, 0, len(i))
 	for k := range i {
@@ -51,6 +65,21 @@ func getKeysOfMap[K comparable, V any](i map[K]V) []K {
 	return o
 }
 
-func returnFirst[T1, T2 any](v1 T1, _ T2) T1 {
-	return v1
+/*
+ * Student emails look like s12345@ykpaoschool.cn, and the student ID is the
+ * numeric part. Anything else is returned as-is.
+ */
+func studentIDFromEmail(email string) string {
+	before, _, found := strings.Cut(email, "@")
+	if !found {
+		return email
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(before, "s"), "S")
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
 }
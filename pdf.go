@@ -0,0 +1,269 @@
+/*
+ * Minimal PDF writer
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+ * This only implements what attendance sheets need: pages of a fixed size
+ * with text in the standard Helvetica fonts and straight lines. The standard
+ * fonts aren't embedded and only cover Windows-1252, so text with anything
+ * outside Latin-1, such as Chinese names, is set in STSong-Light instead.
+ * That is one of Adobe's standard CJK fonts, which PDF readers supply
+ * themselves like they do Helvetica, so nothing has to be embedded either;
+ * it only covers the Basic Multilingual Plane, and anything beyond it is
+ * replaced with question marks. Coordinates are in points, with the origin
+ * at the bottom left of the page.
+ */
+
+type pdfT struct {
+	Width  float64
+	Height float64
+	pages  []*bytes.Buffer
+	cur    *bytes.Buffer
+}
+
+const (
+	pdfA4Width  = 595.28
+	pdfA4Height = 841.89
+)
+
+func newPDF(width, height float64) *pdfT {
+	return &pdfT{
+		Width:  width,
+		Height: height,
+	} //exhaustruct:ignore
+}
+
+func (p *pdfT) addPage() {
+	p.cur = new(bytes.Buffer)
+	p.pages = append(p.pages, p.cur)
+}
+
+func pdfNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+/* Whether s has to be set in the CJK font as Helvetica can't show it */
+func pdfNeedsCJK(s string) bool {
+	for _, r := range s {
+		if r > 0xFF || (r >= 0x80 && r < 0xA0) {
+			return true
+		}
+	}
+	return false
+}
+
+const pdfHexDigits = "0123456789ABCDEF"
+
+/* A string operand for Tj, in the font pdfFont chose for s */
+func pdfEncodeText(s string) []byte {
+	if pdfNeedsCJK(s) {
+		/* UniGB-UCS2-H takes UCS-2 code units, big endian */
+		b := make([]byte, 0, 4*len(s)+2)
+		b = append(b, '<')
+		for _, r := range s {
+			if r > 0xFFFF || (r >= 0xD800 && r < 0xE000) {
+				r = '?'
+			}
+			b = append(b,
+				pdfHexDigits[r>>12&0xF], pdfHexDigits[r>>8&0xF],
+				pdfHexDigits[r>>4&0xF], pdfHexDigits[r&0xF])
+		}
+		return append(b, '>')
+	}
+	b := make([]byte, 0, len(s)+2)
+	b = append(b, '(')
+	for _, r := range s {
+		switch r {
+		case '(', ')', '\\':
+			b = append(b, '\\')
+		}
+		b = append(b, byte(r))
+	}
+	return append(b, ')')
+}
+
+/* STSong-Light has no bold variant, so bold is lost for CJK text */
+func pdfFont(bold bool, s string) string {
+	switch {
+	case pdfNeedsCJK(s):
+		return "/F3"
+	case bold:
+		return "/F2"
+	default:
+		return "/F1"
+	}
+}
+
+func (p *pdfT) text(x, y, size float64, bold bool, s string) {
+	p.cur.WriteString("BT " + pdfFont(bold, s) + " " + pdfNumber(size) + " Tf " +
+		pdfNumber(x) + " " + pdfNumber(y) + " Td ")
+	p.cur.Write(pdfEncodeText(s))
+	p.cur.WriteString(" Tj ET\n")
+}
+
+/* Text rotated 90 degrees counterclockwise, reading upwards from (x, y) */
+func (p *pdfT) textRotated(x, y, size float64, bold bool, s string) {
+	p.cur.WriteString("BT " + pdfFont(bold, s) + " " + pdfNumber(size) + " Tf 0 1 -1 0 " +
+		pdfNumber(x) + " " + pdfNumber(y) + " Tm ")
+	p.cur.Write(pdfEncodeText(s))
+	p.cur.WriteString(" Tj ET\n")
+}
+
+func (p *pdfT) line(x1, y1, x2, y2, width float64) {
+	p.cur.WriteString(pdfNumber(width) + " w " +
+		pdfNumber(x1) + " " + pdfNumber(y1) + " m " +
+		pdfNumber(x2) + " " + pdfNumber(y2) + " l S\n")
+}
+
+/* Character widths of Helvetica in thousandths of the font size, from ' ' */
+var pdfHelveticaWidths = [...]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+/*
+ * Width of a string in points. Helvetica-Bold isn't tabulated separately, and
+ * is approximated as slightly wider than Helvetica. In STSong-Light, ASCII is
+ * half as wide as everything else, as its /W array below says.
+ */
+func pdfTextWidth(s string, size float64, bold bool) float64 {
+	var total int
+	if pdfNeedsCJK(s) {
+		for _, r := range s {
+			if r < 0x80 {
+				total += 500
+			} else {
+				total += 1000
+			}
+		}
+		return float64(total) * size / 1000
+	}
+	for _, r := range s {
+		if r >= ' ' && int(r-' ') < len(pdfHelveticaWidths) {
+			total += pdfHelveticaWidths[r-' ']
+		} else {
+			total += 556
+		}
+	}
+	width := float64(total) * size / 1000
+	if bold {
+		width *= 1.1
+	}
+	return width
+}
+
+/* Shorten a string with an ellipsis until it fits in maxWidth */
+func pdfTruncate(s string, size float64, bold bool, maxWidth float64) string {
+	if pdfTextWidth(s, size, bold) <= maxWidth {
+		return s
+	}
+	r := []rune(s)
+	for len(r) > 0 {
+		r = r[:len(r)-1]
+		t := strings.TrimRight(string(r), " ") + "..."
+		if pdfTextWidth(t, size, bold) <= maxWidth {
+			return t
+		}
+	}
+	return ""
+}
+
+/*
+ * Objects are numbered as follows: 1 is the catalog, 2 is the page tree, 3
+ * and 4 are the regular and bold fonts, 5 to 7 are the CJK font with its
+ * descendant and descriptor, and each page takes two objects, the page
+ * itself and its content stream.
+ */
+func (p *pdfT) writeTo(out io.Writer) error {
+	/* bufio.Writer keeps the first error, which Flush returns at the end */
+	w := bufio.NewWriter(out)
+	var offset int
+	var offsets []int
+	write := func(s string) {
+		n, _ := w.WriteString(s)
+		offset += n
+	}
+	writeBytes := func(b []byte) {
+		n, _ := w.Write(b)
+		offset += n
+	}
+	object := func(body string) {
+		offsets = append(offsets, offset)
+		write(strconv.Itoa(len(offsets)) + " 0 obj\n" + body + "\nendobj\n")
+	}
+
+	write("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+
+	var kids strings.Builder
+	for i := range p.pages {
+		kids.WriteString(strconv.Itoa(8+2*i) + " 0 R ")
+	}
+	object("<< /Type /Pages /Kids [ " + kids.String() + "] /Count " +
+		strconv.Itoa(len(p.pages)) + " >>")
+
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type0 /BaseFont /STSong-Light-UniGB-UCS2-H " +
+		"/Encoding /UniGB-UCS2-H /DescendantFonts [ 6 0 R ] >>")
+	/* CIDs 1 to 95 are ASCII in Adobe-GB1 */
+	object("<< /Type /Font /Subtype /CIDFontType0 /BaseFont /STSong-Light " +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (GB1) /Supplement 2 >> " +
+		"/FontDescriptor 7 0 R /DW 1000 /W [ 1 95 500 ] >>")
+	object("<< /Type /FontDescriptor /FontName /STSong-Light /Flags 6 " +
+		"/FontBBox [ -25 -254 1000 880 ] /ItalicAngle 0 /Ascent 880 /Descent -120 " +
+		"/CapHeight 880 /StemV 93 >>")
+
+	for i, page := range p.pages {
+		object("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 " +
+			pdfNumber(p.Width) + " " + pdfNumber(p.Height) +
+			"] /Resources << /Font << /F1 3 0 R /F2 4 0 R /F3 5 0 R >> >> /Contents " +
+			strconv.Itoa(9+2*i) + " 0 R >>")
+
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		_, err := zw.Write(page.Bytes())
+		if err != nil {
+			return err
+		}
+		err = zw.Close()
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, offset)
+		write(strconv.Itoa(len(offsets)) + " 0 obj\n<< /Length " +
+			strconv.Itoa(compressed.Len()) + " /Filter /FlateDecode >>\nstream\n")
+		writeBytes(compressed.Bytes())
+		write("\nendstream\nendobj\n")
+	}
+
+	xref := offset
+	write("xref\n0 " + strconv.Itoa(len(offsets)+1) + "\n0000000000 65535 f \n")
+	for _, o := range offsets {
+		s := strconv.Itoa(o)
+		write(strings.Repeat("0", 10-len(s)) + s + " 00000 n \n")
+	}
+	write("trailer\n<< /Size " + strconv.Itoa(len(offsets)+1) +
+		" /Root 1 0 R >>\nstartxref\n" + strconv.Itoa(xref) + "\n%%EOF\n")
+
+	return w.Flush()
+}
@@ -0,0 +1,63 @@
+/*
+ * Keep track of recent errors for the staff dashboard
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const recentErrorsCap = 50
+
+type recentErrorT struct {
+	Time    time.Time
+	Source  string
+	Message string
+}
+
+/*
+ * Recent errors are streamed to staff dashboards as
+ *
+ *    ERR <time> <source> :<message>
+ *
+ * where <time> is a UNIX timestamp in seconds and <source> is usually the
+ * request path.
+ */
+func (e recentErrorT) message() string {
+	return "ERR " + strconv.FormatInt(e.Time.Unix(), 10) + " " +
+		e.Source + " :" + e.Message
+}
+
+var recentErrors struct {
+	sync.Mutex
+	list []recentErrorT /* oldest first */
+}
+
+func recordError(source string, err error) {
+	e := recentErrorT{
+		Time:    time.Now(),
+		Source:  source,
+		Message: err.Error(),
+	}
+	func() {
+		recentErrors.Lock()
+		defer recentErrors.Unlock()
+		recentErrors.list = append(recentErrors.list, e)
+		if len(recentErrors.list) > recentErrorsCap {
+			recentErrors.list = recentErrors.list[len(recentErrors.list)-recentErrorsCap:]
+		}
+	}()
+	propagateStaff(e.message())
+}
+
+func getRecentErrors() []recentErrorT {
+	recentErrors.Lock()
+	defer recentErrors.Unlock()
+	return append([]recentErrorT(nil), recentErrors.list...)
+}
@@ -0,0 +1,355 @@
+/*
+ * Check member counts and choices against the database
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The count stored in the database is kept by the choices_count triggers,
+ * whatever changes the choices, but Selected in memory is only changed by
+ * hand whenever a choice is made, removed or forced here or on notice from
+ * another instance, so only Selected could drift, and a missed or doubled
+ * change would go unnoticed by students until they see a wrong count. The
+ * reconciler compares Selected with the number of choices in the database,
+ * and also looks for choices that break the rules checked when choosing,
+ * which could only exist if something went wrong or staff uploaded them.
+ */
+
+/*
+ * A choice that is being made or removed at the moment of a check may
+ * already be committed but not yet counted in memory, so a course only
+ * counts as mismatched if it differs by the same amount in two passes this
+ * far apart.
+ */
+const reconcileSettleTime = 2 * time.Second
+
+const (
+	ruleGroup     = "group"
+	ruleType      = "type"
+	ruleLegalSex  = "legal sex"
+	ruleYearGroup = "year group"
+)
+
+type countMismatchT struct {
+	CourseID int
+	Title    string
+	Memory   uint32
+	Database uint32
+	Repaired bool
+}
+
+type ruleViolationT struct {
+	UserID    string
+	Name      string
+	StudentID string
+	YearGroup string
+	/* 0 for rules about all of a student's choices */
+	CourseID int
+	Forced   bool
+	Rule     string
+	Detail   string
+}
+
+type reconcileReportT struct {
+	Time       time.Time
+	Term       int64
+	Repair     bool
+	Mismatches []countMismatchT
+	Violations []ruleViolationT
+}
+
+func (report *reconcileReportT) TimeString() string {
+	return report.Time.In(loc).Format(time.DateTime)
+}
+
+/* The latest report, nil if there hasn't been a check yet */
+var lastReconcile atomic.Pointer[reconcileReportT]
+
+/*
+ * Check the active term, correcting mismatched counts if repair is true,
+ * with actor and ip recorded in the audit log for each correction.
+ */
+func reconcile(ctx context.Context, repair bool, actor, ip string) (*reconcileReportT, error) {
+	term := getActiveTerm()
+	report := &reconcileReportT{
+		Time:       time.Now(),
+		Term:       term,
+		Repair:     repair,
+		Mismatches: nil,
+		Violations: nil,
+	}
+
+	first, err := measureDrift(ctx, term)
+	if err != nil {
+		return nil, err
+	}
+	if len(first) != 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(reconcileSettleTime):
+		}
+		second, err := measureDrift(ctx, term)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range second {
+			if m == first[m.CourseID] {
+				report.Mismatches = append(report.Mismatches, m)
+			}
+		}
+		sort.Slice(report.Mismatches, func(i, j int) bool {
+			return report.Mismatches[i].CourseID < report.Mismatches[j].CourseID
+		})
+	}
+
+	if repair {
+		for i := range report.Mismatches {
+			err := repairCount(ctx, &report.Mismatches[i], actor, ip)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	report.Violations, err = findRuleViolations(ctx, term)
+	if err != nil {
+		return nil, err
+	}
+
+	lastReconcile.Store(report)
+	return report, nil
+}
+
+/* Courses whose Selected differs from the number of choices in the database */
+func measureDrift(ctx context.Context, term int64) (map[int]countMismatchT, error) {
+	termCourses, err := getSortedCourses()
+	if err != nil {
+		return nil, err
+	}
+	/*
+	 * The database must be read before memory, as choices are counted in
+	 * memory after they are committed. Reading it afterwards would make
+	 * every choice committed in between look like drift.
+	 */
+	inDatabase, err := store.getChoiceCounts(ctx, term)
+	if err != nil {
+		return nil, err
+	}
+	inMemory := make([]uint32, len(termCourses))
+	for i, course := range termCourses {
+		inMemory[i] = atomic.LoadUint32(&course.Selected)
+	}
+
+	result := make(map[int]countMismatchT)
+	for i, course := range termCourses {
+		if inMemory[i] != inDatabase[course.ID] {
+			result[course.ID] = countMismatchT{
+				CourseID: course.ID,
+				Title:    course.Title,
+				Memory:   inMemory[i],
+				Database: inDatabase[course.ID],
+				Repaired: false,
+			}
+		}
+	}
+	return result, nil
+}
+
+/*
+ * Set the count stored in the database to the number of choices, and
+ * correct ours by the difference seen rather than setting it, so that
+ * choices being made at the same time are not lost. Other instances have
+ * drifted differently, if at all, so they must check for themselves, see
+ * requestClusterReconcile.
+ */
+func repairCount(ctx context.Context, m *countMismatchT, actor, ip string) error {
+	_course, ok := courses.Load(m.CourseID)
+	if !ok {
+		return wrapAny(errNoSuchCourse, m.CourseID)
+	}
+	course, ok := _course.(*courseT)
+	if !ok {
+		return errType
+	}
+
+	_, err := store.repairSelected(ctx, actor, ip, m.CourseID)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint32(&course.Selected, m.Database-m.Memory)
+	course.markUpdated()
+	m.Repaired = true
+	return nil
+}
+
+/*
+ * Choices of students in a term that share a course group, are for another
+ * year group or legal sex, and confirmed students without enough courses of
+ * each type.
+ */
+func findRuleViolations(ctx context.Context, term int64) ([]ruleViolationT, error) {
+	users, err := store.getUsers(ctx, term)
+	if err != nil {
+		return nil, err
+	}
+	choiceRows, err := store.getChoiceRows(ctx, term)
+	if err != nil {
+		return nil, err
+	}
+	termCourses, err := getTermCourses(ctx, term)
+	if err != nil {
+		return nil, err
+	}
+	coursesByID := make(map[int]*courseT, len(termCourses))
+	for _, course := range termCourses {
+		coursesByID[course.ID] = course
+	}
+	choicesByUser := make(map[string][]choiceRowT)
+	for _, row := range choiceRows {
+		choicesByUser[row.UserID] = append(choicesByUser[row.UserID], row)
+	}
+
+	sortedCourseTypes := make([]string, 0, len(courseTypes))
+	for courseType := range courseTypes {
+		sortedCourseTypes = append(sortedCourseTypes, courseType)
+	}
+	sort.Strings(sortedCourseTypes)
+
+	var result []ruleViolationT
+	for _, user := range users {
+		if user.Department == staffDepartment {
+			continue
+		}
+		violation := func(row *choiceRowT, rule, detail string) {
+			v := ruleViolationT{
+				UserID:    user.ID,
+				Name:      user.Name,
+				StudentID: studentIDFromEmail(user.Email),
+				YearGroup: user.Department,
+				CourseID:  0,
+				Forced:    false,
+				Rule:      rule,
+				Detail:    detail,
+			}
+			if row != nil {
+				v.CourseID = row.CourseID
+				v.Forced = row.Forced
+			}
+			result = append(result, v)
+		}
+
+		groups := make(map[string]int)
+		types := make(map[string]int)
+		for i := range choicesByUser[user.ID] {
+			row := &choicesByUser[user.ID][i]
+			course, ok := coursesByID[row.CourseID]
+			if !ok {
+				continue
+			}
+			if other, ok := groups[course.Group]; ok {
+				violation(row, ruleGroup, fmt.Sprintf("%s is also taken by course %d", course.Group, other))
+			} else {
+				groups[course.Group] = course.ID
+			}
+			types[course.Type]++
+			if course.YearGroups&yearGroupsNumberBits[user.Department] == 0 {
+				violation(row, ruleYearGroup, "course is for "+yearGroupsNumberToString(course.YearGroups))
+			}
+			if course.LegalSexReq != "" && course.LegalSexReq != user.LegalSex {
+				violation(row, ruleLegalSex, "course is for legal sex "+course.LegalSexReq)
+			}
+		}
+
+		if !user.Confirmed {
+			continue
+		}
+		for _, courseType := range sortedCourseTypes {
+			minimum, err := getCourseTypeMinimumForYearGroup(user.Department, courseType)
+			if err != nil {
+				break
+			}
+			if types[courseType] < minimum {
+				violation(nil, ruleType, fmt.Sprintf("confirmed with %d out of required %d of type %s", types[courseType], minimum, courseType))
+			}
+		}
+	}
+	return result, nil
+}
+
+/*
+ * Ask every other instance to check and repair its counts on behalf of
+ * actor, whether or not perf.reconcile_repair is set there, as staff asked
+ * for a repair here.
+ */
+func requestClusterReconcile(ctx context.Context, actor string) {
+	notifyCluster(ctx, clusterReconcile, actor)
+}
+
+/* Act on requestClusterReconcile from another instance */
+func reconcileForCluster(actor string) {
+	defer func() {
+		if e := recover(); e != nil {
+			slog.Error("panic", "arg", e)
+		}
+	}()
+
+	report, err := reconcile(context.Background(), true, actor, "")
+	if err != nil {
+		slog.Error("reconcile", "error", err)
+		recordError("reconcile", err)
+		return
+	}
+	logReconcileReport(report)
+}
+
+/*
+ * Check every perf.reconcile_interval seconds, repairing counts if
+ * perf.reconcile_repair is set. Drift is reported as a recent error so that
+ * staff see it on the dashboard.
+ */
+func reconcilePeriodically() {
+	if config.Perf.ReconcileInterval == 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Duration(config.Perf.ReconcileInterval) * time.Second)
+		report, err := reconcile(context.Background(), config.Perf.ReconcileRepair, auditSystemActor, "")
+		if err != nil {
+			slog.Error("reconcile", "error", err)
+			recordError("reconcile", err)
+			continue
+		}
+		logReconcileReport(report)
+	}
+}
+
+func logReconcileReport(report *reconcileReportT) {
+	for _, m := range report.Mismatches {
+		slog.Warn(
+			"selected count drift",
+			"course", m.CourseID,
+			"memory", m.Memory,
+			"database", m.Database,
+			"repaired", m.Repaired,
+		)
+	}
+	if len(report.Mismatches) != 0 {
+		recordError("reconcile", wrapAny(errCountDrift, len(report.Mismatches)))
+	}
+	if len(report.Violations) != 0 {
+		slog.Warn("choices breaking course rules", "count", len(report.Violations))
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Course rosters for teachers
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type rosterEntryT struct {
+	Name       string
+	StudentID  string
+	Department string
+	Forced     bool
+	SelTime    time.Time
+}
+
+func (e rosterEntryT) Status() string {
+	if e.Forced {
+		return "Forced"
+	}
+	return "Voluntary"
+}
+
+func (e rosterEntryT) SelTimeString() string {
+	return e.SelTime.In(loc).Format("2006-01-02 15:04:05")
+}
+
+type rosterT struct {
+	Course  *courseT
+	Entries []rosterEntryT
+}
+
+/*
+ * Get the rosters of every course, ordered by course ID, with students in
+ * the order they selected the course.
+ */
+func getRosters(ctx context.Context) ([]rosterT, error) {
+	sortedCourses, err := getSortedCourses()
+	if err != nil {
+		return nil, err
+	}
+	choiceRows, err := store.getChoiceRows(ctx, getActiveTerm())
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[int][]rosterEntryT)
+	for _, row := range choiceRows {
+		entries[row.CourseID] = append(entries[row.CourseID], rosterEntryT{
+			Name:       row.Name,
+			StudentID:  row.StudentID,
+			Department: row.Department,
+			Forced:     row.Forced,
+			SelTime:    row.SelTime,
+		})
+	}
+	rosters := make([]rosterT, 0, len(sortedCourses))
+	for _, course := range sortedCourses {
+		rosters = append(rosters, rosterT{
+			Course:  course,
+			Entries: entries[course.ID],
+		})
+	}
+	return rosters, nil
+}
+
+func getRosterTeachers(rosters []rosterT) []string {
+	teachers := make(map[string]struct{})
+	for _, roster := range rosters {
+		teachers[roster.Course.Teacher] = struct{}{}
+	}
+	result := getKeysOfMap(teachers)
+	sort.Strings(result)
+	return result
+}
+
+func filterRostersByTeacher(rosters []rosterT, teacher string) []rosterT {
+	var result []rosterT
+	for _, roster := range rosters {
+		if roster.Course.Teacher == teacher {
+			result = append(result, roster)
+		}
+	}
+	return result
+}
+
+func writeRostersCSV(w io.Writer, rosters []rosterT) error {
+	csvWriter := csv.NewWriter(w)
+	err := csvWriter.Write([]string{
+		"Course",
+		"Teacher",
+		"Location",
+		"Section ID",
+		"Student Name",
+		"Student ID",
+		"Grade/Year",
+		"Status",
+		"Selection Time",
+	})
+	if err != nil {
+		return err
+	}
+	for _, roster := range rosters {
+		for _, entry := range roster.Entries {
+			err := csvWriter.Write([]string{
+				roster.Course.Title,
+				roster.Course.Teacher,
+				roster.Course.Location,
+				roster.Course.SectionID,
+				entry.Name,
+				entry.StudentID,
+				entry.Department,
+				entry.Status(),
+				entry.SelTimeString(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+/* Make a string safe for use as a file name in archives and downloads */
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+func rosterCourseFilename(course *courseT) string {
+	return sanitizeFilename(strconv.Itoa(course.ID) + " " + course.Title)
+}
@@ -38,7 +38,8 @@ include_code makefile 8 Makefile
 include_code bash 8 scripts/*.sh
 
 chapter SQL scripts
-include_code postgresql 8 sql/*.sql
+include_code postgresql 8 sql/migrations/postgres/*.sql
+include_code sql 8 sql/migrations/sqlite/*.sql
 
 chapter Production documentation
 include_code markdown 2 docs/*.md
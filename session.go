@@ -8,11 +8,8 @@
 package main
 
 import (
-	"context"
 	"errors"
 	"net/http"
-
-	"github.com/jackc/pgx/v5"
 )
 
 func getUserInfoFromRequest(req *http.Request) (userID,
@@ -31,18 +28,10 @@ func getUserInfoFromRequest(req *http.Request) (userID,
 		return
 	}
 
-	err = db.QueryRow(
-		context.Background(),
-		"SELECT id, name, department, email, COALESCE(legal_sex, '') FROM users WHERE session = $1",
-		sessionCookie.Value,
-	).Scan(&userID, &username, &department, &email, &legalSex)
+	user, err := store.getUserBySession(req.Context(), sessionCookie.Value)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			retErr = errNoSuchUser
-			return
-		}
-		retErr = wrapError(errors.New("unexpected database error 29"), err)
+		retErr = err
 		return
 	}
-	return
+	return user.ID, user.Name, user.Department, user.Email, user.LegalSex, nil
 }
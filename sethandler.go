@@ -35,6 +35,7 @@ func setHandler(pattern string, handler func(
 				"status", statusCode,
 				"error", err,
 			)
+			recordError(req.URL.Path, err)
 			if msg != "" {
 				wstr(w, statusCode, msg+"\n"+err.Error())
 			} else {
@@ -1,4 +1,6 @@
+DROP TABLE pre_selected;
 DROP TABLE choices;
+DROP TABLE expected_students;
 DROP TABLE users;
 DROP TABLE courses;
 DROP TABLE misc;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS announcements (
+	id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	body TEXT NOT NULL,
+	year_groups SMALLINT NOT NULL,
+	author TEXT NOT NULL,
+	created BIGINT NOT NULL -- seconds
+);
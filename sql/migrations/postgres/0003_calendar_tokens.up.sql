@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS calendar_tokens (
+	userid TEXT PRIMARY KEY NOT NULL,
+	FOREIGN KEY(userid) REFERENCES users(id),
+	token TEXT UNIQUE NOT NULL
+);
@@ -0,0 +1 @@
+DROP TABLE choice_events;
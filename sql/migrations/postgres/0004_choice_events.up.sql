@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS choice_events (
+	id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	userid TEXT NOT NULL, -- not a foreign key, so that history outlives users and courses
+	courseid INTEGER, -- null for confirmations
+	kind TEXT NOT NULL CHECK (kind IN ('choose', 'unchoose', 'confirm', 'unconfirm')),
+	time BIGINT NOT NULL -- microseconds
+);
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS audit_events (
+	id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	time BIGINT NOT NULL, -- microseconds
+	actor TEXT NOT NULL, -- user ID, or "system"
+	ip TEXT NOT NULL,
+	action TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	before JSONB,
+	after JSONB
+);
+CREATE INDEX IF NOT EXISTS audit_events_subject ON audit_events (subject);
+CREATE INDEX IF NOT EXISTS audit_events_actor ON audit_events (actor);
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+	FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events;
+CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+	FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
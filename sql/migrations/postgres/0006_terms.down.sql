@@ -0,0 +1,27 @@
+-- Only the active term is kept
+ALTER TABLE users ADD COLUMN confirmed BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ALTER COLUMN confirmed DROP DEFAULT;
+UPDATE users SET confirmed = true WHERE id IN (SELECT userid FROM confirmations WHERE term = (SELECT value FROM misc WHERE key = 'active_term'));
+DROP TABLE confirmations;
+
+DELETE FROM choices WHERE courseid IN (SELECT id FROM courses WHERE term <> (SELECT value FROM misc WHERE key = 'active_term'));
+DELETE FROM choice_events WHERE term <> (SELECT value FROM misc WHERE key = 'active_term');
+DELETE FROM pre_selected WHERE term <> (SELECT value FROM misc WHERE key = 'active_term');
+DELETE FROM expected_students WHERE term <> (SELECT value FROM misc WHERE key = 'active_term');
+DELETE FROM courses WHERE term <> (SELECT value FROM misc WHERE key = 'active_term');
+
+ALTER TABLE choice_events DROP COLUMN term;
+
+ALTER TABLE pre_selected DROP CONSTRAINT pre_selected_term_student_id_fkey;
+ALTER TABLE pre_selected DROP CONSTRAINT pre_selected_pkey;
+ALTER TABLE pre_selected DROP COLUMN term;
+ALTER TABLE pre_selected ADD PRIMARY KEY (student_id, course_id);
+ALTER TABLE expected_students DROP CONSTRAINT expected_students_pkey;
+ALTER TABLE expected_students DROP COLUMN term;
+ALTER TABLE expected_students ADD PRIMARY KEY (id);
+ALTER TABLE pre_selected ADD FOREIGN KEY (student_id) REFERENCES expected_students(id);
+
+ALTER TABLE courses DROP COLUMN term;
+
+DELETE FROM misc WHERE key = 'active_term';
+DROP TABLE terms;
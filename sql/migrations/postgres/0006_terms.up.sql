@@ -0,0 +1,38 @@
+CREATE TABLE terms (
+	id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	name TEXT UNIQUE NOT NULL,
+	created BIGINT NOT NULL -- seconds
+);
+INSERT INTO terms (name, created) VALUES ('Initial term', EXTRACT(EPOCH FROM now())::BIGINT);
+INSERT INTO misc (key, value) SELECT 'active_term', id FROM terms;
+
+ALTER TABLE courses ADD COLUMN term INTEGER REFERENCES terms(id);
+UPDATE courses SET term = (SELECT id FROM terms);
+ALTER TABLE courses ALTER COLUMN term SET NOT NULL;
+CREATE INDEX courses_term ON courses (term);
+
+ALTER TABLE pre_selected DROP CONSTRAINT pre_selected_student_id_fkey;
+ALTER TABLE expected_students ADD COLUMN term INTEGER REFERENCES terms(id);
+UPDATE expected_students SET term = (SELECT id FROM terms);
+ALTER TABLE expected_students ALTER COLUMN term SET NOT NULL;
+ALTER TABLE expected_students DROP CONSTRAINT expected_students_pkey;
+ALTER TABLE expected_students ADD PRIMARY KEY (term, id);
+
+ALTER TABLE pre_selected ADD COLUMN term INTEGER;
+UPDATE pre_selected SET term = (SELECT id FROM terms);
+ALTER TABLE pre_selected ALTER COLUMN term SET NOT NULL;
+ALTER TABLE pre_selected DROP CONSTRAINT pre_selected_pkey;
+ALTER TABLE pre_selected ADD PRIMARY KEY (term, student_id, course_id);
+ALTER TABLE pre_selected ADD FOREIGN KEY (term, student_id) REFERENCES expected_students(term, id);
+
+ALTER TABLE choice_events ADD COLUMN term INTEGER; -- not a foreign key either
+UPDATE choice_events SET term = (SELECT id FROM terms);
+ALTER TABLE choice_events ALTER COLUMN term SET NOT NULL;
+
+CREATE TABLE confirmations (
+	term INTEGER NOT NULL REFERENCES terms(id),
+	userid TEXT NOT NULL REFERENCES users(id),
+	PRIMARY KEY (term, userid)
+);
+INSERT INTO confirmations (term, userid) SELECT (SELECT id FROM terms), id FROM users WHERE confirmed;
+ALTER TABLE users DROP COLUMN confirmed;
@@ -0,0 +1 @@
+ALTER TABLE courses DROP COLUMN selected;
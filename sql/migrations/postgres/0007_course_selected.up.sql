@@ -0,0 +1,4 @@
+-- capacity is checked against this in the same statement that takes a seat,
+-- so that several instances could serve the same courses
+ALTER TABLE courses ADD COLUMN selected INTEGER NOT NULL DEFAULT 0;
+UPDATE courses SET selected = (SELECT COUNT(*) FROM choices WHERE choices.courseid = courses.id);
@@ -0,0 +1,3 @@
+DROP TRIGGER choices_count_move ON choices;
+DROP TRIGGER choices_count ON choices;
+DROP FUNCTION choices_count;
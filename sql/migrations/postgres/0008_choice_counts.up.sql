@@ -0,0 +1,26 @@
+-- keep courses.selected right however choices change, even by hand, and
+-- refuse choices beyond capacity other than forced ones
+CREATE OR REPLACE FUNCTION choices_count() RETURNS trigger AS $$
+DECLARE
+	taken INTEGER;
+	capacity INTEGER;
+BEGIN
+	IF TG_OP IN ('UPDATE', 'DELETE') THEN
+		UPDATE courses SET selected = selected - 1 WHERE id = OLD.courseid;
+	END IF;
+	IF TG_OP IN ('INSERT', 'UPDATE') THEN
+		-- waits for other choices of the course to commit or roll back
+		UPDATE courses SET selected = selected + 1 WHERE id = NEW.courseid
+			RETURNING selected, nmax INTO taken, capacity;
+		IF NOT NEW.forced AND taken > capacity THEN
+			RAISE EXCEPTION 'course is full' USING ERRCODE = 'check_violation';
+		END IF;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER choices_count AFTER INSERT OR DELETE ON choices
+	FOR EACH ROW EXECUTE FUNCTION choices_count();
+CREATE TRIGGER choices_count_move AFTER UPDATE OF courseid ON choices
+	FOR EACH ROW WHEN (OLD.courseid <> NEW.courseid) EXECUTE FUNCTION choices_count();
+UPDATE courses SET selected = (SELECT COUNT(*) FROM choices WHERE choices.courseid = courses.id);
@@ -0,0 +1,3 @@
+DELETE FROM choice_events WHERE kind = 'full';
+ALTER TABLE choice_events DROP CONSTRAINT choice_events_kind_check;
+ALTER TABLE choice_events ADD CONSTRAINT choice_events_kind_check CHECK (kind IN ('choose', 'unchoose', 'confirm', 'unconfirm'));
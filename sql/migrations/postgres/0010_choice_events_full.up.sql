@@ -0,0 +1,3 @@
+-- choices refused because the course was full, for demand in analytics
+ALTER TABLE choice_events DROP CONSTRAINT choice_events_kind_check;
+ALTER TABLE choice_events ADD CONSTRAINT choice_events_kind_check CHECK (kind IN ('choose', 'unchoose', 'confirm', 'unconfirm', 'full'));
@@ -0,0 +1,7 @@
+DROP TABLE pre_selected;
+DROP TABLE choices;
+DROP TABLE expected_students;
+DROP TABLE users;
+DROP TABLE courses;
+DROP TABLE misc;
+DROP TABLE states;
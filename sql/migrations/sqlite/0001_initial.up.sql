@@ -0,0 +1,54 @@
+CREATE TABLE courses (
+	id INTEGER PRIMARY KEY AUTOINCREMENT, -- never reused, like an identity column
+	nmax INTEGER NOT NULL,
+	title TEXT NOT NULL,
+	teacher TEXT NOT NULL,
+	location TEXT NOT NULL,
+	ctype TEXT NOT NULL,
+	cgroup TEXT NOT NULL,
+	course_id TEXT NOT NULL,
+	section_id TEXT NOT NULL,
+	year_groups SMALLINT NOT NULL,
+	forced BOOLEAN NOT NULL,
+	legal_sex_requirements TEXT CHECK (legal_sex_requirements IN ('F', 'M'))
+);
+CREATE TABLE users (
+	id TEXT PRIMARY KEY NOT NULL,
+	name TEXT NOT NULL,
+	email TEXT NOT NULL,
+	department TEXT NOT NULL,
+	session TEXT,
+	expr BIGINT, -- seconds
+	confirmed BOOLEAN NOT NULL,
+	legal_sex TEXT CHECK (legal_sex in ('F', 'M'))
+);
+CREATE TABLE expected_students (
+	id INTEGER PRIMARY KEY NOT NULL,
+	name TEXT NOT NULL,
+	legal_sex TEXT NOT NULL CHECK (legal_sex IN ('F', 'M'))
+);
+CREATE TABLE choices (
+	seltime BIGINT NOT NULL, -- microseconds
+	userid TEXT NOT NULL,
+	courseid INTEGER NOT NULL,
+	forced BOOLEAN NOT NULL,
+	PRIMARY KEY (userid, courseid),
+	FOREIGN KEY(userid) REFERENCES users(id),
+	FOREIGN KEY(courseid) REFERENCES courses(id)
+);
+CREATE TABLE misc (
+	key TEXT PRIMARY KEY NOT NULL,
+	value INTEGER NOT NULL
+);
+CREATE TABLE states (
+	yeargroup TEXT PRIMARY KEY NOT NULL,
+	state INTEGER NOT NULL,
+	schedule TIMESTAMP NOT NULL
+);
+CREATE TABLE pre_selected (
+	student_id INTEGER NOT NULL,
+	course_id INTEGER NOT NULL,
+	PRIMARY KEY (student_id, course_id),
+	FOREIGN KEY(student_id) REFERENCES expected_students(id),
+	FOREIGN KEY(course_id) REFERENCES courses(id)
+);
@@ -0,0 +1,7 @@
+CREATE TABLE announcements (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	body TEXT NOT NULL,
+	year_groups SMALLINT NOT NULL,
+	author TEXT NOT NULL,
+	created BIGINT NOT NULL -- seconds
+);
@@ -0,0 +1,5 @@
+CREATE TABLE calendar_tokens (
+	userid TEXT PRIMARY KEY NOT NULL,
+	token TEXT UNIQUE NOT NULL,
+	FOREIGN KEY(userid) REFERENCES users(id)
+);
@@ -0,0 +1,20 @@
+CREATE TABLE audit_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time BIGINT NOT NULL, -- microseconds
+	actor TEXT NOT NULL, -- user ID, or "system"
+	ip TEXT NOT NULL,
+	action TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	before TEXT, -- JSON
+	after TEXT -- JSON
+);
+CREATE INDEX audit_events_subject ON audit_events (subject);
+CREATE INDEX audit_events_actor ON audit_events (actor);
+CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+BEGIN
+	SELECT RAISE(ABORT, 'audit_events is append-only');
+END;
+CREATE TRIGGER audit_events_no_delete BEFORE DELETE ON audit_events
+BEGIN
+	SELECT RAISE(ABORT, 'audit_events is append-only');
+END;
@@ -0,0 +1,37 @@
+-- Only the active term is kept
+ALTER TABLE users ADD COLUMN confirmed BOOLEAN NOT NULL DEFAULT false;
+UPDATE users SET confirmed = true WHERE id IN (SELECT userid FROM confirmations WHERE term = (SELECT value FROM misc WHERE key = 'active_term'));
+DROP TABLE confirmations;
+
+DELETE FROM choices WHERE courseid IN (SELECT id FROM courses WHERE term <> (SELECT value FROM misc WHERE key = 'active_term'));
+DELETE FROM choice_events WHERE term <> (SELECT value FROM misc WHERE key = 'active_term');
+DELETE FROM pre_selected WHERE term <> (SELECT value FROM misc WHERE key = 'active_term');
+DELETE FROM expected_students WHERE term <> (SELECT value FROM misc WHERE key = 'active_term');
+DELETE FROM courses WHERE term <> (SELECT value FROM misc WHERE key = 'active_term');
+
+ALTER TABLE choice_events DROP COLUMN term;
+
+CREATE TABLE expected_students_old (
+	id INTEGER PRIMARY KEY NOT NULL,
+	name TEXT NOT NULL,
+	legal_sex TEXT NOT NULL CHECK (legal_sex IN ('F', 'M'))
+);
+INSERT INTO expected_students_old (id, name, legal_sex) SELECT id, name, legal_sex FROM expected_students;
+CREATE TABLE pre_selected_old (
+	student_id INTEGER NOT NULL,
+	course_id INTEGER NOT NULL,
+	PRIMARY KEY (student_id, course_id),
+	FOREIGN KEY(student_id) REFERENCES expected_students_old(id),
+	FOREIGN KEY(course_id) REFERENCES courses(id)
+);
+INSERT INTO pre_selected_old (student_id, course_id) SELECT student_id, course_id FROM pre_selected;
+DROP TABLE pre_selected;
+DROP TABLE expected_students;
+ALTER TABLE expected_students_old RENAME TO expected_students;
+ALTER TABLE pre_selected_old RENAME TO pre_selected;
+
+DROP INDEX courses_term;
+ALTER TABLE courses DROP COLUMN term;
+
+DELETE FROM misc WHERE key = 'active_term';
+DROP TABLE terms;
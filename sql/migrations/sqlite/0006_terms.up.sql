@@ -0,0 +1,49 @@
+CREATE TABLE terms (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT UNIQUE NOT NULL,
+	created BIGINT NOT NULL -- seconds
+);
+INSERT INTO terms (name, created) VALUES ('Initial term', CAST(strftime('%s', 'now') AS INTEGER));
+INSERT INTO misc (key, value) SELECT 'active_term', id FROM terms;
+
+-- References terms(id), but columns added with foreign keys couldn't be dropped again
+ALTER TABLE courses ADD COLUMN term INTEGER;
+UPDATE courses SET term = (SELECT id FROM terms);
+CREATE INDEX courses_term ON courses (term);
+
+-- Primary keys can't be altered, so these are rebuilt
+CREATE TABLE expected_students_new (
+	term INTEGER NOT NULL,
+	id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	legal_sex TEXT NOT NULL CHECK (legal_sex IN ('F', 'M')),
+	PRIMARY KEY (term, id),
+	FOREIGN KEY(term) REFERENCES terms(id)
+);
+INSERT INTO expected_students_new (term, id, name, legal_sex) SELECT (SELECT id FROM terms), id, name, legal_sex FROM expected_students;
+CREATE TABLE pre_selected_new (
+	term INTEGER NOT NULL,
+	student_id INTEGER NOT NULL,
+	course_id INTEGER NOT NULL,
+	PRIMARY KEY (term, student_id, course_id),
+	FOREIGN KEY(term, student_id) REFERENCES expected_students_new(term, id),
+	FOREIGN KEY(course_id) REFERENCES courses(id)
+);
+INSERT INTO pre_selected_new (term, student_id, course_id) SELECT (SELECT id FROM terms), student_id, course_id FROM pre_selected;
+DROP TABLE pre_selected;
+DROP TABLE expected_students;
+ALTER TABLE expected_students_new RENAME TO expected_students;
+ALTER TABLE pre_selected_new RENAME TO pre_selected;
+
+ALTER TABLE choice_events ADD COLUMN term INTEGER; -- not a foreign key either
+UPDATE choice_events SET term = (SELECT id FROM terms);
+
+CREATE TABLE confirmations (
+	term INTEGER NOT NULL,
+	userid TEXT NOT NULL,
+	PRIMARY KEY (term, userid),
+	FOREIGN KEY(term) REFERENCES terms(id),
+	FOREIGN KEY(userid) REFERENCES users(id)
+);
+INSERT INTO confirmations (term, userid) SELECT (SELECT id FROM terms), id FROM users WHERE confirmed;
+ALTER TABLE users DROP COLUMN confirmed;
@@ -0,0 +1,3 @@
+DROP TRIGGER choices_count_move;
+DROP TRIGGER choices_count_delete;
+DROP TRIGGER choices_count_insert;
@@ -0,0 +1,21 @@
+-- keep courses.selected right however choices change, even by hand, and
+-- refuse choices beyond capacity other than forced ones
+CREATE TRIGGER choices_count_insert AFTER INSERT ON choices
+BEGIN
+	UPDATE courses SET selected = selected + 1 WHERE id = NEW.courseid;
+	SELECT RAISE(ABORT, 'course is full') FROM courses
+		WHERE id = NEW.courseid AND NOT NEW.forced AND selected > nmax;
+END;
+CREATE TRIGGER choices_count_delete AFTER DELETE ON choices
+BEGIN
+	UPDATE courses SET selected = selected - 1 WHERE id = OLD.courseid;
+END;
+CREATE TRIGGER choices_count_move AFTER UPDATE OF courseid ON choices
+	WHEN OLD.courseid <> NEW.courseid
+BEGIN
+	UPDATE courses SET selected = selected - 1 WHERE id = OLD.courseid;
+	UPDATE courses SET selected = selected + 1 WHERE id = NEW.courseid;
+	SELECT RAISE(ABORT, 'course is full') FROM courses
+		WHERE id = NEW.courseid AND NOT NEW.forced AND selected > nmax;
+END;
+UPDATE courses SET selected = (SELECT COUNT(*) FROM choices WHERE choices.courseid = courses.id);
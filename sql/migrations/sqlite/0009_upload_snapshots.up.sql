@@ -0,0 +1,11 @@
+-- What each upload replaced, so that it could be reverted; see backup.go for the format of data
+CREATE TABLE upload_snapshots (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	term INTEGER NOT NULL REFERENCES terms(id),
+	tablename TEXT NOT NULL CHECK (tablename IN ('courses', 'expected_students', 'pre_selected')),
+	time BIGINT NOT NULL, -- microseconds
+	actor TEXT NOT NULL,
+	data TEXT NOT NULL, -- JSON
+	reverted BIGINT -- microseconds, null unless reverted
+);
+CREATE INDEX upload_snapshots_term ON upload_snapshots (term, id);
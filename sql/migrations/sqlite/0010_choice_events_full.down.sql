@@ -0,0 +1,11 @@
+CREATE TABLE choice_events_old (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	userid TEXT NOT NULL, -- not a foreign key, so that history outlives users and courses
+	courseid INTEGER, -- null for confirmations
+	kind TEXT NOT NULL CHECK (kind IN ('choose', 'unchoose', 'confirm', 'unconfirm')),
+	time BIGINT NOT NULL, -- microseconds
+	term INTEGER -- not a foreign key either
+);
+INSERT INTO choice_events_old (id, userid, courseid, kind, time, term) SELECT id, userid, courseid, kind, time, term FROM choice_events WHERE kind <> 'full';
+DROP TABLE choice_events;
+ALTER TABLE choice_events_old RENAME TO choice_events;
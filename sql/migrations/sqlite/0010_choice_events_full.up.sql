@@ -0,0 +1,13 @@
+-- choices refused because the course was full, for demand in analytics;
+-- checks can't be altered, so the table is rebuilt
+CREATE TABLE choice_events_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	userid TEXT NOT NULL, -- not a foreign key, so that history outlives users and courses
+	courseid INTEGER, -- null for confirmations
+	kind TEXT NOT NULL CHECK (kind IN ('choose', 'unchoose', 'confirm', 'unconfirm', 'full')),
+	time BIGINT NOT NULL, -- microseconds
+	term INTEGER -- not a foreign key either
+);
+INSERT INTO choice_events_new (id, userid, courseid, kind, time, term) SELECT id, userid, courseid, kind, time, term FROM choice_events;
+DROP TABLE choice_events;
+ALTER TABLE choice_events_new RENAME TO choice_events;
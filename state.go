@@ -11,10 +11,9 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"strconv"
 	"sync/atomic"
 	"time"
-
-	"github.com/jackc/pgx/v5"
 )
 
 /*
@@ -39,29 +38,9 @@ var schedules = map[string]*atomic.Pointer[time.Time]{
 
 func loadStateAndSchedule() error {
 	for yeargroup := range states {
-		var state uint32
-		var schedule time.Time
-		err := db.QueryRow(
-			context.Background(),
-			"SELECT state, schedule FROM states WHERE yeargroup = $1",
-			yeargroup,
-		).Scan(&state, &schedule)
+		state, schedule, err := store.loadState(context.Background(), yeargroup)
 		if err != nil {
-			if errors.Is(err, pgx.ErrNoRows) {
-				state = 0
-				_, err := db.Exec(
-					context.Background(),
-					"INSERT INTO states(yeargroup, state, schedule) VALUES ($1, $2, $3)",
-					yeargroup,
-					state,
-					time.Time{},
-				)
-				if err != nil {
-					return wrapError(errors.New("unexpected database error 30"), err)
-				}
-			} else {
-				return wrapError(errors.New("unexpected database error 31"), err)
-			}
+			return err
 		}
 		_state, ok := states[yeargroup]
 		if !ok {
@@ -77,39 +56,42 @@ func loadStateAndSchedule() error {
 	return nil
 }
 
-func saveStateValue(ctx context.Context, yeargroup string, newState uint32) error {
-	_, err := db.Exec(
-		ctx,
-		"UPDATE states SET state = $2 WHERE yeargroup = $1",
-		yeargroup,
-		newState,
-	)
-	if err != nil {
-		return wrapError(errors.New("unexpected database error 32"), err)
-	}
-	return nil
-}
-
-func saveScheduleValue(ctx context.Context, yeargroup string, newSchedule *time.Time) error {
-	_, err := db.Exec(
-		ctx,
-		"UPDATE states SET schedule = $2 WHERE yeargroup = $1",
-		yeargroup,
-		*newSchedule,
-	)
-	if err != nil {
-		return wrapError(errors.New("unexpected database error 33"), err)
+/* Whether student access is disabled for every year group */
+func allStatesDisabled() bool {
+	for _, v := range states {
+		if atomic.LoadUint32(v) != 0 {
+			return false
+		}
 	}
-	return nil
+	return true
 }
 
-func setSchedule(ctx context.Context, yeargroup string, newSchedule *time.Time) error {
+func setSchedule(
+	ctx context.Context,
+	yeargroup string,
+	newSchedule *time.Time,
+	actor string,
+	ip string,
+) error {
 	_schedule, ok := schedules[yeargroup]
 	if !ok {
 		return errNoSuchYearGroup
 	}
-	_schedule.Store(newSchedule)
-	return saveScheduleValue(ctx, yeargroup, newSchedule)
+	oldSchedule := _schedule.Swap(newSchedule)
+	err := store.saveSchedule(ctx, yeargroup, *newSchedule)
+	if err != nil {
+		return err
+	}
+	notifyCluster(ctx, clusterSchedule, yeargroup, strconv.FormatInt(newSchedule.Unix(), 10))
+	return store.recordAudit(
+		ctx,
+		actor,
+		ip,
+		auditSetSchedule,
+		yeargroup,
+		auditScheduleT{oldSchedule},
+		auditScheduleT{newSchedule},
+	)
 }
 
 func pollState() {
@@ -123,8 +105,9 @@ func pollState() {
 				}
 				schedule := _schedule.Load()
 				if time.Now().After(*schedule) {
-					err := setState(context.Background(), yeargroup, 2)
-					if err != nil {
+					/* Every instance tries, and all but one find it done */
+					err := setState(context.Background(), yeargroup, 2, auditSystemActor, "")
+					if err != nil && !errors.Is(err, errStateChanged) {
 						slog.Error("schedule setting failed", "yeargroup", yeargroup)
 					}
 				}
@@ -133,7 +116,56 @@ func pollState() {
 	}
 }
 
-func setState(ctx context.Context, yeargroup string, newState uint32) error {
+/*
+ * Change the state of a year group, unless another instance changed it
+ * since we last heard, in which case errStateChanged is returned and the
+ * change should be reconsidered.
+ */
+func setState(
+	ctx context.Context,
+	yeargroup string,
+	newState uint32,
+	actor string,
+	ip string,
+) error {
+	_state, ok := states[yeargroup]
+	if !ok {
+		return errNoSuchYearGroup
+	}
+	oldState := atomic.LoadUint32(_state)
+	if newState > 3 {
+		return errInvalidState
+	}
+
+	ok, err := store.saveState(ctx, yeargroup, oldState, newState)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errStateChanged
+	}
+	err = applyState(yeargroup, newState)
+	if err != nil {
+		return err
+	}
+	notifyCluster(ctx, clusterState, yeargroup, strconv.FormatUint(uint64(newState), 10))
+	return store.recordAudit(
+		ctx,
+		actor,
+		ip,
+		auditSetState,
+		yeargroup,
+		auditStateT{oldState},
+		auditStateT{newState},
+	)
+}
+
+/* Tell connected students about a new state and start using it */
+func applyState(yeargroup string, newState uint32) error {
+	_state, ok := states[yeargroup]
+	if !ok {
+		return errNoSuchYearGroup
+	}
 	switch newState {
 	case 0:
 	case 1:
@@ -151,14 +183,6 @@ func setState(ctx context.Context, yeargroup string, newState uint32) error {
 	default:
 		return errInvalidState
 	}
-	err := saveStateValue(ctx, yeargroup, newState)
-	if err != nil {
-		return err
-	}
-	_state, ok := states[yeargroup]
-	if !ok {
-		return errNoSuchYearGroup
-	}
 	atomic.StoreUint32(_state, newState)
 	return nil
 }
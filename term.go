@@ -0,0 +1,46 @@
+/*
+ * Term dates
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"time"
+)
+
+/*
+ * Attendance sheets and calendar feeds need the dates of the term, which
+ * are optional in the configuration, so that instances set up before they
+ * existed keep working. Their handlers fail with errNoTermDates without
+ * them, and the pages linking to them leave the links out.
+ */
+func haveTermDates() bool {
+	return config.Term != nil
+}
+
+/*
+ * Get every date in the current term that falls on one of the given
+ * weekdays, excluding skipped dates. Dates are at midnight in loc. There
+ * are none if the term isn't configured.
+ */
+func getTermDates(weekdays []time.Weekday) []time.Time {
+	var dates []time.Time
+	if !haveTermDates() {
+		return nil
+	}
+	for d := config.Term.Start; !d.After(config.Term.End); d = d.AddDate(0, 0, 1) {
+		if _, ok := config.Term.Skip[d]; ok {
+			continue
+		}
+		for _, weekday := range weekdays {
+			if d.Weekday() == weekday {
+				dates = append(dates, d)
+				break
+			}
+		}
+	}
+	return dates
+}
@@ -0,0 +1,96 @@
+/*
+ * Terms, each with their own courses, students and choices
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Courses, expected students, pre-selections, choices and confirmations all
+ * belong to a term, so that setting up a new round of selections doesn't
+ * destroy the last one. Only the active term is loaded into memory and seen
+ * by students and uploads; the others stay in the database to be browsed
+ * and exported.
+ */
+type termT struct {
+	ID       int64
+	Name     string
+	Created  time.Time
+	Courses  int
+	Students int
+	Choices  int
+}
+
+func (term termT) CreatedString() string {
+	return term.Created.In(loc).Format("2006-01-02 15:04")
+}
+
+var activeTerm int64 /* atomic */
+
+func getActiveTerm() int64 {
+	return atomic.LoadInt64(&activeTerm)
+}
+
+/* This must be called during setup, before setupCourses. */
+func setupTerms(ctx context.Context) error {
+	term, err := store.getActiveTerm(ctx)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&activeTerm, term)
+	return nil
+}
+
+/* Parse the ID of a term from a query parameter, defaulting to the active one */
+func parseTerm(s string) (int64, error) {
+	if s == "" {
+		return getActiveTerm(), nil
+	}
+	term, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || term <= 0 {
+		return 0, wrapAny(errInvalidTerm, s)
+	}
+	return term, nil
+}
+
+/*
+ * Courses of a term ordered by ID. Those of the active term are the ones in
+ * memory, so that Selected is up to date.
+ */
+func getTermCourses(ctx context.Context, term int64) ([]*courseT, error) {
+	if term == getActiveTerm() {
+		return getSortedCourses()
+	}
+	return store.getCourses(ctx, term)
+}
+
+/*
+ * Make another term the active one. Student access must be disabled for
+ * every year group first, as their pages would still show the courses of
+ * the old term.
+ */
+func switchTerm(ctx context.Context, actor, ip string, term int64) error {
+	if !allStatesDisabled() {
+		return errDisableStudentAccessFirst
+	}
+	err := store.setActiveTerm(ctx, actor, ip, term)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&activeTerm, term)
+	err = reloadCourses(ctx)
+	if err != nil {
+		return err
+	}
+	notifyCluster(ctx, clusterTerm, strconv.FormatInt(term, 10))
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Revert the latest upload
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+/*
+ * Uploading courses deletes every choice of the term, and uploading
+ * students or forced choices replaces the previous lists, so one wrong file
+ * could undo weeks of selections. Each upload therefore keeps what it
+ * replaces in upload_snapshots, in the same transaction, as a partial
+ * backup in the format of backup.go. For perf.upload_undo_window seconds
+ * afterwards, staff may revert the latest upload to the active term, after
+ * which the one before it becomes the latest.
+ */
+
+type uploadSnapshotT struct {
+	ID    int64
+	Table string
+	Time  time.Time
+	Actor string
+}
+
+func (snapshot *uploadSnapshotT) TimeString() string {
+	return snapshot.Time.In(loc).Format(time.DateTime)
+}
+
+/* What the upload replaced, for staff */
+func (snapshot *uploadSnapshotT) What() string {
+	switch snapshot.Table {
+	case "courses":
+		return "course list"
+	case "expected_students":
+		return "student list"
+	case "pre_selected":
+		return "forced association list"
+	default:
+		return snapshot.Table
+	}
+}
+
+/* Uploads made before this can no longer be reverted */
+func uploadUndoCutoff() time.Time {
+	return time.Now().Add(-time.Duration(config.Perf.UploadUndoWindow) * time.Second)
+}
+
+/* The latest upload to the active term that could be reverted, or nil */
+func getLastUpload(ctx context.Context) (*uploadSnapshotT, error) {
+	if config.Perf.UploadUndoWindow == 0 {
+		return nil, nil
+	}
+	return store.getLastUpload(ctx, getActiveTerm(), uploadUndoCutoff())
+}
+
+/*
+ * Revert the upload with the given ID, which must still be the latest one
+ * to the active term, and start using what it replaced. Student access
+ * must be disabled for every year group first, as for uploads.
+ */
+func revertLastUpload(ctx context.Context, actor, ip string, id int64) error {
+	if !allStatesDisabled() {
+		return errDisableStudentAccessFirst
+	}
+	table, err := store.revertUpload(ctx, getActiveTerm(), actor, ip, id, uploadUndoCutoff())
+	if err != nil {
+		return err
+	}
+	/* Forced choices change the forced flag of courses too */
+	if table == "courses" || table == "pre_selected" {
+		err = reloadCourses(ctx)
+		if err != nil {
+			return err
+		}
+		notifyCluster(ctx, clusterCourses)
+	}
+	return nil
+}
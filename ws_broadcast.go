@@ -0,0 +1,214 @@
+/*
+ * Batched broadcasting of course member counts
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * One broadcaster runs for each year group. On every tick, it collects the
+ * courses visible to the year group whose versions have changed since the
+ * previous tick, and sends a single M message covering all of them to every
+ * connection in the year group, through the same send queues used by
+ * propagate.
+ *
+ * The M message carries any number of course ID and member count pairs:
+ *
+ *    M <id> <selected> [<id> <selected>]...
+ *
+ * A connection whose send queue is full when an M message is sent misses
+ * it, so it is remembered and sent the counts of every course instead on
+ * the following ticks, until one gets through.
+ */
+func broadcastSelectedUpdates(yeargroup string) {
+	defer func() {
+		if e := recover(); e != nil {
+			slog.Error("panic", "arg", e)
+		}
+	}()
+
+	yearGroupBits, ok := yearGroupsNumberBits[yeargroup]
+	if !ok {
+		panic(errNoSuchYearGroup)
+	}
+
+	lastVersions := make(map[int]uint64)
+	missed := make(map[string]struct{})
+	ticker := time.NewTicker(
+		time.Duration(config.Perf.BroadcastInterval) * time.Millisecond,
+	)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		msg, snapshot, err := collectSelectedUpdates(yearGroupBits, lastVersions)
+		if err != nil {
+			slog.Error(
+				"broadcast",
+				"yeargroup", yeargroup,
+				"error", err,
+			)
+			continue
+		}
+		if msg == "" && len(missed) == 0 {
+			continue
+		}
+		err = propagateSelectedUpdates(yeargroup, msg, snapshot, missed)
+		if err != nil {
+			slog.Error(
+				"broadcast",
+				"yeargroup", yeargroup,
+				"error", err,
+			)
+		}
+	}
+}
+
+/*
+ * Send msg to every connection in the year group, and snapshot instead to
+ * those in missed, which is updated with the connections whose send queues
+ * were full. msg may be empty if nothing has changed.
+ */
+func propagateSelectedUpdates(yeargroup, msg, snapshot string, missed map[string]struct{}) error {
+	chanSubPool, ok := chanPool[yeargroup]
+	if !ok {
+		return errNoSuchYearGroup
+	}
+	connected := make(map[string]struct{}, len(missed))
+	var err error
+	chanSubPool.Range(func(_userID, _ch interface{}) bool {
+		userID, ok := _userID.(string)
+		if !ok {
+			err = errType
+			return false
+		}
+		ch, ok := _ch.(*chan string)
+		if !ok {
+			err = errType
+			return false
+		}
+		connected[userID] = struct{}{}
+		toSend := msg
+		if _, ok := missed[userID]; ok {
+			toSend = snapshot
+		}
+		if toSend == "" {
+			return true
+		}
+		select {
+		case *ch <- toSend:
+			delete(missed, userID)
+		default:
+			missed[userID] = struct{}{}
+			slog.Warn(
+				"sendq",
+				"user", userID,
+				"msg", toSend,
+			)
+		}
+		return true
+	})
+
+	/* Those who have left get every count when they connect again */
+	for userID := range missed {
+		if _, ok := connected[userID]; !ok {
+			delete(missed, userID)
+		}
+	}
+	return err
+}
+
+/*
+ * Build the M message for courses visible to any of the year groups in
+ * yearGroupBits that changed since lastVersions was last updated, and update
+ * lastVersions accordingly, along with one for all of those courses. An
+ * empty string is returned for the former if nothing has changed.
+ */
+func collectSelectedUpdates(
+	yearGroupBits uint8,
+	lastVersions map[int]uint64,
+) (string, string, error) {
+	var updates, all []selectedUpdateT
+	seen := make(map[int]struct{}, len(lastVersions))
+
+	var err error
+	courses.Range(func(key, value interface{}) bool {
+		courseID, ok := key.(int)
+		if !ok {
+			err = errType
+			return false
+		}
+		course, ok := value.(*courseT)
+		if !ok {
+			err = errType
+			return false
+		}
+		if course.YearGroups&yearGroupBits == 0 {
+			return true
+		}
+		seen[courseID] = struct{}{}
+		/*
+		 * The version must be loaded before Selected. If Selected
+		 * changes in between, the version would change again and the
+		 * course would simply be sent once more on the next tick.
+		 */
+		version := atomic.LoadUint64(&course.Version)
+		update := selectedUpdateT{
+			courseID: courseID,
+			selected: atomic.LoadUint32(&course.Selected),
+		}
+		all = append(all, update)
+		if version == lastVersions[courseID] {
+			return true
+		}
+		lastVersions[courseID] = version
+		updates = append(updates, update)
+		return true
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	/* Forget courses that have been removed, e.g. by /newcourses */
+	for courseID := range lastVersions {
+		if _, ok := seen[courseID]; !ok {
+			delete(lastVersions, courseID)
+		}
+	}
+
+	return formatSelectedUpdates(updates), formatSelectedUpdates(all), nil
+}
+
+type selectedUpdateT struct {
+	courseID int
+	selected uint32
+}
+
+/* The M message for updates, sorted by course ID, or "" if there are none */
+func formatSelectedUpdates(updates []selectedUpdateT) string {
+	if len(updates) == 0 {
+		return ""
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].courseID < updates[j].courseID
+	})
+	var sb strings.Builder
+	sb.WriteString("M")
+	for _, update := range updates {
+		sb.WriteByte(' ')
+		sb.WriteString(strconv.Itoa(update.courseID))
+		sb.WriteByte(' ')
+		sb.WriteString(strconv.FormatUint(uint64(update.selected), 10))
+	}
+	return sb.String()
+}
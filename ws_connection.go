@@ -22,13 +22,6 @@ type errbytesT struct {
 	bytes *[]byte
 }
 
-var usemCount int64 /* atomic */
-
-/*
- * This is more appropriately typed as uint64, but it needs to be cast to int64
- * later anyway due to time.Duration, so let's just use int64.
- */
-
 /*
  * The actual logic in handling the connection, after authentication has been
  * completed.
@@ -39,6 +32,7 @@ func handleConn(
 	userID string,
 	department string,
 	legalSex string,
+	ip string,
 ) (reterr error) {
 	_state, ok := states[department]
 	if !ok {
@@ -57,6 +51,11 @@ func handleConn(
 	defer chanSubPool.CompareAndDelete(userID, &send)
 
 	newCtx, newCancel := context.WithCancel(ctx)
+	/*
+	 * Cancelling on return makes sure that the reading and heartbeat
+	 * goroutines exit too, rather than leaking along with the connection.
+	 */
+	defer newCancel()
 
 	_cancel, ok := cancelPool.Load(userID)
 	if ok {
@@ -67,82 +66,23 @@ func handleConn(
 		/* TODO: Make the cancel synchronous */
 	}
 	cancelPool.Store(userID, &newCancel)
+	notifyCluster(ctx, clusterSession, userID)
 
 	defer func() {
 		cancelPool.CompareAndDelete(userID, &newCancel)
 	}()
 
-	/* TODO: Tell the user their current choices here. Deprecate HELLO. */
-
-	usems := make(map[int]*usemT)
-
-	atomic.AddInt64(&usemCount, int64(atomic.LoadUint32(&numCourses)))
-	var err error
-	courses.Range(func(key, value interface{}) bool {
-		courseID, ok := key.(int)
-		if !ok {
-			err = errType
-			return false
-		}
-		course, ok := value.(*courseT)
-		if !ok {
-			err = errType
-			return false
-		}
-		usem := &usemT{} //exhaustruct:ignore
-		usem.init()
-		course.Usems.Store(userID, usem)
-		usems[courseID] = usem
-		return true
-	})
-
-	defer func() {
-		courses.Range(func(key, value interface{}) bool {
-			_ = key
-			course, ok := value.(*courseT)
-			if !ok {
-				reterr = errType
-				return false
-			}
-			course.Usems.Delete(userID)
-			return true
-		})
-		atomic.AddInt64(&usemCount, -int64(atomic.LoadUint32(&numCourses)))
-	}()
-
-	usemParent := make(chan int)
-	for courseID, usem := range usems {
-		go func() {
-			defer func() {
-				if e := recover(); e != nil {
-					slog.Error("panic", "arg", e)
-				}
-			}()
-
-			for {
-				select {
-				case <-newCtx.Done():
-					return
-				case <-usem.ch:
-					select {
-					case <-newCtx.Done():
-						return
-					case usemParent <- courseID:
-					}
-				}
-				time.Sleep(
-					time.Duration(
-						atomic.LoadInt64(&usemCount)>>
-							config.Perf.UsemDelayShiftBits,
-					) * time.Millisecond,
-				)
-			}
-		}()
-	}
+	session := &wsSessionT{
+		UserID:     userID,
+		Department: department,
+	} //exhaustruct:ignore
+	session.touch()
+	wsSessions.Store(session, struct{}{})
+	defer wsSessions.Delete(session)
 
 	var userCourseGroups userCourseGroupsT = make(map[string]struct{})
 	var userCourseTypes userCourseTypesT = make(map[string]int)
-	err = populateUserCourseTypesAndGroups(
+	err := populateUserCourseTypesAndGroups(
 		newCtx,
 		&userCourseTypes,
 		&userCourseGroups,
@@ -152,6 +92,21 @@ func handleConn(
 		return err
 	}
 
+	/*
+	 * The send channel is already in chanPool at this point, so anything
+	 * that changes after the snapshot is taken would still reach the
+	 * client through the broadcaster.
+	 */
+	err = sendSnapshot(newCtx, c, userID, department)
+	if err != nil {
+		return err
+	}
+
+	err = sendAnnouncements(newCtx, c, department)
+	if err != nil {
+		return err
+	}
+
 	/*
 	 * Later we need to select from recv and send and perform the
 	 * corresponding action. But we can't just select from c.Read because
@@ -160,6 +115,48 @@ func handleConn(
 	 * then we can select from that channel.
 	 */
 	recv := make(chan *errbytesT)
+	heartbeatFailed := make(chan error, 1)
+
+	/*
+	 * A client that disappears without closing its TCP connection would
+	 * never cause c.Read to fail, so we periodically ping it and give up on
+	 * the connection if the pong doesn't arrive in time. The pong is
+	 * processed by c.Read in the reading goroutine below. As with reading,
+	 * the original connection context is used for the ping itself, as
+	 * its expiry closes the connection.
+	 */
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				slog.Error("panic", "arg", e)
+			}
+		}()
+		ticker := time.NewTicker(
+			time.Duration(config.Perf.PingInterval) * time.Second,
+		)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-newCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			pingCtx, pingCancel := context.WithTimeout(
+				ctx,
+				time.Duration(config.Perf.PingTimeout)*time.Second,
+			)
+			err := c.Ping(pingCtx)
+			pingCancel()
+			if err != nil {
+				select {
+				case heartbeatFailed <- err:
+				default:
+				}
+				return
+			}
+		}
+	}()
+
 	go func() {
 		defer func() {
 			if e := recover(); e != nil {
@@ -212,6 +209,22 @@ func handleConn(
 		}
 	}()
 
+	/*
+	 * Receiving from a nil channel blocks forever, so the idle timeout is
+	 * effectively disabled when idleTimeout stays nil.
+	 */
+	var idleTimer *time.Timer
+	var idleTimeout <-chan time.Time
+	if config.Perf.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(
+			time.Duration(config.Perf.IdleTimeout) * time.Second,
+		)
+		defer idleTimer.Stop()
+		idleTimeout = idleTimer.C
+	}
+
+	var throttledUntil time.Time
+
 	for {
 		var mar []string
 		select {
@@ -227,6 +240,12 @@ func handleConn(
 				errWsHandlerContextCanceled,
 				newCtx.Err(),
 			)
+		case <-idleTimeout:
+			atomic.AddUint64(&wsReapedIdle, 1)
+			return errIdleTimeout
+		case err := <-heartbeatFailed:
+			atomic.AddUint64(&wsReapedHeartbeat, 1)
+			return wrapError(errHeartbeatFailed, err)
 		case sendText := <-send:
 			select {
 			case <-newCtx.Done():
@@ -241,24 +260,6 @@ func handleConn(
 			if err != nil {
 				return err
 			}
-		case courseID := <-usemParent:
-			select {
-			case <-newCtx.Done():
-				return wrapError(
-					errWsHandlerContextCanceled,
-					newCtx.Err(),
-				)
-			default:
-			}
-
-			err := sendSelectedUpdate(newCtx, c, courseID)
-			if err != nil {
-				return wrapError(
-					errCannotSend,
-					err,
-				)
-			}
-			continue
 		case errbytes := <-recv:
 			select {
 			case <-newCtx.Done():
@@ -288,6 +289,13 @@ func handleConn(
 				 * reading routine
 				 */
 			}
+			session.touch()
+			if idleTimer != nil {
+				idleTimer.Reset(
+					time.Duration(config.Perf.IdleTimeout) * time.Second,
+				)
+			}
+
 			slog.Info(
 				"incoming",
 				"user", userID,
@@ -295,6 +303,22 @@ func handleConn(
 			)
 
 			mar = splitMsg(errbytes.bytes)
+
+			ok, err := checkRateLimit(
+				newCtx,
+				c,
+				mar,
+				userID,
+				ip,
+				&throttledUntil,
+			)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+
 			switch mar[0] {
 			case "HELLO":
 				err := messageHello(
@@ -313,6 +337,7 @@ func handleConn(
 					c,
 					mar,
 					userID,
+					ip,
 					department,
 					legalSex,
 					&userCourseGroups,
@@ -327,6 +352,7 @@ func handleConn(
 					c,
 					mar,
 					userID,
+					ip,
 					department,
 					&userCourseGroups,
 					&userCourseTypes,
@@ -340,6 +366,7 @@ func handleConn(
 					c,
 					mar,
 					userID,
+					ip,
 					department,
 					&userCourseTypes,
 				)
@@ -352,6 +379,7 @@ func handleConn(
 					c,
 					mar,
 					userID,
+					ip,
 					department,
 				)
 				if err != nil {
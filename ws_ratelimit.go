@@ -0,0 +1,165 @@
+/*
+ * Rate limiting for incoming WebSocket messages
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"golang.org/x/time/rate"
+)
+
+/*
+ * Each user and each IP address gets its own token bucket. A message is only
+ * processed if both buckets have a token available. Note that many students
+ * may share the school's IP address, so the per-IP limits should be much
+ * more generous than the per-user limits.
+ */
+
+type limiterT struct {
+	lastUsed int64 /* atomic, unix seconds */
+	limiter  *rate.Limiter
+}
+
+var (
+	userLimiters sync.Map /* string, *limiterT */
+	ipLimiters   sync.Map /* string, *limiterT */
+)
+
+/* Limiters that haven't been used for this long are forgotten. */
+const limiterExpiry = 10 * time.Minute
+
+func getLimiter(limiters *sync.Map, key string, r float64, burst int) *rate.Limiter {
+	_l, ok := limiters.Load(key)
+	if !ok {
+		_l, _ = limiters.LoadOrStore(key, &limiterT{
+			lastUsed: time.Now().Unix(),
+			limiter:  rate.NewLimiter(rate.Limit(r), burst),
+		})
+	}
+	l, ok := _l.(*limiterT)
+	if !ok {
+		panic(errType)
+	}
+	atomic.StoreInt64(&l.lastUsed, time.Now().Unix())
+	return l.limiter
+}
+
+/*
+ * Both buckets are always consulted, so that a user flooding from a shared
+ * IP address also drains the shared bucket.
+ */
+func allowMessage(userID, ip string) bool {
+	userOk := getLimiter(
+		&userLimiters,
+		userID,
+		config.RateLimit.UserRate,
+		config.RateLimit.UserBurst,
+	).Allow()
+	ipOk := getLimiter(
+		&ipLimiters,
+		ip,
+		config.RateLimit.IPRate,
+		config.RateLimit.IPBurst,
+	).Allow()
+	return userOk && ipOk
+}
+
+func pruneLimiters() {
+	for {
+		time.Sleep(limiterExpiry)
+		expiry := time.Now().Add(-limiterExpiry).Unix()
+		for _, limiters := range []*sync.Map{&userLimiters, &ipLimiters} {
+			limiters.Range(func(key, value interface{}) bool {
+				l, ok := value.(*limiterT)
+				if ok && atomic.LoadInt64(&l.lastUsed) < expiry {
+					limiters.Delete(key)
+				}
+				return true
+			})
+		}
+	}
+}
+
+/*
+ * Tell the client that a message was dropped due to throttling, using the
+ * rejection message corresponding to the command, so that the interface
+ * doesn't get stuck waiting for a reply.
+ */
+func rejectThrottled(ctx context.Context, c *websocket.Conn, mar []string) error {
+	var msg string
+	switch mar[0] {
+	case "Y":
+		if len(mar) != 2 {
+			return nil
+		}
+		msg = "R " + mar[1] + " :Rate limited"
+	case "N":
+		if len(mar) != 2 {
+			return nil
+		}
+		msg = "RU " + mar[1] + " :Rate limited"
+	case "YC", "NC":
+		msg = "RC :Rate limited, please try again later"
+	default:
+		return nil
+	}
+	err := writeText(ctx, c, msg)
+	if err != nil {
+		return wrapError(errCannotSend, err)
+	}
+	return nil
+}
+
+/*
+ * Check whether a message may be processed, and handle throttling if not.
+ * throttledUntil belongs to the connection and is updated when the client
+ * first exceeds the limits. ok is false if the message must be dropped.
+ */
+func checkRateLimit(
+	ctx context.Context,
+	c *websocket.Conn,
+	mar []string,
+	userID string,
+	ip string,
+	throttledUntil *time.Time,
+) (ok bool, retErr error) {
+	now := time.Now()
+	if now.Before(*throttledUntil) {
+		return false, rejectThrottled(ctx, c, mar)
+	}
+	if allowMessage(userID, ip) {
+		return true, nil
+	}
+
+	*throttledUntil = now.Add(
+		time.Duration(config.RateLimit.Throttle) * time.Second,
+	)
+	slog.Warn(
+		"rate limit",
+		"user", userID,
+		"ip", ip,
+		"msg", mar[0],
+	)
+	err := writeText(
+		ctx,
+		c,
+		"E :You are sending too many requests. Please wait "+
+			strconv.Itoa(config.RateLimit.Throttle)+
+			" seconds before trying again.",
+	)
+	if err != nil {
+		return false, wrapError(errCannotSend, err)
+	}
+	return false, rejectThrottled(ctx, c, mar)
+}
@@ -0,0 +1,86 @@
+/*
+ * WebSocket session tracking and lifecycle metrics
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * A session is considered idle if the client has not sent any message for
+ * this long. Idle sessions are still live; they are only reaped once
+ * perf.idle_timeout is reached.
+ */
+const wsIdleThreshold = time.Minute
+
+type wsSessionT struct {
+	LastActive int64 /* atomic, unix seconds */
+	UserID     string
+	Department string
+}
+
+func (session *wsSessionT) touch() {
+	atomic.StoreInt64(&session.LastActive, time.Now().Unix())
+}
+
+var wsSessions sync.Map /* *wsSessionT, struct{} */
+
+var (
+	wsReapedHeartbeat uint64 /* atomic */
+	wsReapedIdle      uint64 /* atomic */
+)
+
+type wsMetricsT struct {
+	Live            int
+	Idle            int
+	ReapedHeartbeat uint64
+	ReapedIdle      uint64
+}
+
+func getWsMetrics() (metrics wsMetricsT) {
+	idleBefore := time.Now().Add(-wsIdleThreshold).Unix()
+	wsSessions.Range(func(key, _ interface{}) bool {
+		session, ok := key.(*wsSessionT)
+		if !ok {
+			return true
+		}
+		metrics.Live++
+		if atomic.LoadInt64(&session.LastActive) < idleBefore {
+			metrics.Idle++
+		}
+		return true
+	})
+	metrics.ReapedHeartbeat = atomic.LoadUint64(&wsReapedHeartbeat)
+	metrics.ReapedIdle = atomic.LoadUint64(&wsReapedIdle)
+	return
+}
+
+func handleMetrics(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_ = w
+
+	_, _, department, _, _, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	metrics := getWsMetrics()
+	return fmt.Sprintf(
+		"ws_sessions_live %d\nws_sessions_idle %d\nws_sessions_reaped_heartbeat %d\nws_sessions_reaped_idle %d\n",
+		metrics.Live,
+		metrics.Idle,
+		metrics.ReapedHeartbeat,
+		metrics.ReapedIdle,
+	), http.StatusOK, nil
+}
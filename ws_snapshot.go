@@ -0,0 +1,140 @@
+/*
+ * Full state snapshot sent when a WebSocket connection is established
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/coder/websocket"
+)
+
+/*
+ * The snapshot is a single message of the form
+ *
+ *    SNAP <state> <confirmed> <requirements> <courses> :<choices>
+ *
+ * <state> is START or STOP, and <confirmed> is YC or NC, with the same
+ * meanings as the standalone messages of the same names.
+ * <requirements> is a comma-separated list of type=minimum pairs, e.g.
+ * "Non-sport=1,Sport=1".
+ * <courses> is a comma-separated list of id:selected:max triples covering
+ * every course visible to the user's year group.
+ * <choices> is a comma-separated list of the IDs of the courses that the
+ * user has currently chosen, which may be empty.
+ *
+ * This should be sent after the user's send channel has been added to
+ * chanPool, so that any update that happens after the snapshot is taken is
+ * still delivered through M messages.
+ */
+func sendSnapshot(
+	ctx context.Context,
+	c *websocket.Conn,
+	userID string,
+	yeargroup string,
+) error {
+	_state, ok := states[yeargroup]
+	if !ok {
+		return errNoSuchYearGroup
+	}
+	stateString := "STOP"
+	if atomic.LoadUint32(_state) == 2 {
+		stateString = "START"
+	}
+
+	confirmed, err := store.getConfirmed(ctx, getActiveTerm(), userID)
+	if err != nil {
+		return err
+	}
+	confirmedString := "NC"
+	if confirmed {
+		confirmedString = "YC"
+	}
+
+	courseTypeNames := getKeysOfMap(courseTypes)
+	sort.Strings(courseTypeNames)
+	requirements := make([]string, 0, len(courseTypeNames))
+	for _, courseType := range courseTypeNames {
+		minimum, err := getCourseTypeMinimumForYearGroup(
+			yeargroup,
+			courseType,
+		)
+		if err != nil {
+			return wrapError(errInvalidYearGroupOrCourseType, err)
+		}
+		requirements = append(
+			requirements,
+			courseType+"="+strconv.Itoa(minimum),
+		)
+	}
+
+	courseIDs := make([]int, 0, atomic.LoadUint32(&numCourses))
+	courses.Range(func(key, value interface{}) bool {
+		courseID, ok := key.(int)
+		if !ok {
+			err = errType
+			return false
+		}
+		course, ok := value.(*courseT)
+		if !ok {
+			err = errType
+			return false
+		}
+		if course.YearGroups&yearGroupsNumberBits[yeargroup] == 0 {
+			return true
+		}
+		courseIDs = append(courseIDs, courseID)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	sort.Ints(courseIDs)
+	courseTriples := make([]string, 0, len(courseIDs))
+	for _, courseID := range courseIDs {
+		_course, ok := courses.Load(courseID)
+		if !ok {
+			continue /* deleted while we were building the list */
+		}
+		course, ok := _course.(*courseT)
+		if !ok {
+			return errType
+		}
+		courseTriples = append(
+			courseTriples,
+			strconv.Itoa(courseID)+":"+
+				strconv.FormatUint(uint64(atomic.LoadUint32(&course.Selected)), 10)+":"+
+				strconv.FormatUint(uint64(course.Max), 10),
+		)
+	}
+
+	choiceIDs, err := store.getUserChoices(ctx, getActiveTerm(), userID)
+	if err != nil {
+		return err
+	}
+	choices := make([]string, len(choiceIDs))
+	for i, courseID := range choiceIDs {
+		choices[i] = strconv.Itoa(courseID)
+	}
+
+	err = writeText(ctx, c, "SNAP "+
+		stateString+" "+
+		confirmedString+" "+
+		strings.Join(requirements, ",")+" "+
+		strings.Join(courseTriples, ",")+" :"+
+		strings.Join(choices, ","),
+	)
+	if err != nil {
+		return wrapError(errCannotSend, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,308 @@
+/*
+ * Live staff dashboard over WebSocket
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+/*
+ * Staff connections only receive messages. Besides the batched M messages
+ * used for students (covering courses of all year groups), they receive:
+ *
+ *    G <group> <selected> <max> [<group> <selected> <max>]...
+ *    CONN <yeargroup> <count> [<yeargroup> <count>]...
+ *    CONF <yeargroup> <confirmed> <total> [<yeargroup> <confirmed> <total>]...
+ *    ERR <time> <source> :<message>
+ *
+ * G carries the fill rate of each course group, CONN the number of connected
+ * students in each year group, and CONF how many students who have logged in
+ * have confirmed their choices. G, CONN and CONF are sent on every dashboard
+ * tick, while ERR is sent as soon as an error is recorded. As with students,
+ * a connection that misses an M message because its send queue is full is
+ * sent the counts of every course on the following ticks instead.
+ */
+
+var staffChanPool sync.Map /* *chan string, string */
+
+/* All year group bits set, as staff see every course */
+const allYearGroupBits = ^uint8(0)
+
+func handleStaffConn(
+	ctx context.Context,
+	c *websocket.Conn,
+	userID string,
+) error {
+	send := make(chan string, config.Perf.SendQ)
+	staffChanPool.Store(&send, userID)
+	defer staffChanPool.Delete(&send)
+
+	session := &wsSessionT{
+		UserID:     userID,
+		Department: staffDepartment,
+	} //exhaustruct:ignore
+	session.touch()
+	wsSessions.Store(session, struct{}{})
+	defer wsSessions.Delete(session)
+
+	/*
+	 * Staff never send us anything, so CloseRead takes care of reading
+	 * control frames, including the pongs for our heartbeats. The
+	 * returned context is done once the connection is closed.
+	 */
+	readCtx := c.CloseRead(ctx)
+
+	_, snapshot, err := collectSelectedUpdates(allYearGroupBits, make(map[int]uint64))
+	if err != nil {
+		return err
+	}
+	msgs, err := buildStaffDashboard(readCtx)
+	if err != nil {
+		return err
+	}
+	if snapshot != "" {
+		msgs = append([]string{snapshot}, msgs...)
+	}
+	for _, e := range getRecentErrors() {
+		msgs = append(msgs, e.message())
+	}
+	for _, msg := range msgs {
+		err := writeText(readCtx, c, msg)
+		if err != nil {
+			return wrapError(errCannotSend, err)
+		}
+	}
+
+	ticker := time.NewTicker(
+		time.Duration(config.Perf.PingInterval) * time.Second,
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-readCtx.Done():
+			return nil
+		case <-ticker.C:
+			pingCtx, pingCancel := context.WithTimeout(
+				ctx,
+				time.Duration(config.Perf.PingTimeout)*time.Second,
+			)
+			err := c.Ping(pingCtx)
+			pingCancel()
+			if err != nil {
+				atomic.AddUint64(&wsReapedHeartbeat, 1)
+				return wrapError(errHeartbeatFailed, err)
+			}
+			session.touch()
+		case msg := <-send:
+			err := writeText(readCtx, c, msg)
+			if err != nil {
+				return wrapError(errCannotSend, err)
+			}
+		}
+	}
+}
+
+func propagateStaff(msg string) {
+	staffChanPool.Range(func(_ch, _userID interface{}) bool {
+		ch, ok := _ch.(*chan string)
+		if !ok {
+			slog.Error(errType.Error())
+			return false
+		}
+		select {
+		case *ch <- msg:
+		default:
+			slog.Warn(
+				"sendq",
+				"user", _userID,
+				"msg", msg,
+			)
+		}
+		return true
+	})
+}
+
+func broadcastStaffDashboard() {
+	defer func() {
+		if e := recover(); e != nil {
+			slog.Error("panic", "arg", e)
+		}
+	}()
+
+	lastVersions := make(map[int]uint64)
+	missed := make(map[*chan string]struct{})
+	ticker := time.NewTicker(
+		time.Duration(config.Perf.DashboardInterval) * time.Second,
+	)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		empty := true
+		staffChanPool.Range(func(_, _ interface{}) bool {
+			empty = false
+			return false
+		})
+		if empty {
+			continue
+		}
+
+		/*
+		 * Versions only advance here, so the M message must reach every
+		 * connection or be replaced by a snapshot for those it didn't.
+		 */
+		msg, snapshot, err := collectSelectedUpdates(allYearGroupBits, lastVersions)
+		if err != nil {
+			slog.Error("staff dashboard", "error", err)
+			continue
+		}
+		propagateStaffSelectedUpdates(msg, snapshot, missed)
+
+		msgs, err := buildStaffDashboard(context.Background())
+		if err != nil {
+			slog.Error("staff dashboard", "error", err)
+			continue
+		}
+		for _, msg := range msgs {
+			propagateStaff(msg)
+		}
+	}
+}
+
+/*
+ * Send msg to every staff connection, and snapshot instead to those in
+ * missed, which is updated with the connections whose send queues were
+ * full, like propagateSelectedUpdates. msg may be empty if nothing has
+ * changed.
+ */
+func propagateStaffSelectedUpdates(msg, snapshot string, missed map[*chan string]struct{}) {
+	connected := make(map[*chan string]struct{}, len(missed))
+	staffChanPool.Range(func(_ch, _userID interface{}) bool {
+		ch, ok := _ch.(*chan string)
+		if !ok {
+			slog.Error(errType.Error())
+			return false
+		}
+		connected[ch] = struct{}{}
+		toSend := msg
+		if _, ok := missed[ch]; ok {
+			toSend = snapshot
+		}
+		if toSend == "" {
+			return true
+		}
+		select {
+		case *ch <- toSend:
+			delete(missed, ch)
+		default:
+			missed[ch] = struct{}{}
+			slog.Warn(
+				"sendq",
+				"user", _userID,
+				"msg", toSend,
+			)
+		}
+		return true
+	})
+
+	/* Connections that have closed get every count if staff reconnect */
+	for ch := range missed {
+		if _, ok := connected[ch]; !ok {
+			delete(missed, ch)
+		}
+	}
+}
+
+/*
+ * Build the G, CONN and CONF messages, which describe everything at once
+ * and so are sent whole on every tick
+ */
+func buildStaffDashboard(ctx context.Context) ([]string, error) {
+	var msgs []string
+	var err error
+
+	type groupFillT struct {
+		Selected uint64
+		Max      uint64
+	}
+	groupFills := make(map[string]*groupFillT, len(courseGroups))
+	for group := range courseGroups {
+		groupFills[group] = &groupFillT{} //exhaustruct:ignore
+	}
+	courses.Range(func(_, value interface{}) bool {
+		course, ok := value.(*courseT)
+		if !ok {
+			err = errType
+			return false
+		}
+		groupFill, ok := groupFills[course.Group]
+		if !ok {
+			return true
+		}
+		groupFill.Selected += uint64(atomic.LoadUint32(&course.Selected))
+		groupFill.Max += uint64(course.Max)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	groupNames := getKeysOfMap(groupFills)
+	sort.Strings(groupNames)
+	var sb strings.Builder
+	sb.WriteString("G")
+	for _, group := range groupNames {
+		sb.WriteString(" " + group +
+			" " + strconv.FormatUint(groupFills[group].Selected, 10) +
+			" " + strconv.FormatUint(groupFills[group].Max, 10))
+	}
+	msgs = append(msgs, sb.String())
+
+	yearGroups := getKeysOfMap(states)
+	sort.Slice(yearGroups, func(i, j int) bool {
+		return yearGroupsNumberBits[yearGroups[i]] < yearGroupsNumberBits[yearGroups[j]]
+	})
+
+	connected := make(map[string]int, len(yearGroups))
+	wsSessions.Range(func(key, _ interface{}) bool {
+		session, ok := key.(*wsSessionT)
+		if ok {
+			connected[session.Department]++
+		}
+		return true
+	})
+	sb.Reset()
+	sb.WriteString("CONN")
+	for _, yeargroup := range yearGroups {
+		sb.WriteString(" " + yeargroup + " " + strconv.Itoa(connected[yeargroup]))
+	}
+	msgs = append(msgs, sb.String())
+
+	confirmations, err := store.getYearGroupCounts(ctx, getActiveTerm())
+	if err != nil {
+		return nil, err
+	}
+	sb.Reset()
+	sb.WriteString("CONF")
+	for _, yeargroup := range yearGroups {
+		sb.WriteString(" " + yeargroup +
+			" " + strconv.Itoa(confirmations[yeargroup].Confirmed) +
+			" " + strconv.Itoa(confirmations[yeargroup].Total))
+	}
+	msgs = append(msgs, sb.String())
+
+	return msgs, nil
+}
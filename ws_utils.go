@@ -67,19 +67,6 @@ endl:
 	return mar
 }
 
-func propagateSelectedUpdate(course *courseT) {
-	course.Usems.Range(func(key, value interface{}) bool {
-		_ = key
-		usem, ok := value.(*usemT)
-		if !ok {
-			slog.Error(errType.Error())
-			return false
-		}
-		usem.set()
-		return true
-	})
-}
-
 func sendSelectedUpdate(
 	ctx context.Context,
 	conn *websocket.Conn,
@@ -9,15 +9,10 @@ package main
 
 import (
 	"context"
-	"errors"
-	"log/slog"
 	"strconv"
 	"sync/atomic"
-	"time"
 
 	"github.com/coder/websocket"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 )
 
 func messageChooseCourse(
@@ -25,6 +20,7 @@ func messageChooseCourse(
 	c *websocket.Conn,
 	mar []string,
 	userID string,
+	ip string,
 	yeargroup string,
 	legalSex string,
 	userCourseGroups *userCourseGroupsT,
@@ -134,123 +130,60 @@ func messageChooseCourse(
 	//		return nil
 	//	}
 
-	err = func() (returnedError error) {
-		tx, err := db.Begin(ctx)
+	result, err := store.insertChoice(ctx, getActiveTerm(), userID, ip, courseID)
+	switch result {
+	case choiceAlreadyChosen:
+		err = writeText(ctx, c, "Y "+mar[1])
 		if err != nil {
-			return wrapError(errors.New("unexpected database error 34"), err)
+			return wrapError(
+				errCannotSend,
+				err,
+			)
 		}
-		defer func() {
-			err := tx.Rollback(ctx)
-			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
-				returnedError = wrapError(errors.New("unexpected database error 35"), err)
-				return
-			}
-		}()
-
-		_, err = tx.Exec(
-			ctx,
-			"INSERT INTO choices (seltime, userid, courseid, forced) VALUES ($1, $2, $3, false)",
-			time.Now().UnixMicro(),
-			userID,
-			courseID,
-		)
+		return nil
+	case choiceFull:
 		if err != nil {
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) &&
-				pgErr.Code == pgErrUniqueViolation {
-				err2 := writeText(ctx, c, "Y "+mar[1])
-				if err2 != nil {
-					return wrapError(
-						err2,
-						wrapError(errors.New("unexpected database error 36"), err),
-					)
-				}
-				return nil
-			}
-			return wrapError(errors.New("unexpected database error 37"), err)
+			return err
 		}
+		err = writeText(ctx, c, "R "+mar[1]+" :Full")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-		ok := func() bool {
-			course.SelectedLock.Lock()
-			defer course.SelectedLock.Unlock()
-			/*
-			 * The read here doesn't have to be atomic because the
-			 * lock guarantees that no other goroutine is writing to
-			 * it.
-			 */
-			if course.Selected < course.Max {
-				atomic.AddUint32(&course.Selected, 1)
-				/*
-				 * This write must be atomic because there
-				 * could be other atomic readers.
-				 */
-				return true
-			}
-			return false
-		}()
-
-		if ok {
-			go func() {
-				defer func() {
-					if e := recover(); e != nil {
-						slog.Error("panic", "arg", e)
-					}
-				}()
-				propagateSelectedUpdate(course)
-			}()
-			err := tx.Commit(ctx)
-			if err != nil {
-				err := course.decrementSelectedAndPropagate(ctx, c)
-				if err != nil {
-					return wrapError(
-						errCannotSend,
-						err,
-					)
-				}
-				return wrapError(errors.New("unexpected database error 38"), err)
-			}
+	atomic.AddUint32(&course.Selected, 1)
+	course.markUpdated()
 
-			/*
-			 * This would race if message handlers could run
-			 * concurrently for one connection.
-			 */
-			(*userCourseGroups)[course.Group] = struct{}{}
-			(*userCourseTypes)[course.Type]++
+	/*
+	 * This would race if message handlers could run concurrently for one
+	 * connection.
+	 */
+	(*userCourseGroups)[course.Group] = struct{}{}
+	(*userCourseTypes)[course.Type]++
 
-			err = writeText(ctx, c, "Y "+mar[1])
-			if err != nil {
-				return wrapError(
-					errCannotSend,
-					err,
-				)
-			}
+	err = writeText(ctx, c, "Y "+mar[1])
+	if err != nil {
+		return wrapError(
+			errCannotSend,
+			err,
+		)
+	}
 
-			if config.Perf.PropagateImmediate {
-				err = sendSelectedUpdate(ctx, c, courseID)
-				if err != nil {
-					return wrapError(
-						errCannotSend,
-						err,
-					)
-				}
-			}
-		} else {
-			err := tx.Rollback(ctx)
-			if err != nil {
-				return wrapError(errors.New("unexpected database error 39"), err)
-			}
-			err = writeText(ctx, c, "R "+mar[1]+" :Full")
-			if err != nil {
-				return wrapError(
-					errCannotSend,
-					err,
-				)
-			}
+	if config.Perf.PropagateImmediate {
+		err = sendSelectedUpdate(ctx, c, courseID)
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
 		}
-		return nil
-	}()
-	if err != nil {
-		return err
 	}
 	return nil
 }
@@ -9,7 +9,6 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"sync/atomic"
 
@@ -21,6 +20,7 @@ func messageConfirm(
 	c *websocket.Conn,
 	mar []string,
 	userID string,
+	ip string,
 	department string,
 	userCourseTypes *userCourseTypesT,
 ) error {
@@ -72,13 +72,9 @@ func messageConfirm(
 		}
 	}
 
-	_, err := db.Exec(
-		ctx,
-		"UPDATE users SET confirmed = true WHERE id = $1",
-		userID,
-	)
+	err := store.setConfirmed(ctx, getActiveTerm(), userID, ip, true)
 	if err != nil {
-		return wrapError(errors.New("unexpected database error 40"), err)
+		return err
 	}
 
 	return writeText(
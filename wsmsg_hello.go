@@ -9,14 +9,18 @@ package main
 
 import (
 	"context"
-	"errors"
+	"strconv"
 	"strings"
 	"sync/atomic"
 
 	"github.com/coder/websocket"
-	"github.com/jackc/pgx/v5"
 )
 
+/*
+ * HELLO is deprecated, as the same information is pushed to the client in the
+ * snapshot sent when the connection is established. It is kept for clients
+ * that still send it.
+ */
 func messageHello(
 	ctx context.Context,
 	c *websocket.Conn,
@@ -35,17 +39,13 @@ func messageHello(
 	default:
 	}
 
-	rows, err := db.Query(
-		ctx,
-		"SELECT courseid FROM choices WHERE userid = $1",
-		userID,
-	)
+	choiceIDs, err := store.getUserChoices(ctx, getActiveTerm(), userID)
 	if err != nil {
-		return wrapError(errors.New("unexpected database error 41"), err)
+		return err
 	}
-	courseIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
-	if err != nil {
-		return wrapError(errors.New("unexpected database error 42"), err)
+	courseIDs := make([]string, len(choiceIDs))
+	for i, courseID := range choiceIDs {
+		courseIDs[i] = strconv.Itoa(courseID)
 	}
 
 	_state, ok := states[yeargroup]
@@ -64,7 +64,7 @@ func messageHello(
 		}
 	}
 
-	confirmed, err := getConfirmedStatus(ctx, userID)
+	confirmed, err := store.getConfirmed(ctx, getActiveTerm(), userID)
 	if err != nil {
 		return err
 	}
@@ -9,7 +9,6 @@ package main
 
 import (
 	"context"
-	"errors"
 	"strconv"
 	"sync/atomic"
 
@@ -21,6 +20,7 @@ func messageUnchooseCourse(
 	c *websocket.Conn,
 	mar []string,
 	userID string,
+	ip string,
 	yeargroup string,
 	userCourseGroups *userCourseGroupsT,
 	userCourseTypes *userCourseTypesT,
@@ -72,17 +72,12 @@ func messageUnchooseCourse(
 		return nil
 	}
 
-	ct, err := db.Exec(
-		ctx,
-		"DELETE FROM choices WHERE userid = $1 AND courseid = $2",
-		userID,
-		courseID,
-	)
+	found, err := store.deleteChoice(ctx, getActiveTerm(), userID, ip, courseID)
 	if err != nil {
-		return wrapError(errors.New("unexpected database error 43"), err)
+		return err
 	}
 
-	if ct.RowsAffected() != 0 {
+	if found {
 		err := course.decrementSelectedAndPropagate(ctx, c)
 		if err != nil {
 			return wrapError(
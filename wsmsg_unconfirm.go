@@ -9,7 +9,6 @@ package main
 
 import (
 	"context"
-	"errors"
 	"sync/atomic"
 
 	"github.com/coder/websocket"
@@ -20,6 +19,7 @@ func messageUnconfirm(
 	c *websocket.Conn,
 	mar []string,
 	userID string,
+	ip string,
 	yeargroup string,
 ) error {
 	_ = mar
@@ -48,13 +48,9 @@ func messageUnconfirm(
 	default:
 	}
 
-	_, err := db.Exec(
-		ctx,
-		"UPDATE users SET confirmed = false WHERE id = $1",
-		userID,
-	)
+	err := store.setConfirmed(ctx, getActiveTerm(), userID, ip, false)
 	if err != nil {
-		return wrapError(errors.New("unexpected database error 44"), err)
+		return err
 	}
 
 	return writeText(
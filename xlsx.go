@@ -0,0 +1,279 @@
+/*
+ * Minimal XLSX writer
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * This only implements what we need for exports: several sheets, each with a
+ * bold and frozen header row, and cells that are strings, numbers, booleans
+ * or times. Strings are written inline so that no shared string table is
+ * needed. Times are converted to spreadsheet serial dates in loc.
+ */
+
+type xlsxSheetT struct {
+	Name   string
+	Header []string
+	Rows   [][]interface{}
+}
+
+const (
+	xlsxStyleDefault = 0
+	xlsxStyleHeader  = 1
+	xlsxStyleTime    = 2
+)
+
+const xlsxContentTypesHead = xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+	`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+	`<Default Extension="xml" ContentType="application/xml"/>` +
+	`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+	`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`
+
+const xlsxRootRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+const xlsxStyles = xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts>` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="3">` +
+	`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`</cellXfs>` +
+	`</styleSheet>`
+
+/* Sheet names are limited to 31 characters and may not contain []:*?/\ */
+func xlsxSheetName(name string, used map[string]struct{}) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '[', ']', ':', '*', '?', '/', '\\':
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, "'")
+	if name == "" {
+		name = "Sheet"
+	}
+	base := []rune(name)
+	for i := 1; ; i++ {
+		suffix := ""
+		if i > 1 {
+			suffix = " (" + strconv.Itoa(i) + ")"
+		}
+		r := base
+		if len(r)+len(suffix) > 31 {
+			r = r[:31-len(suffix)]
+		}
+		candidate := string(r) + suffix
+		if _, ok := used[strings.ToLower(candidate)]; !ok {
+			used[strings.ToLower(candidate)] = struct{}{}
+			return candidate
+		}
+	}
+}
+
+func xlsxColumnName(col int) string {
+	var name []byte
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = append([]byte{byte('A' + (col-1)%26)}, name...)
+	}
+	return string(name)
+}
+
+/* Spreadsheet serial dates count days since 1899-12-30 */
+func xlsxSerialTime(t time.Time) float64 {
+	t = t.In(loc)
+	wall := time.Date(
+		t.Year(), t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second(), t.Nanosecond(),
+		time.UTC,
+	)
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	return wall.Sub(epoch).Hours() / 24
+}
+
+func xlsxEscape(w *bufio.Writer, s string) error {
+	return xml.EscapeText(w, []byte(s))
+}
+
+func xlsxWriteCell(w *bufio.Writer, ref string, value interface{}) error {
+	var err error
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		_, err = w.WriteString(`<c r="` + ref + `" t="inlineStr"><is><t xml:space="preserve">`)
+		if err == nil {
+			err = xlsxEscape(w, v)
+		}
+		if err == nil {
+			_, err = w.WriteString(`</t></is></c>`)
+		}
+	case bool:
+		b := "0"
+		if v {
+			b = "1"
+		}
+		_, err = w.WriteString(`<c r="` + ref + `" t="b"><v>` + b + `</v></c>`)
+	case int:
+		_, err = w.WriteString(`<c r="` + ref + `"><v>` + strconv.Itoa(v) + `</v></c>`)
+	case int64:
+		_, err = w.WriteString(`<c r="` + ref + `"><v>` + strconv.FormatInt(v, 10) + `</v></c>`)
+	case uint32:
+		_, err = w.WriteString(`<c r="` + ref + `"><v>` + strconv.FormatUint(uint64(v), 10) + `</v></c>`)
+	case float64:
+		_, err = w.WriteString(`<c r="` + ref + `"><v>` + strconv.FormatFloat(v, 'g', -1, 64) + `</v></c>`)
+	case time.Time:
+		_, err = w.WriteString(`<c r="` + ref + `" s="` + strconv.Itoa(xlsxStyleTime) + `"><v>` +
+			strconv.FormatFloat(xlsxSerialTime(v), 'f', -1, 64) + `</v></c>`)
+	default:
+		return errType
+	}
+	return err
+}
+
+func xlsxWriteSheet(zw *zip.Writer, index int, sheet xlsxSheetT) error {
+	fw, err := zw.Create("xl/worksheets/sheet" + strconv.Itoa(index) + ".xml")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fw)
+
+	_, err = w.WriteString(xml.Header +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<sheetViews><sheetView workbookViewId="0">` +
+		`<pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/>` +
+		`</sheetView></sheetViews><sheetData>`)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.WriteString(`<row r="1">`)
+	if err != nil {
+		return err
+	}
+	for col, title := range sheet.Header {
+		_, err = w.WriteString(`<c r="` + xlsxColumnName(col) + `1" t="inlineStr" s="` +
+			strconv.Itoa(xlsxStyleHeader) + `"><is><t>`)
+		if err != nil {
+			return err
+		}
+		err = xlsxEscape(w, title)
+		if err != nil {
+			return err
+		}
+		_, err = w.WriteString(`</t></is></c>`)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.WriteString(`</row>`)
+	if err != nil {
+		return err
+	}
+
+	for i, row := range sheet.Rows {
+		rowNumber := strconv.Itoa(i + 2)
+		_, err = w.WriteString(`<row r="` + rowNumber + `">`)
+		if err != nil {
+			return err
+		}
+		for col, value := range row {
+			err = xlsxWriteCell(w, xlsxColumnName(col)+rowNumber, value)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = w.WriteString(`</row>`)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.WriteString(`</sheetData></worksheet>`)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func writeXLSX(out io.Writer, sheets []xlsxSheetT) error {
+	zw := zip.NewWriter(out)
+
+	var contentTypes, workbook, workbookRels strings.Builder
+	contentTypes.WriteString(xlsxContentTypesHead)
+	workbook.WriteString(xml.Header +
+		`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	workbookRels.WriteString(xml.Header +
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+
+	used := make(map[string]struct{}, len(sheets))
+	for i, sheet := range sheets {
+		n := strconv.Itoa(i + 1)
+		contentTypes.WriteString(`<Override PartName="/xl/worksheets/sheet` + n +
+			`.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`)
+		workbook.WriteString(`<sheet name="`)
+		err := xml.EscapeText(&workbook, []byte(xlsxSheetName(sheet.Name, used)))
+		if err != nil {
+			return err
+		}
+		workbook.WriteString(`" sheetId="` + n + `" r:id="rId` + n + `"/>`)
+		workbookRels.WriteString(`<Relationship Id="rId` + n +
+			`" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet` +
+			n + `.xml"/>`)
+	}
+	stylesID := strconv.Itoa(len(sheets) + 1)
+	workbookRels.WriteString(`<Relationship Id="rId` + stylesID +
+		`" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`)
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	workbookRels.WriteString(`</Relationships>`)
+
+	for _, file := range []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", contentTypes.String()},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", workbook.String()},
+		{"xl/_rels/workbook.xml.rels", workbookRels.String()},
+		{"xl/styles.xml", xlsxStyles},
+	} {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(fw, file.content)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, sheet := range sheets {
+		err := xlsxWriteSheet(zw, i+1, sheet)
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}